@@ -0,0 +1,162 @@
+// A client for tools talking to an anchor server, like bots, bridges and
+// trackers. Handles framing and answers the server's pings
+import { writeAll } from "https://deno.land/std@0.208.0/streams/write_all.ts";
+import {
+  type ClientData,
+  decodePacket,
+  decryptPacket,
+  encodePacket,
+  encryptPacket,
+  findDelimiterIndex,
+  type GamePacket,
+  type Packet,
+  type RoomOptions,
+} from "./protocol.ts";
+
+export { deriveRoomKey } from "./protocol.ts";
+export type {
+  ClientData,
+  GamePacket,
+  Packet,
+  RoomOptions,
+} from "./protocol.ts";
+
+type PacketHandler = (packet: Packet | GamePacket) => void;
+
+export class AnchorClient {
+  private connection: Deno.Conn;
+  // By packet type, "*" receives every packet
+  private handlers = new Map<string, PacketHandler[]>();
+  private pingSentAt?: number;
+  private pongWaiters: ((rtt: number) => void)[] = [];
+  private roomKey?: CryptoKey;
+  // Encryption is async, chained so packets keep their order both ways
+  private sending = Promise.resolve();
+  private receiving = Promise.resolve();
+  // Resolves once the server closes the connection, or close() is called
+  public readonly closed: Promise<void>;
+
+  private constructor(connection: Deno.Conn) {
+    this.connection = connection;
+    this.closed = this.read();
+  }
+
+  static async connect(hostname = "localhost", port = 43385) {
+    return new AnchorClient(await Deno.connect({ hostname, port }));
+  }
+
+  // For servers behind a TLS proxy, cert and key are only needed when it
+  // checks client certificates
+  static async connectTls(options: Deno.ConnectTlsOptions) {
+    return new AnchorClient(await Deno.connectTls(options));
+  }
+
+  on(type: string, handler: PacketHandler) {
+    this.handlers.set(type, [...this.handlers.get(type) ?? [], handler]);
+  }
+
+  send(packet: Packet | GamePacket) {
+    const sent = this.sending.then(async () => {
+      const sealed = this.roomKey
+        ? await encryptPacket(packet, this.roomKey)
+        : packet;
+      await writeAll(this.connection, encodePacket(sealed));
+    });
+    this.sending = sent.catch(() => {});
+    return sent;
+  }
+
+  // From deriveRoomKey, game packets and save states are encrypted with it
+  // from now on and incoming ones decrypted
+  setRoomKey(key: CryptoKey | undefined) {
+    this.roomKey = key;
+  }
+
+  // Joins (creating if needed) a room, roomOptions only apply when creating it
+  join(roomId: string, data: ClientData, roomOptions?: RoomOptions) {
+    return this.send({
+      type: "UPDATE_CLIENT_DATA",
+      roomId,
+      roomOptions,
+      data,
+    });
+  }
+
+  // Resolves with the round trip time in ms
+  async ping() {
+    const pong = new Promise<number>((resolve) => {
+      this.pongWaiters.push(resolve);
+    });
+    this.pingSentAt ??= Date.now();
+    await this.send({ type: "PING", quiet: true });
+    return pong;
+  }
+
+  close() {
+    try {
+      this.connection.close();
+    } catch (_) {
+      // Already closed by the server
+    }
+  }
+
+  private async read() {
+    const buffer = new Uint8Array(1024 * 64);
+    let data = new Uint8Array(0);
+
+    while (true) {
+      let count: number | null;
+      try {
+        count = await this.connection.read(buffer);
+      } catch (_) {
+        count = null;
+      }
+      if (!count) {
+        return;
+      }
+
+      const received = new Uint8Array(data.length + count);
+      received.set(data);
+      received.set(buffer.subarray(0, count), data.length);
+      data = received;
+
+      let delimiterIndex;
+      while ((delimiterIndex = findDelimiterIndex(data)) !== -1) {
+        const packet = data.subarray(0, delimiterIndex);
+        data = data.subarray(delimiterIndex + 1);
+        let decoded: Packet | GamePacket;
+        try {
+          decoded = decodePacket(packet);
+        } catch (error) {
+          console.error(`Error handling packet: ${error.message}`);
+          continue;
+        }
+        this.receiving = this.receiving
+          .then(async () => {
+            const key = this.roomKey;
+            const plain = key ? await decryptPacket(decoded, key) : decoded;
+            this.handlePacket(plain);
+          })
+          .catch((error) => {
+            console.error(`Error handling packet: ${error.message}`);
+          });
+      }
+    }
+  }
+
+  private handlePacket(packet: Packet | GamePacket) {
+    if (packet.type === "PING") {
+      this.send({ type: "PONG", quiet: true }).catch(() => {});
+    } else if (packet.type === "PONG" && this.pingSentAt !== undefined) {
+      const rtt = Date.now() - this.pingSentAt;
+      this.pingSentAt = undefined;
+      this.pongWaiters.splice(0).forEach((resolve) => resolve(rtt));
+    }
+
+    for (const type of [packet.type, "*"]) {
+      for (const handler of this.handlers.get(type) ?? []) {
+        handler(packet);
+      }
+    }
+  }
+}
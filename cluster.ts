@@ -0,0 +1,193 @@
+// Shares rooms between anchor instances through Redis, so several behind one
+// hostname can host the same room. Each room's settings are registered by
+// whichever instance creates it first, packets are relayed over a channel per
+// room, and clientIds are handed out in blocks so they're unique across the
+// cluster
+import type { ClientData, Packet, RoomOptions } from "./protocol.ts";
+import { RedisClient } from "./redis.ts";
+import { writeLog } from "./server.ts";
+
+const timeoutMs = 5 * 1000;
+// Reserved at a time, another block is reserved once half are used
+const clientIdBlockSize = 1000;
+// Registry entries expire unless an instance refreshes them, see report
+const roomTtlSeconds = 60;
+
+// What the instance that created a room decided, so every instance holds
+// joiners to the same seed, game and version
+export interface SharedRoom {
+  options: RoomOptions;
+  seedHash?: string;
+  settings?: string;
+  gameId?: string;
+  requiredClientVersion?: string;
+}
+
+// Published to a room's channel. Exactly one of packet, members or savedState
+export interface RoomMessage {
+  instanceId: string;
+  // Relayed as if sent by one of this instance's clients, to teamId only if
+  // set and to packet.targetClientId only if that's set
+  packet?: Packet;
+  teamId?: string;
+  // Came in as a datagram, and goes out as one where it can
+  unreliable?: boolean;
+  // Every client in the room on the sending instance, as in ALL_CLIENT_DATA
+  members?: ClientData[];
+  // A PUSH_SAVE_STATE and the saveStateKey it was stored under
+  savedState?: Packet;
+  saveStateKey?: string;
+}
+
+export class Cluster {
+  private redis: RedisClient;
+  // Reserved and not yet used up, oldest first. Other instances may reserve
+  // in between, so they aren't contiguous
+  private idBlocks: { next: number; last: number }[] = [];
+  private reserving?: Promise<void>;
+
+  constructor(
+    public readonly url: string,
+    private readonly prefix: string,
+    private readonly instanceId: string,
+  ) {
+    this.redis = new RedisClient(url);
+  }
+
+  // Once before clients connect, later blocks are reserved in the background
+  async reserveClientIds() {
+    const lastId = await this.command(
+      "INCRBY",
+      `${this.prefix}:clientIds`,
+      clientIdBlockSize,
+    );
+    if (typeof lastId !== "number") {
+      throw new Error(`unexpected reply ${JSON.stringify(lastId)}`);
+    }
+    this.idBlocks.push({ next: lastId - clientIdBlockSize + 1, last: lastId });
+  }
+
+  // Undefined once every reserved id is used and Redis hasn't answered yet
+  nextClientId() {
+    const remaining = this.idBlocks.reduce(
+      (total, block) => total + block.last - block.next + 1,
+      0,
+    );
+    if (remaining < clientIdBlockSize / 2) {
+      this.reserving ??= this.reserveClientIds()
+        .catch((error) => {
+          writeLog("error", `Error reserving clientIds: ${error.message}`);
+        })
+        .finally(() => this.reserving = undefined);
+    }
+
+    const block = this.idBlocks[0];
+    if (!block) {
+      return;
+    }
+    const id = block.next++;
+    if (block.next > block.last) {
+      this.idBlocks.shift();
+    }
+    return id;
+  }
+
+  // Registers the room with these settings unless another instance already
+  // has, and returns the ones that stick
+  async claimRoom(roomId: string, shared: SharedRoom) {
+    const key = this.roomKey(roomId);
+    await this.command("HSETNX", key, "shared", JSON.stringify(shared));
+    await this.command("EXPIRE", key, roomTtlSeconds);
+    const stored = await this.command("HGET", key, "shared");
+    return typeof stored === "string"
+      ? JSON.parse(stored) as SharedRoom
+      : shared;
+  }
+
+  // Keeps the room registered while this instance has it, with how many of its
+  // clients are here
+  async report(roomId: string, clients: number) {
+    const key = this.roomKey(roomId);
+    await this.command("HSET", key, `instance:${this.instanceId}`, clients);
+    await this.command("EXPIRE", key, roomTtlSeconds);
+  }
+
+  // handler gets other instances' messages for the room until leaveRoom
+  joinRoom(roomId: string, handler: (message: RoomMessage) => void) {
+    this.subscribe(this.roomKey(roomId), handler);
+  }
+
+  async leaveRoom(roomId: string) {
+    this.redis.unsubscribe(this.roomKey(roomId));
+    await this.command(
+      "HDEL",
+      this.roomKey(roomId),
+      `instance:${this.instanceId}`,
+    );
+  }
+
+  publish(roomId: string, message: Omit<RoomMessage, "instanceId">) {
+    this.redis.command(
+      "PUBLISH",
+      this.roomKey(roomId),
+      JSON.stringify({ instanceId: this.instanceId, ...message }),
+    ).catch((error) => {
+      writeLog("error", `Error publishing to Redis: ${error.message}`);
+    });
+  }
+
+  // Admin actions for every instance, see Server.runClusterAction
+  subscribeActions(handler: (body: string) => void) {
+    this.redis.subscribe(`${this.prefix}:cluster`, handler);
+  }
+
+  publishAction(body: string) {
+    this.redis.command("PUBLISH", `${this.prefix}:cluster`, body)
+      .catch((error) => {
+        writeLog("error", `Error publishing to Redis: ${error.message}`);
+      });
+  }
+
+  close() {
+    this.redis.close();
+  }
+
+  private roomKey(roomId: string) {
+    return `${this.prefix}:room:${roomId}`;
+  }
+
+  private subscribe(
+    channel: string,
+    handler: (message: RoomMessage) => void,
+  ) {
+    this.redis.subscribe(channel, (body) => {
+      try {
+        const message: RoomMessage = JSON.parse(body);
+        // Messages this instance published come back to it too
+        if (message.instanceId !== this.instanceId) {
+          handler(message);
+        }
+      } catch (error) {
+        writeLog(
+          "error",
+          `Error handling message from Redis: ${error.message}`,
+        );
+      }
+    });
+  }
+
+  // Waits for a connection, but fails rather than hanging while Redis is down
+  // or slow to answer
+  private command(...args: (string | number)[]) {
+    let timer: number | undefined;
+    return Promise.race([
+      this.redis.ready().then(() => this.redis.command(...args)),
+      new Promise<never>((_, reject) => {
+        timer = setTimeout(
+          () => reject(new Error("Redis didn't answer in time")),
+          timeoutMs,
+        );
+      }),
+    ]).finally(() => clearTimeout(timer));
+  }
+}
@@ -0,0 +1,121 @@
+// Registers the server with Consul or a simple HTTP registry so launchers can
+// find the nearest community server, and takes it off again on shutdown
+const timeoutMs = 10 * 1000;
+const consulDefaultPort = 8500;
+
+export interface Registration {
+  id: string;
+  address: string;
+  port: number;
+  region?: string;
+  // Players connected and the most allowed, 0 for no limit
+  clients: number;
+  maxClients: number;
+  version: string;
+  // Consul checks this, if set, and drops the server once it's failed a while
+  healthUrl?: string;
+}
+
+export interface ServiceRegistry {
+  readonly url: string;
+  // Called again periodically, so counts stay current and entries don't expire
+  register(registration: Registration): Promise<void>;
+  deregister(id: string): Promise<void>;
+}
+
+// url is consul://[token@]host[:port] for a Consul agent, or an http(s):// URL
+// registrations are POSTed to and deleted from as url/<id>
+export function createServiceRegistry(url: string): ServiceRegistry {
+  const { protocol } = new URL(url);
+  if (protocol === "consul:") {
+    return new ConsulRegistry(url);
+  } else if (protocol === "http:" || protocol === "https:") {
+    return new HttpRegistry(url);
+  }
+  throw new Error(`Unsupported registry ${url}, use consul:// or http(s)://`);
+}
+
+// https://developer.hashicorp.com/consul/api-docs/agent/service
+class ConsulRegistry implements ServiceRegistry {
+  private agentUrl: string;
+  private headers: Record<string, string> = {};
+
+  constructor(public readonly url: string) {
+    const { hostname, port, username } = new URL(url);
+    this.agentUrl = `http://${hostname}:${port || consulDefaultPort}`;
+    if (username) {
+      this.headers["X-Consul-Token"] = decodeURIComponent(username);
+    }
+  }
+
+  async register(registration: Registration) {
+    const { id, address, port, region, healthUrl } = registration;
+    await send(`${this.agentUrl}/v1/agent/service/register`, {
+      method: "PUT",
+      headers: this.headers,
+      body: JSON.stringify({
+        ID: id,
+        Name: "anchor",
+        Address: address,
+        Port: port,
+        Tags: region ? [region] : [],
+        // Meta values must be strings
+        Meta: {
+          region: region ?? "",
+          clients: String(registration.clients),
+          maxClients: String(registration.maxClients),
+          version: registration.version,
+        },
+        Check: healthUrl
+          ? {
+            HTTP: healthUrl,
+            Interval: "10s",
+            DeregisterCriticalServiceAfter: "5m",
+          }
+          : undefined,
+      }),
+    });
+  }
+
+  async deregister(id: string) {
+    await send(
+      `${this.agentUrl}/v1/agent/service/deregister/${encodeURIComponent(id)}`,
+      { method: "PUT", headers: this.headers },
+    );
+  }
+}
+
+class HttpRegistry implements ServiceRegistry {
+  constructor(public readonly url: string) {}
+
+  async register(registration: Registration) {
+    await send(this.url, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(registration),
+    });
+  }
+
+  async deregister(id: string) {
+    await send(`${this.url.replace(/\/$/, "")}/${encodeURIComponent(id)}`, {
+      method: "DELETE",
+    });
+  }
+}
+
+// Throws unless the registry answers with a 2xx
+async function send(url: string, init: RequestInit) {
+  const response = await fetch(url, {
+    ...init,
+    signal: AbortSignal.timeout(timeoutMs),
+  });
+  await response.body?.cancel();
+  if (!response.ok) {
+    throw new Error(`${redact(url)} answered ${response.status}`);
+  }
+}
+
+// Without any credentials, for logging
+export function redact(url: string) {
+  return url.replace(/\/\/[^@/]*@/, "//");
+}
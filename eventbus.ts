@@ -0,0 +1,277 @@
+// Streams server events onto NATS or Kafka for analytics pipelines and other
+// automation. Events published while the bus is unreachable are dropped, it's
+// a live feed rather than a durable log
+import { writeLog } from "./server.ts";
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+
+const reconnectDelayMs = 5000;
+const natsDefaultPort = 4222;
+
+export interface EventPublisher {
+  readonly url: string;
+  readonly topic: string;
+  publish(event: string, body: string): void;
+  // Only NATS supports this, for clustering
+  subscribe?(name: string, handler: (body: string) => void): void;
+  close(): void;
+}
+
+// url is nats://[user:pass@|token@]host[:port] or
+// kafka://broker[:port][,broker[:port]...]. topic is the NATS subject prefix,
+// or the Kafka topic with the event as each message's key
+export function createEventPublisher(
+  url: string,
+  topic: string,
+): EventPublisher {
+  // Not new URL(url).protocol, Kafka URLs can list several hosts
+  const scheme = url.split("://")[0];
+  if (scheme === "nats") {
+    return new NatsPublisher(url, topic);
+  } else if (scheme === "kafka") {
+    return new KafkaPublisher(url, topic);
+  }
+  throw new Error(`Unsupported event bus ${url}, use nats:// or kafka://`);
+}
+
+// Just enough of the NATS text protocol to publish and subscribe, see
+// https://docs.nats.io/reference/reference-protocols/nats-protocol
+class NatsPublisher implements EventPublisher {
+  private connection?: Deno.Conn;
+  private writing = Promise.resolve();
+  private closed = false;
+  private dropped = 0;
+  // Indexed by sid - 1
+  private subscriptions: {
+    subject: string;
+    handler: (body: string) => void;
+  }[] = [];
+
+  constructor(public readonly url: string, public readonly topic: string) {
+    this.connect();
+  }
+
+  publish(event: string, body: string) {
+    if (!this.connection) {
+      this.dropped++;
+      return;
+    }
+
+    const payload = encoder.encode(body);
+    this.write(
+      `PUB ${this.topic}.${event} ${payload.length}\r\n${body}\r\n`,
+    );
+  }
+
+  // Messages published to <topic>.<name>, including by this process
+  subscribe(name: string, handler: (body: string) => void) {
+    const subject = `${this.topic}.${name}`;
+    const sid = this.subscriptions.push({ subject, handler });
+    this.write(`SUB ${subject} ${sid}\r\n`);
+  }
+
+  close() {
+    this.closed = true;
+    this.connection?.close();
+    this.connection = undefined;
+  }
+
+  private async connect() {
+    while (!this.closed) {
+      try {
+        const { hostname, port, username, password } = new URL(this.url);
+        const connection = await Deno.connect({
+          hostname,
+          port: port ? parseInt(port, 10) : natsDefaultPort,
+        });
+        // A user without a password is a token
+        const auth = password
+          ? {
+            user: decodeURIComponent(username),
+            pass: decodeURIComponent(password),
+          }
+          : username
+          ? { auth_token: decodeURIComponent(username) }
+          : {};
+        this.connection = connection;
+        this.write(
+          `CONNECT ${
+            JSON.stringify({
+              verbose: false,
+              pedantic: false,
+              name: "anchor",
+              lang: "deno",
+              ...auth,
+            })
+          }\r\n`,
+        );
+        this.subscriptions.forEach(({ subject }, i) => {
+          this.write(`SUB ${subject} ${i + 1}\r\n`);
+        });
+        writeLog("info", `Connected to event bus ${redact(this.url)}`);
+        if (this.dropped) {
+          writeLog("info", `Dropped ${this.dropped} events while disconnected`);
+          this.dropped = 0;
+        }
+
+        await this.read(connection);
+      } catch (error) {
+        writeLog("error", `Error connecting to event bus: ${error.message}`);
+      }
+
+      this.connection = undefined;
+      if (!this.closed) {
+        await new Promise((resolve) => setTimeout(resolve, reconnectDelayMs));
+      }
+    }
+  }
+
+  // Answers the server's PINGs and delivers messages until the connection
+  // closes
+  private async read(connection: Deno.Conn) {
+    let buffered = new Uint8Array(0);
+    const chunk = new Uint8Array(16 * 1024);
+    while (true) {
+      const read = await connection.read(chunk);
+      if (read === null) {
+        return;
+      }
+      const merged = new Uint8Array(buffered.length + read);
+      merged.set(buffered);
+      merged.set(chunk.subarray(0, read), buffered.length);
+      buffered = merged;
+
+      let offset = 0;
+      let lineEnd;
+      while ((lineEnd = indexOfCrlf(buffered, offset)) !== -1) {
+        const line = decoder.decode(buffered.subarray(offset, lineEnd));
+        if (line.startsWith("MSG ")) {
+          // MSG <subject> <sid> [reply-to] <bytes>, then the payload, read by
+          // its length as other publishers' payloads can contain anything
+          const fields = line.split(" ");
+          const payloadEnd = lineEnd + 2 + parseInt(fields.at(-1)!, 10);
+          if (buffered.length < payloadEnd + 2) {
+            break;
+          }
+          const payload = buffered.subarray(lineEnd + 2, payloadEnd);
+          this.subscriptions[parseInt(fields[2], 10) - 1]?.handler(
+            decoder.decode(payload),
+          );
+          offset = payloadEnd + 2;
+          continue;
+        }
+
+        if (line === "PING") {
+          this.write("PONG\r\n");
+        } else if (line.startsWith("-ERR")) {
+          writeLog("error", `Error from event bus: ${line.slice(5)}`);
+        }
+        offset = lineEnd + 2;
+      }
+      buffered = buffered.slice(offset);
+    }
+  }
+
+  private write(text: string) {
+    const { connection } = this;
+    if (!connection) {
+      return;
+    }
+
+    const data = encoder.encode(text);
+    this.writing = this.writing.then(async () => {
+      let written = 0;
+      while (written < data.length) {
+        written += await connection.write(data.subarray(written));
+      }
+    }).catch(() => {
+      // The read loop notices the connection closing and reconnects
+    });
+  }
+}
+
+// kafkajs is only downloaded when a Kafka bus is configured
+interface KafkaProducer {
+  connect(): Promise<void>;
+  disconnect(): Promise<void>;
+  send(record: {
+    topic: string;
+    messages: { key: string; value: string }[];
+  }): Promise<unknown>;
+}
+
+class KafkaPublisher implements EventPublisher {
+  private producer?: KafkaProducer;
+  private closed = false;
+  private dropped = 0;
+
+  constructor(public readonly url: string, public readonly topic: string) {
+    this.connect().catch((error) => {
+      writeLog("error", `Error loading Kafka client: ${error.message}`);
+    });
+  }
+
+  publish(event: string, body: string) {
+    if (!this.producer) {
+      this.dropped++;
+      return;
+    }
+
+    this.producer.send({
+      topic: this.topic,
+      messages: [{ key: event, value: body }],
+    }).catch((error) => {
+      writeLog("error", `Error publishing to event bus: ${error.message}`);
+    });
+  }
+
+  close() {
+    this.closed = true;
+    this.producer?.disconnect().catch(() => {});
+    this.producer = undefined;
+  }
+
+  private async connect() {
+    // The URL parser only understands a single host
+    const brokers = this.url.slice("kafka://".length).split("/")[0].split(",");
+    const { Kafka } = await import("npm:kafkajs@2.2.4");
+    const producer: KafkaProducer = new Kafka({ clientId: "anchor", brokers })
+      .producer();
+
+    // kafkajs reconnects by itself once the first connection is made
+    while (!this.closed) {
+      try {
+        await producer.connect();
+        if (this.closed) {
+          await producer.disconnect();
+          return;
+        }
+        this.producer = producer;
+        writeLog("info", `Connected to event bus ${redact(this.url)}`);
+        if (this.dropped) {
+          writeLog("info", `Dropped ${this.dropped} events while disconnected`);
+          this.dropped = 0;
+        }
+        return;
+      } catch (error) {
+        writeLog("error", `Error connecting to event bus: ${error.message}`);
+        await new Promise((resolve) => setTimeout(resolve, reconnectDelayMs));
+      }
+    }
+  }
+}
+
+// Without any credentials, for logging
+function redact(url: string) {
+  return url.replace(/\/\/[^@/]*@/, "//");
+}
+
+function indexOfCrlf(buffer: Uint8Array, offset: number) {
+  for (let i = offset; i < buffer.length - 1; i++) {
+    if (buffer[i] === 13 && buffer[i + 1] === 10) {
+      return i;
+    }
+  }
+  return -1;
+}
@@ -0,0 +1,123 @@
+// Verifies JSON Web Tokens issued by an external identity provider, like a
+// community's Discord bot. HS256 uses a shared secret, RS256 and ES256 the
+// provider's public key
+import { decodeBase64 } from "https://deno.land/std@0.208.0/encoding/base64.ts";
+import {
+  decodeBase64Url,
+} from "https://deno.land/std@0.208.0/encoding/base64url.ts";
+
+const decoder = new TextDecoder();
+const encoder = new TextEncoder();
+
+// Tolerated difference between our clock and the provider's
+const clockSkewSeconds = 30;
+
+const algorithms = {
+  HS256: {
+    importParams: { name: "HMAC", hash: "SHA-256" },
+    verifyParams: { name: "HMAC" },
+  },
+  RS256: {
+    importParams: { name: "RSASSA-PKCS1-v1_5", hash: "SHA-256" },
+    verifyParams: { name: "RSASSA-PKCS1-v1_5" },
+  },
+  ES256: {
+    importParams: { name: "ECDSA", namedCurve: "P-256" },
+    verifyParams: { name: "ECDSA", hash: "SHA-256" },
+  },
+};
+
+type JwtAlgorithm = keyof typeof algorithms;
+
+export interface JwtKey {
+  algorithm: JwtAlgorithm;
+  key: CryptoKey;
+}
+
+export interface JwtClaims {
+  sub?: string;
+  iss?: string;
+  aud?: string | string[];
+  exp?: number;
+  nbf?: number;
+  [claim: string]: unknown;
+}
+
+// material is the secret for HS256, otherwise a PEM encoded public key
+export async function importJwtKey(
+  algorithm: string,
+  material: string,
+): Promise<JwtKey> {
+  if (!(algorithm in algorithms)) {
+    throw new Error(`Unsupported JWT algorithm ${algorithm}`);
+  }
+
+  const { importParams } = algorithms[algorithm as JwtAlgorithm];
+  const key = algorithm === "HS256"
+    ? await crypto.subtle.importKey(
+      "raw",
+      encoder.encode(material),
+      importParams,
+      false,
+      ["verify"],
+    )
+    : await crypto.subtle.importKey(
+      "spki",
+      decodeBase64(material.replace(/-----[^-]+-----|\s/g, "")),
+      importParams,
+      false,
+      ["verify"],
+    );
+  return { algorithm: algorithm as JwtAlgorithm, key };
+}
+
+// Returns the token's claims, throws if it isn't valid right now
+export async function verifyJwt(
+  token: string,
+  jwtKey: JwtKey,
+  expected: { issuer?: string; audience?: string } = {},
+): Promise<JwtClaims> {
+  const parts = token.split(".");
+  if (parts.length !== 3) {
+    throw new Error("Malformed token");
+  }
+  const [header, payload, signature] = parts;
+
+  // The key decides the algorithm, never the token
+  const { alg } = JSON.parse(decoder.decode(decodeBase64Url(header)));
+  if (alg !== jwtKey.algorithm) {
+    throw new Error(`Unexpected algorithm ${alg}`);
+  }
+
+  const valid = await crypto.subtle.verify(
+    algorithms[jwtKey.algorithm].verifyParams,
+    jwtKey.key,
+    decodeBase64Url(signature),
+    encoder.encode(`${header}.${payload}`),
+  );
+  if (!valid) {
+    throw new Error("Invalid signature");
+  }
+
+  const claims: JwtClaims = JSON.parse(
+    decoder.decode(decodeBase64Url(payload)),
+  );
+  const now = Date.now() / 1000;
+  if (typeof claims.exp === "number" && now > claims.exp + clockSkewSeconds) {
+    throw new Error("Token expired");
+  }
+  if (typeof claims.nbf === "number" && now < claims.nbf - clockSkewSeconds) {
+    throw new Error("Token not valid yet");
+  }
+  if (expected.issuer !== undefined && claims.iss !== expected.issuer) {
+    throw new Error(`Unexpected issuer ${claims.iss}`);
+  }
+  const audiences = Array.isArray(claims.aud) ? claims.aud : [claims.aud];
+  if (
+    expected.audience !== undefined && !audiences.includes(expected.audience)
+  ) {
+    throw new Error("Token is for another audience");
+  }
+
+  return claims;
+}
@@ -0,0 +1,157 @@
+// Simulated players for measuring capacity before an event, e.g.
+// deno run --allow-net loadtest.ts --clients 200 --rooms 20 --duration 120
+import { parseArgs } from "https://deno.land/std@0.208.0/cli/parse_args.ts";
+import { AnchorClient, type GamePacket, type Packet } from "./client.ts";
+
+const args = parseArgs(Deno.args, {
+  string: ["host"],
+  default: {
+    host: "localhost",
+    port: 43385,
+    clients: 50,
+    rooms: 5,
+    // Seconds the test runs for
+    duration: 60,
+    // Milliseconds between each bot's updates and pings
+    interval: 1000,
+    // Chance per interval that a bot disconnects and reconnects
+    churn: 0.01,
+  },
+});
+
+// Relayed to the rest of the room, sentAt measures relay latency
+const updatePacketType = "LOADTEST_UPDATE";
+
+const results = {
+  connects: 0,
+  connectErrors: 0,
+  disconnects: 0,
+  packetsSent: 0,
+  packetsReceived: 0,
+  // Milliseconds from PING to PONG
+  rtts: [] as number[],
+  // Milliseconds from a bot sending an update to another bot receiving it
+  relayLatencies: [] as number[],
+};
+
+class Bot {
+  private client?: AnchorClient;
+  private timer?: number;
+
+  constructor(public id: number, public roomId: string) {}
+
+  async connect() {
+    try {
+      this.client = await AnchorClient.connect(args.host, Number(args.port));
+      results.connects++;
+    } catch (error) {
+      results.connectErrors++;
+      console.error(`Bot ${this.id} failed to connect: ${error.message}`);
+      return;
+    }
+
+    this.client.on("*", (packet) => this.handlePacket(packet));
+    await this.send(() =>
+      this.client?.join(this.roomId, { name: `bot-${this.id}` })
+    );
+    this.timer = setInterval(() => this.tick(), Number(args.interval));
+  }
+
+  async tick() {
+    if (Math.random() < Number(args.churn)) {
+      this.stop();
+      results.disconnects++;
+      await this.connect();
+      return;
+    }
+
+    const client = this.client;
+    if (!client) {
+      return;
+    }
+
+    this.send(async () => {
+      results.rtts.push(await client.ping());
+    });
+    await this.send(() =>
+      client.send({
+        type: updatePacketType,
+        roomId: this.roomId,
+        sentAt: Date.now(),
+      })
+    );
+  }
+
+  handlePacket(packet: Packet | GamePacket) {
+    results.packetsReceived++;
+
+    if (packet.type === updatePacketType) {
+      results.relayLatencies.push(Date.now() - Number(packet.sentAt));
+    } else if (packet.type === "REQUEST_SAVE_STATE") {
+      // Small stand in so save state requests are answered like a real game
+      this.send(() =>
+        this.client?.send({
+          type: "PUSH_SAVE_STATE",
+          roomId: this.roomId,
+          state: { bot: this.id },
+        })
+      );
+    }
+  }
+
+  async send(send: () => Promise<unknown> | undefined) {
+    try {
+      await send();
+      results.packetsSent++;
+    } catch (_) {
+      // The connection closed, the next churn or the end of the test cleans up
+    }
+  }
+
+  stop() {
+    clearInterval(this.timer);
+    this.client?.close();
+    this.client = undefined;
+  }
+}
+
+function percentile(values: number[], p: number) {
+  if (!values.length) {
+    return NaN;
+  }
+
+  const sorted = [...values].sort((a, b) => a - b);
+  return sorted[Math.min(sorted.length - 1, Math.floor(sorted.length * p))];
+}
+
+function describe(label: string, values: number[]) {
+  const [p50, p90, p99] = [0.5, 0.9, 0.99].map((p) => percentile(values, p));
+  console.log(
+    `${label}: p50 ${p50}ms, p90 ${p90}ms, p99 ${p99}ms, max ${
+      values.length ? Math.max(...values) : NaN
+    }ms (${values.length} samples)`,
+  );
+}
+
+const bots = Array.from(
+  { length: Number(args.clients) },
+  (_, i) => new Bot(i, `loadtest-${i % Number(args.rooms)}`),
+);
+console.log(
+  `Connecting ${bots.length} bots in ${args.rooms} rooms to ${args.host}:${args.port} for ${args.duration} seconds`,
+);
+await Promise.all(bots.map((bot) => bot.connect()));
+
+await new Promise((resolve) => {
+  setTimeout(resolve, 1000 * Number(args.duration));
+});
+bots.forEach((bot) => bot.stop());
+
+console.log(
+  `${results.connects} connects, ${results.connectErrors} failed, ${results.disconnects} reconnects`,
+);
+console.log(
+  `${results.packetsSent} packets sent, ${results.packetsReceived} received`,
+);
+describe("Round trip", results.rtts);
+describe("Relay", results.relayLatencies);
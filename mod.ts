@@ -1,589 +1,1073 @@
-import { writeAll } from "https://deno.land/std@0.208.0/streams/write_all.ts";
 import { readLines } from "https://deno.land/std@0.208.0/io/read_lines.ts";
-import { encodeHex } from "https://deno.land/std@0.208.0/encoding/hex.ts";
-
-const decoder = new TextDecoder();
+import {
+  Client,
+  config,
+  type Connection,
+  features,
+  formatDuration,
+  parseFeaturePercent,
+  quietMode,
+  reloadConfig,
+  Room,
+  sendDisable,
+  sendServerMessage,
+  Server,
+  setFeature,
+  setMaxConnections,
+  setQuietMode,
+  sortRooms,
+  writeLog,
+} from "./server.ts";
+import { loadHostKey, SshConsole } from "./ssh.ts";
+import { Dashboard } from "./tui.ts";
+
+// The command line interface, the server itself lives in server.ts so it can
+// also be embedded in other programs
 const encoder = new TextEncoder();
 
-type ClientData = Record<string, any>;
+// Stands in for a socket when replaying a recording, writes go nowhere
+class ReplayConnection implements Connection {
+  public remoteAddr: Deno.Addr = {
+    transport: "tcp",
+    hostname: "replay",
+    port: 0,
+  };
 
-interface BasePacket {
-  clientId?: number;
-  roomId?: string;
-  quiet?: boolean;
-  targetClientId?: number;
-}
+  read(_buffer: Uint8Array): Promise<number | null> {
+    return new Promise(() => {}); // Never receives data, so never disconnects
+  }
+
+  write(data: Uint8Array) {
+    return Promise.resolve(data.length);
+  }
 
-interface UpdateClientDataPacket extends BasePacket {
-  type: "UPDATE_CLIENT_DATA";
-  data: ClientData;
+  close() {}
 }
 
-interface AllClientDataPacket extends BasePacket {
-  type: "ALL_CLIENT_DATA";
-  clients: ClientData[];
+// Feeds the inbound packets of a recording through the packet handlers, the
+// listener is never started so no real clients are affected
+async function replay(path: string) {
+  const clients = new Map<number, Client>();
+  const lines = (await Deno.readTextFile(path)).split("\n").filter(Boolean);
+  let count = 0;
+
+  for (const line of lines) {
+    const { direction, roomId, clientId, packet } = JSON.parse(line);
+    if (direction !== "in") {
+      continue;
+    }
+
+    // Clients may have joined before the recording started
+    packet.roomId ??= roomId;
+
+    let client = clients.get(clientId);
+    if (!client) {
+      // Keeps the recorded ids, so they match the packets
+      client = new Client(new ReplayConnection(), server, clientId);
+      server.clients.push(client);
+      clients.set(clientId, client);
+    }
+
+    await client.handlePacket(encoder.encode(JSON.stringify(packet)));
+    count++;
+  }
+
+  console.log(
+    `Replayed ${count} packets from ${path}, console commands can be used to inspect the result`,
+  );
 }
 
-interface ServerMessagePacket extends BasePacket {
-  type: "SERVER_MESSAGE";
-  message: string;
+const server = new Server();
+const dashboard = Deno.args.includes("--tui")
+  ? new Dashboard(server, runCommand)
+  : undefined;
+server.stopped.then(() => {
+  // Gives the terminal back before exiting
+  dashboard?.stop();
+  Deno.exit();
+});
+const replayIndex = Deno.args.indexOf("--replay");
+if (replayIndex !== -1) {
+  replay(Deno.args[replayIndex + 1]).catch((error) => {
+    writeLog("error", `Error replaying recording: ${error.stack ?? error}`);
+    Deno.exit(1);
+  });
+} else {
+  server.start().catch((error) => {
+    writeLog("error", `Error starting server: ${error.stack ?? error}`);
+    Deno.exit(1);
+  });
 }
 
-interface DisableAnchorPacket extends BasePacket {
-  type: "DISABLE_ANCHOR";
+// For reproducible setup, e.g. quiet mode or scheduled maintenance
+const execFileIndex = Deno.args.indexOf("--exec-file");
+if (execFileIndex !== -1) {
+  runCommandFile(Deno.args[execFileIndex + 1]).catch((error) => {
+    writeLog("error", `Error running exec file: ${error.stack ?? error}`);
+    Deno.exit(1);
+  });
 }
 
-interface OtherPackets extends BasePacket {
-  type:
-    | "REQUEST_SAVE_STATE"
-    | "PUSH_SAVE_STATE"
-    | "GAME_COMPLETE"
-    | "HEARTBEAT";
+// Windows only supports SIGINT and SIGBREAK listeners
+if (Deno.build.os !== "windows") {
+  Deno.addSignalListener("SIGHUP", () => {
+    reloadConfig().catch((error) => {
+      writeLog("error", `Error reloading config: ${error.stack ?? error}`);
+    });
+  });
+  // Kubernetes sends this when deleting a pod, after any preStop hook
+  Deno.addSignalListener("SIGTERM", () => {
+    server.terminate();
+  });
+  Deno.addSignalListener("SIGUSR1", () => {
+    server.dumpState().catch((error) => {
+      writeLog("error", `Error dumping state: ${error.stack ?? error}`);
+    });
+  });
 }
 
-type Packet =
-  | UpdateClientDataPacket
-  | DisableAnchorPacket
-  | ServerMessagePacket
-  | AllClientDataPacket
-  | OtherPackets;
-
-interface ServerStats {
-  lastStatsHeartbeat: number;
-  clientSHAs: Record<string, boolean>;
-  onlineCount: number;
-  gamesCompleted: number;
-  pid: number;
+globalThis.addEventListener("unhandledrejection", (e) => {
+  writeLog("error", `Unhandled rejection: ${e.reason?.stack ?? e.reason}`);
+  e.preventDefault();
+  Deno.exit(1);
+});
+
+interface AuditEntry {
+  action: string;
+  target?: string;
+  message?: string;
+  operator?: string; // who ran the action, the local console unless remote
+  [detail: string]: unknown; // e.g. a mute's minutes
 }
 
-const port =
-  (Deno.env.has("PORT") && !isNaN(parseInt(Deno.env.get("PORT")!, 10)))
-    ? parseInt(Deno.env.get("PORT")!, 10)
-    : 43385;
-let quietMode = !!Deno.env.has("QUIET");
-
-class Server {
-  private listener?: Deno.Listener;
-  public clients: Client[] = [];
-  public rooms: Room[] = [];
-  public stats: ServerStats = {
-    lastStatsHeartbeat: Date.now(),
-    clientSHAs: {},
-    onlineCount: 0,
-    gamesCompleted: 0,
-    pid: Deno.pid,
-  };
+// Who the command being run came from, for its audit log entries
+let commandOperator = "console";
 
-  async start() {
-    await this.parseStats();
+// Resolves once written, or failing to be, so actions that end sessions or the
+// process can wait for their entry first
+function audit({ operator = commandOperator, ...entry }: AuditEntry) {
+  const line = JSON.stringify({
+    timestamp: new Date().toISOString(),
+    operator,
+    ...entry,
+  });
+  return Deno.writeTextFile(config.auditLogPath, line + "\n", { append: true })
+    .catch((error) => {
+      writeLog("error", `Error writing audit log: ${error.message}`);
+    });
+}
 
-    this.statsHeartbeat();
-    this.clientHeartbeat();
+function printDiagnostics() {
+  const megabytes = (bytes: number) => `${(bytes / 1024 / 1024).toFixed(1)} MB`;
+  const { rss, heapUsed, heapTotal, external } = Deno.memoryUsage();
+  console.log(
+    `Memory: ${megabytes(rss)} rss, ${megabytes(heapUsed)} of ${
+      megabytes(heapTotal)
+    } heap used, ${megabytes(external)} external`,
+  );
 
-    this.startServer();
+  for (const [name, { lastRun }] of Object.entries(server.heartbeats)) {
+    console.log(
+      `${name}: last ran ${formatDuration(Date.now() - lastRun)} ago`,
+    );
   }
-
-  async parseStats() {
-    try {
-      const statsString = await Deno.readTextFile("./stats.json");
-      this.stats = Object.assign(this.stats, JSON.parse(statsString));
-      this.stats.pid = Deno.pid;
-      this.log("Loaded stats file");
-    } catch (_) {
-      this.log("No stats file found");
-    }
+  for (const problem of server.healthProblems()) {
+    console.log(`Problem: ${problem}`);
   }
 
-  async statsHeartbeat() {
-    try {
-      this.stats.lastStatsHeartbeat = Date.now();
-      this.stats.onlineCount = this.clients.length;
-
-      await this.saveStats();
-    } catch (error) {
-      this.log(`Error saving stats: ${error.message}`);
-    }
+  const roomless = server.clients.filter((client) => !client.room);
+  const retained = server.rooms.filter((room) => !room.clients.length);
+  console.log(
+    `${server.clients.length} connections, ${roomless.length} not in a room`,
+  );
+  console.log(
+    `${server.rooms.length} rooms, ${retained.length} empty and retained`,
+  );
 
-    setTimeout(() => {
-      this.statsHeartbeat();
-    }, 2500);
+  const rooms = server.rooms.filter((room) => room.clients.length);
+  rooms.sort((a, b) => b.clients.length - a.clients.length);
+  for (const room of rooms) {
+    console.log(`  ${room.id}: ${room.clients.length} clients`);
   }
+}
 
-  async clientHeartbeat() {
-    try {
-      await Promise.all(server.clients.map((client) => {
-        return client.sendPacket({
-          type: "HEARTBEAT",
-        }).catch((_) => {}); // Ignore errors, client will disconnect if it's a problem
-      }));
-    } catch (error) {
-      this.log(`Error sending heartbeat to clients: ${error.message}`);
-    }
+// Console output for wrapper scripts, see the json command
+let jsonMode = false;
 
-    setTimeout(() => {
-      this.clientHeartbeat();
-    }, 1000 * 30);
-  }
+// Counters that can drift, e.g. after restoring an old stats file
+const settableStats = ["gamesCompleted"] as const;
+
+function printError(message: string, json: boolean) {
+  console.log(json ? JSON.stringify({ error: message }) : message);
+}
 
-  async saveStats() {
-    try {
-      await Deno.writeTextFile(
-        "./stats.json",
-        JSON.stringify(this.stats, null, 4),
+const listPageSize = 25;
+
+// Filters are room=<id>, team=<id>, or <field>=<value> and <field>~<text>
+// matching client data, the latter case insensitively. Rooms can be narrowed
+// down and sorted like LIST_ROOMS with game=, region=, tag=, search= and sort=
+function printClientList(args: string[], json: boolean) {
+  let page: number | undefined;
+  let sort: string | undefined;
+  const filters: ((client: Client) => boolean)[] = [];
+  const tags: string[] = [];
+  const listing: { gameId?: string; region?: string; search?: string } = {};
+  for (const arg of args) {
+    const [, field, operator, value] = arg.match(/^(\w+)([=~])(.*)$/) ?? [];
+    if (field === "page" && operator === "=") {
+      page = Math.max(1, parseInt(value, 10) || 1);
+    } else if (field === "sort" && operator === "=") {
+      sort = value;
+    } else if (field === "game" && operator === "=") {
+      listing.gameId = value;
+    } else if (field === "region" && operator === "=") {
+      listing.region = value;
+    } else if (field === "tag" && operator === "=") {
+      tags.push(value);
+    } else if (field === "search" && operator === "=") {
+      listing.search = value;
+    } else if (field === "room" && operator === "=") {
+      filters.push((client) => client.room?.id === value);
+    } else if (field === "team" && operator === "=") {
+      filters.push((client) => client.teamId === value);
+    } else if (operator === "=") {
+      filters.push((client) => String(client.data[field]) === value);
+    } else if (operator === "~") {
+      filters.push((client) =>
+        String(client.data[field] ?? "").toLowerCase()
+          .includes(value.toLowerCase())
       );
-    } catch (error) {
-      this.log(`Error saving stats: ${error.message}`);
+    } else {
+      printError(`Invalid filter ${arg}`, json);
+      return;
     }
   }
 
-  async startServer() {
-    this.listener = Deno.listen({ port });
-
-    this.log(`Server Started on port ${port}`);
-    try {
-      for await (const connection of this.listener) {
-        try {
-          const client = new Client(connection, this);
-          this.clients.push(client);
-        } catch (error) {
-          this.log(`Error connecting client: ${error.message}`);
-        }
-      }
-    } catch (error) {
-      this.log(`Error starting server: ${error.message}`);
-    }
+  if (sort && !["clientCount", "title", "createdAt"].includes(sort)) {
+    printError(`Invalid sort ${sort}`, json);
+    return;
+  }
+  const rooms = sortRooms(
+    server.rooms.filter((room) => room.matchesListing({ ...listing, tags })),
+    sort,
+  );
+  let clients = rooms.flatMap((room) => room.clients)
+    .filter((client) => filters.every((filter) => filter(client)));
+  const total = clients.length;
+  if (page !== undefined) {
+    clients = clients.slice((page - 1) * listPageSize, page * listPageSize);
   }
 
-  removeClient(client: Client) {
-    const index = this.clients.indexOf(client);
-    if (index !== -1) {
-      this.clients.splice(index, 1);
-    }
+  if (json) {
+    console.log(JSON.stringify({
+      total,
+      page,
+      rooms: rooms.map((room) => room.summary()),
+      clients: clients.map((client) => client.summary()),
+    }));
+    return;
   }
 
-  getOrCreateRoom(id: string) {
-    const room = this.rooms.find((room) => room.id === id);
-    if (room) {
-      return room;
+  // Unfiltered, empty rooms are listed too
+  const showAllRooms = !filters.length && page === undefined;
+  for (const room of rooms) {
+    const roomClients = clients.filter((client) => client.room === room);
+    if (!roomClients.length && !showAllRooms) {
+      continue;
     }
 
-    const newRoom = new Room(id, this);
-    this.rooms.push(newRoom);
-    return newRoom;
-  }
-
-  removeRoom(room: Room) {
-    const index = this.rooms.indexOf(room);
-    if (index !== -1) {
-      this.rooms.splice(index, 1);
+    const title = room.title ? ` ${JSON.stringify(room.title)}` : "";
+    console.log(
+      `Room ${room.id}${title} (${room.public ? "public" : "private"}):`,
+    );
+    for (const client of roomClients) {
+      const rtt = client.rtt === undefined ? "?" : client.rtt;
+      const name = typeof client.data.name === "string"
+        ? ` ${JSON.stringify(client.data.name)}`
+        : "";
+      console.log(
+        `  Client ${client.id}${name} (${rtt}ms): ${
+          JSON.stringify(client.data)
+        }`,
+      );
     }
   }
 
-  log(...data: any[]) {
-    console.log(`[Server]:`, ...data);
+  if (page !== undefined) {
+    console.log(
+      `Page ${page} of ${Math.ceil(total / listPageSize) || 1}, ${total} clients`,
+    );
+  } else if (filters.length) {
+    console.log(`${total} matching clients`);
   }
 }
 
-class Client {
-  public id: number;
-  public data: ClientData = {};
-  public connection: Deno.Conn;
-  public server: Server;
-  public room?: Room;
-
-  constructor(connection: Deno.Conn, server: Server) {
-    this.connection = connection;
-    this.server = server;
-    this.id = connection.rid;
-
-    // SHA256 to get a rough idea of how many unique players there are
-    crypto.subtle.digest(
-      "SHA-256",
-      encoder.encode((this.connection.remoteAddr as Deno.NetAddr).hostname),
-    )
-      .then((hasBuffer) => {
-        this.server.stats.onlineCount++;
-        this.server.stats.clientSHAs[encodeHex(hasBuffer)] = true;
-      })
-      .catch((error) => {
-        this.log(`Error hashing client: ${error.message}`);
-      });
-
-    this.waitForData();
-    this.log("Connected");
+function printScoreboard(room: Room) {
+  const teams = room.scoreboard();
+  if (!teams.length) {
+    console.log(`Room ${room.id} has no teams`);
+    return;
   }
 
-  async waitForData() {
-    const buffer = new Uint8Array(1024);
-    let data = new Uint8Array(0);
-
-    while (true) {
-      let count: null | number = 0;
-
-      try {
-        count = await this.connection.read(buffer);
-      } catch (error) {
-        this.log(`Error reading from connection: ${error.message}`);
-        this.disconnect();
-        break;
-      }
+  console.log(`Room ${room.id} scoreboard:`);
+  teams.forEach((score, index) => {
+    const completion = score.completionMs === undefined
+      ? "playing"
+      : `finished in ${formatDuration(score.completionMs)}`;
+    console.log(
+      `  ${index + 1}. ${score.teamId}: ${score.checks} checks, ${score.items} items, ${completion}`,
+    );
+  });
+}
 
-      if (!count) {
-        this.disconnect();
-        break;
-      }
+function printRoomInfo(room: Room) {
+  const options = [room.public ? "public" : "private"];
+  if (room.gameId) {
+    options.push(room.gameId);
+  }
+  if (room.teamScoped) {
+    options.push("team scoped");
+  }
+  if (room.encrypted) {
+    options.push("encrypted");
+  }
+  if (room.isRecording) {
+    options.push("recording");
+  }
+  if (room.isLogging) {
+    options.push("logging");
+  }
 
-      // Concatenate received data with the existing data
-      const receivedData = buffer.subarray(0, count);
-      data = concatUint8Arrays(data, receivedData);
+  const owner = room.ownerId === undefined
+    ? "unknown"
+    : `Client ${room.ownerId}${
+      room.clients.some((c) => c.id === room.ownerId) ? "" : " (left)"
+    }`;
+  const teams: Record<string, number> = {};
+  for (const client of room.clients) {
+    teams[client.teamId] = (teams[client.teamId] ?? 0) + 1;
+  }
+  const { savedStateBytes, flagCount } = room.summary();
+
+  console.log(`Room ${room.id} (${options.join(", ")}):
+  Created: ${new Date(room.createdAt).toLocaleString()}
+  Last activity: ${formatDuration(Date.now() - room.lastActivity)} ago
+  Owner: ${owner}
+  Moderators: ${
+    [...room.moderatorIds].map((id) => `Client ${id}`).join(", ") || "none"
+  }
+  Teams: ${
+    Object.entries(teams).map(([id, count]) => `${id} (${count})`).join(", ") ||
+    "none"
+  }
+  Saved states: ${Object.keys(room.savedStates).length} (${savedStateBytes} bytes)
+  Waiting for a save state: ${room.requestingStateClients.length} clients
+  Flags: ${flagCount} (${room.flagMerge})
+  Events: ${room.nextEventSeq - 1} (${room.events.length} in memory)
+  Seed: ${room.seedHash ?? "unknown"}${
+    room.settings ? ` (settings ${room.settings})` : ""
+  }
+  Versions: ${
+    room.requiredClientVersion ??
+      (room.minClientVersion ? `${room.minClientVersion} or newer` : "any")
+  }
+  Title: ${room.title ?? "none"}
+  Description: ${room.description ?? "none"}
+  Tags: ${room.tags.join(", ") || "none"}
+  Region: ${room.region ?? "unknown"}
+  Metadata: ${JSON.stringify(room.metadata)}
+  Clients:`);
+  for (const client of room.clients) {
+    const rtt = client.rtt === undefined ? "?" : client.rtt;
+    const reconnecting = client.connected ? "" : ", dropped, waiting for it";
+    const tracing = client.isTracing ? ", tracing" : "";
+    console.log(
+      `    Client ${client.id} ${
+        JSON.stringify(client.data.name ?? "")
+      } (team ${client.teamId}, ${rtt}ms, last active ${
+        formatDuration(Date.now() - client.lastActivity)
+      } ago${reconnecting}${tracing})`,
+    );
+  }
+}
 
-      // Handle all complete packets (while loop in case multiple packets were received at once)
-      while (true) {
-        const delimiterIndex = findDelimiterIndex(data);
-        if (delimiterIndex === -1) {
-          break; // Incomplete packet, wait for more data
-        }
+// Prints the peak online and room counts and the completions of each hour
+async function printHistory(hours: number) {
+  const since = Date.now() - 1000 * 60 * 60 * hours;
+  const buckets = new Map<
+    number,
+    { online: number; rooms: number; firstCompleted: number; completed: number }
+  >();
+  let peak = { online: 0, timestamp: 0 };
+
+  const history = await Deno.readTextFile(config.historyPath);
+  for (const line of history.split("\n")) {
+    const [timestamp, online, rooms, completed] = line.split(",").map(Number);
+    if (!(timestamp >= since)) {
+      continue;
+    }
 
-        // Extract the packet
-        const packet = data.subarray(0, delimiterIndex);
-        data = data.subarray(delimiterIndex + 1);
+    const hour = timestamp - timestamp % (1000 * 60 * 60);
+    const bucket = buckets.get(hour) ??
+      { online: 0, rooms: 0, firstCompleted: completed, completed };
+    bucket.online = Math.max(bucket.online, online);
+    bucket.rooms = Math.max(bucket.rooms, rooms);
+    bucket.completed = completed;
+    buckets.set(hour, bucket);
 
-        this.handlePacket(packet);
-      }
+    if (!peak.timestamp || online > peak.online) {
+      peak = { online, timestamp };
     }
   }
 
-  handlePacket(packet: Uint8Array) {
-    try {
-      const packetString = decoder.decode(packet);
-      const packetObject: Packet = JSON.parse(packetString);
-      packetObject.clientId = this.id;
+  for (const [hour, bucket] of buckets) {
+    console.log(
+      `${new Date(hour).toLocaleString()}: ${bucket.online} online, ${bucket.rooms} rooms, ${
+        bucket.completed - bucket.firstCompleted
+      } games completed`,
+    );
+  }
+  if (peak.timestamp) {
+    console.log(
+      `Peak: ${peak.online} online at ${
+        new Date(peak.timestamp).toLocaleString()
+      }`,
+    );
+  } else {
+    console.log(`No samples in the last ${hours} hours`);
+  }
+}
 
-      if (!packetObject.quiet && !quietMode) {
-        this.log(`-> ${packetObject.type} packet`);
+// operator is ssh:<key comment> for commands run over the SSH console
+function runCommand(line: string, operator = "console") {
+  commandOperator = operator;
+  const [command, ...words] = line.split(" ");
+  // Makes list, stats, info and roomInfo print JSON for this command only
+  const json = jsonMode || words.includes("--json");
+  const args = words.filter((word) => word !== "--json");
+
+  switch (command) {
+    default:
+    case "help": {
+      console.log(
+        `Available commands:
+  help: Show this help message
+  stats: Print server stats
+  uptime: Print when the server started and how long ago
+  version: Print the build version, commit and Deno version
+  saveStats: Save stats to STATS_PATH now
+  reloadStats [path]: Replace the stats in memory with those in STATS_PATH, or a backup, and save them
+  setStat gamesCompleted <n>: Correct a counter, e.g. after restoring an old stats file
+  packetStats: Print packet counts and bytes by type since startup
+  diag: Print memory usage, background loop timings, and connection and room totals
+  leaderboard [count]: Print the fastest completions, 10 by default
+  history [hours]: Print hourly peaks from the sampled history, last 24 hours by default
+  quiet: Toggle quiet mode
+  json: Toggle JSON output for list, stats, info and roomInfo, or add --json to a single command
+  reload: Reload the config file, same as sending SIGHUP
+  rebind: Close and bind the listeners again, e.g. after changing PORT, LISTENERS or QUIC_PORT, without disconnecting anyone
+  roomCount: Show the number of rooms
+  clientCount: Show the number of clients
+  maxConnections [n]: Show or change the connection limit until the config is reloaded, 0 for no limit
+  feature [name on|off|<percent>]: Show the feature flags, or turn one on for all, none or a percentage of clients until the config is reloaded
+  list [filters] [page=<n>] [sort=<clientCount|title|createdAt>]: List rooms and clients, filtered by room=<id>, team=<id>, <field>=<value> or <field>~<text> on client data, and game=<id>, region=<region>, tag=<tag> or search=<text> on rooms
+  info <clientId>: Show a client's address, activity, room, team and data
+  roomInfo <roomId>: Show a room's age, activity, owner, teams, saved states and clients
+  events <roomId> [sinceSeq]: Print a room's event log, optionally only the events after a seq
+  rebuild <roomId>: Replay a room's event log into its teams, scores and flags, reporting any that disagreed
+  scoreboard <roomId>: Show each team's checks, items and completion time, leader first
+  record <roomId>: Toggle recording a room's packets to a file
+  roomLog <roomId> on|off: Append everything logged about a room, even in quiet mode, to a file in ROOM_LOGS_DIR
+  trace <clientId> on|off [path]: Log every packet to and from a client even in quiet mode, or append them to path
+  restoreRoom <roomId>: Bring back a room archived after its retention period
+  cleanup: Delete data past its retention period now rather than at the next scheduled cleanup
+  purgeClient <clientId>: Delete everything kept about a client, in memory, archived rooms, event logs, recordings and stats
+  drain: Stop accepting connections and new rooms, reporting until empty
+  handover: Save rooms for a new process, drain and exit once empty
+  migrate <roomId> <host:port> [url]: Move a room to another instance, redirecting its clients to host:port. Its snapshot is posted to url, http://host:HTTP_PORT by default
+  stop <message>: Stop the server
+  maintenance <minutes> <message>: Count down to stopping the server, turning away new players
+  maintenance cancel: Cancel scheduled maintenance
+  message <clientId> <message>: Send a message to a client
+  messageAll <message>: Send a message to all clients, on every instance when clustered
+  messageRoom <roomId> <message>: Send a message to everyone in a room, on every instance when clustered
+  mute <clientId> [minutes]: Drop a client's chat and other text packets, 10 minutes by default
+  unmute <clientId>: Let a muted client chat again
+  disable <clientId> <message>: Disable anchor on a client
+  disableAll <message>: Disable anchor on all clients, on every instance when clustered`,
+      );
+      break;
+    }
+    case "reload": {
+      reloadConfig().catch((error) => {
+        console.log(`Error reloading config: ${error.message}`);
+      });
+      break;
+    }
+    case "rebind": {
+      try {
+        server.rebindListeners();
+      } catch (error) {
+        console.log(`Error rebinding listeners: ${error.message}`);
       }
-
-      if (packetObject.type === "UPDATE_CLIENT_DATA") {
-        this.data = packetObject.data;
+      break;
+    }
+    case "roomCount": {
+      const publicCount = server.rooms.filter((room) => room.public).length;
+      console.log(
+        `Room count: ${server.rooms.length} (${publicCount} public, ${
+          server.rooms.length - publicCount
+        } private)`,
+      );
+      break;
+    }
+    case "clientCount": {
+      console.log(`Client count: ${server.clients.length}`);
+      break;
+    }
+    case "maxConnections": {
+      if (args[0] !== undefined) {
+        const maxConnections = parseInt(args[0], 10);
+        if (!Number.isInteger(maxConnections) || maxConnections < 0) {
+          console.log("Usage: maxConnections [n]");
+          break;
+        }
+        audit({ action: "maxConnections", target: String(maxConnections) });
+        setMaxConnections(maxConnections);
       }
-
-      if (packetObject.type === "GAME_COMPLETE") {
-        this.server.stats.gamesCompleted++;
+      console.log(
+        `Max connections: ${config.maxConnections || "no limit"} (${server.clients.length} connected)`,
+      );
+      break;
+    }
+    case "feature": {
+      const [name, setting] = args;
+      if (name !== undefined) {
+        const feature = features.find((f) => f === name);
+        const percent = parseFeaturePercent(setting ?? "");
+        if (!feature || percent === undefined) {
+          console.log(
+            `Usage: feature <${features.join("|")}> on|off|<percent>`,
+          );
+          break;
+        }
+        audit({ action: "feature", target: feature, percent });
+        setFeature(feature, percent);
       }
-
-      if (packetObject.roomId && !this.room) {
-        this.server.getOrCreateRoom(packetObject.roomId).addClient(this);
+      for (const [feature, percent] of Object.entries(config.features)) {
+        console.log(
+          `${feature}: ${
+            percent === 100 ? "on" : percent ? `${percent}% of clients` : "off"
+          }`,
+        );
       }
-
-      if (!this.room) {
-        this.log("Not in a room, ignoring packet");
-        return;
+      break;
+    }
+    case "quiet": {
+      setQuietMode(!quietMode);
+      console.log(`Quiet mode: ${quietMode}`);
+      break;
+    }
+    case "stats": {
+      const { clientSHAs: _, leaderboard: __, ...stats } = server.stats;
+      console.log(json ? JSON.stringify(stats) : stats);
+      break;
+    }
+    case "uptime": {
+      const uptimeMs = Date.now() - server.startedAt;
+      console.log(
+        json
+          ? JSON.stringify({ startedAt: server.startedAt, uptimeMs })
+          : `Up ${formatDuration(uptimeMs)}, since ${
+            new Date(server.startedAt).toLocaleString()
+          }`,
+      );
+      break;
+    }
+    case "version": {
+      const info = server.info();
+      console.log(
+        json
+          ? JSON.stringify(info)
+          : `Anchor ${info.version} (commit ${info.commit}) on ${info.runtime}`,
+      );
+      break;
+    }
+    case "saveStats": {
+      server.saveStats().then(() => {
+        console.log(`Saved stats to ${config.statsPath}`);
+      }).catch((error) => {
+        console.log(`Error saving stats: ${error.message}`);
+      });
+      break;
+    }
+    case "reloadStats": {
+      const [path] = args;
+      audit({ action: "reloadStats", target: path });
+      server.reloadStats(path).catch((error) => {
+        console.log(`Error reloading stats: ${error.message}`);
+      });
+      break;
+    }
+    case "setStat": {
+      const [name, valueArg] = args;
+      const value = parseInt(valueArg, 10);
+      if (!settableStats.includes(name)) {
+        console.log(
+          `Unknown stat ${name}, can be one of ${settableStats.join(", ")}`,
+        );
+      } else if (!(value >= 0)) {
+        console.log(`Invalid value ${valueArg}`);
+      } else {
+        audit({ action: "setStat", target: name, value });
+        server.stats[name as typeof settableStats[number]] = value;
+        server.saveStats().catch((error) => {
+          console.log(`Error saving stats: ${error.message}`);
+        });
       }
-
-      if (packetObject.targetClientId) {
-        const targetClient = this.room.clients.find((client) =>
-          client.id === packetObject.targetClientId
+      break;
+    }
+    case "json": {
+      jsonMode = !jsonMode;
+      console.log(`JSON mode: ${jsonMode}`);
+      break;
+    }
+    case "diag": {
+      printDiagnostics();
+      break;
+    }
+    case "packetStats": {
+      const entries = Object.entries(server.packetStats);
+      entries.sort(([, a], [, b]) =>
+        (b.bytesReceived + b.bytesSent) - (a.bytesReceived + a.bytesSent)
+      );
+      for (const [type, stats] of entries) {
+        console.log(
+          `${type}: ${stats.received} in (${stats.bytesReceived} bytes), ${stats.sent} out (${stats.bytesSent} bytes), ${stats.superseded} superseded, ${stats.throttled} throttled`,
         );
-        if (targetClient) {
-          targetClient.sendPacket(packetObject);
-        } else {
-          this.log(`Target client ${packetObject.targetClientId} not found`);
+      }
+      break;
+    }
+    case "leaderboard": {
+      const count = parseInt(args[0], 10);
+      const entries = server.stats.leaderboard.slice(
+        0,
+        isNaN(count) ? 10 : count,
+      );
+      entries.forEach((entry, i) => {
+        console.log(
+          `${i + 1}. ${formatDuration(entry.elapsedMs)} - team ${entry.teamId} in room ${entry.roomId}, ${entry.playerCount} players, ${
+            new Date(entry.completedAt).toLocaleString()
+          }`,
+        );
+      });
+      if (!entries.length) {
+        console.log("No completions recorded");
+      }
+      break;
+    }
+    case "history": {
+      const hours = parseInt(args[0], 10);
+      printHistory(isNaN(hours) ? 24 : hours).catch((error) => {
+        console.log(`Error reading history: ${error.message}`);
+      });
+      break;
+    }
+    case "list": {
+      printClientList(args, json);
+      break;
+    }
+    case "record": {
+      const [roomId] = args;
+      const room = server.rooms.find((r) => r.id === roomId);
+      if (!room) {
+        console.log(`Room ${roomId} not found`);
+      } else if (room.isRecording) {
+        room.stopRecording();
+      } else {
+        try {
+          console.log(`Recording to ${room.startRecording()}`);
+        } catch (error) {
+          console.log(`Error starting recording: ${error.message}`);
         }
-        return;
       }
-
-      if (packetObject.type === "REQUEST_SAVE_STATE") {
-        if (this.room.clients.length > 1) {
-          this.room.requestingStateClients.push(this);
-          this.room.broadcastPacket(packetObject, this);
+      break;
+    }
+    case "roomLog": {
+      const [roomId, state] = args;
+      const room = server.rooms.find((r) => r.id === roomId);
+      if (!room) {
+        console.log(`Room ${roomId} not found`);
+      } else if (state === "off") {
+        room.stopLog();
+      } else if (state === "on") {
+        try {
+          console.log(`Logging to ${room.startLog()}`);
+        } catch (error) {
+          console.log(`Error starting room log: ${error.message}`);
         }
-      } else if (packetObject.type === "PUSH_SAVE_STATE") {
-        const roomStateRequests = this.room.requestingStateClients;
-        roomStateRequests.forEach((client) => {
-          client.sendPacket(packetObject);
-        });
-        this.room.requestingStateClients = [];
       } else {
-        this.room.broadcastPacket(packetObject, this);
+        console.log("Usage: roomLog <roomId> on|off");
       }
-    } catch (error) {
-      this.log(`Error handling packet: ${error.message}`);
+      break;
     }
-  }
-
-  async sendPacket(packetObject: Packet) {
-    try {
-      if (!packetObject.quiet && !quietMode) {
-        this.log(`<- ${packetObject.type} packet`);
+    case "trace": {
+      const [clientId, state, path] = args;
+      const client = server.clients.find((c) =>
+        c.id === parseInt(clientId, 10)
+      );
+      if (!client) {
+        console.log(`Client ${clientId} not found`);
+      } else if (state === "off") {
+        client.stopTrace();
+      } else if (state === "on") {
+        try {
+          client.startTrace(path);
+        } catch (error) {
+          console.log(`Error starting trace: ${error.message}`);
+        }
+      } else {
+        console.log("Usage: trace <clientId> on|off [path]");
       }
-      const packetString = JSON.stringify(packetObject);
-      const packet = encoder.encode(packetString + "\0");
-
-      // Wait for writeAll to complete, if it takes longer than 30 seconds, disconnect
-      await Promise.race([
-        writeAll(this.connection, packet),
-        new Promise((_, reject) => {
-          setTimeout(() => {
-            reject(new Error("Timeout, took longer than 30 seconds to send"));
-          }, 1000 * 30);
-        }),
-      ]);
-    } catch (error) {
-      this.log(`Error sending packet: ${error.message}`);
-      this.disconnect();
+      break;
     }
-  }
-
-  disconnect() {
-    try {
-      if (this.room) {
-        this.room.removeClient(this);
+    case "disable": {
+      const [clientId, ...messageParts] = args;
+      const message = messageParts.join(" ");
+      const client = server.clients.find((c) =>
+        c.id === parseInt(clientId, 10)
+      );
+      if (client) {
+        audit({ action: "disable", target: clientId, message });
+        sendDisable(client, message);
+      } else {
+        console.log(`Client ${clientId} not found`);
       }
-      this.server.removeClient(this);
-      this.connection.close();
-    } catch (error) {
-      this.log(`Error disconnecting: ${error.message}`);
-    } finally {
-      this.server.stats.onlineCount--;
-      this.log("Disconnected");
+      break;
     }
-  }
-
-  log(message: string) {
-    console.log(`[Client ${this.id}]: ${message}`);
-  }
-}
-
-class Room {
-  public id: string;
-  public server: Server;
-  public clients: Client[] = [];
-  public requestingStateClients: Client[] = [];
-
-  constructor(id: string, server: Server) {
-    this.id = id;
-    this.server = server;
-    this.log("Created");
-  }
-
-  addClient(client: Client) {
-    this.log(`Adding client ${client.id}`);
-    this.clients.push(client);
-    client.room = this;
-
-    this.broadcastAllClientData();
-  }
-
-  removeClient(client: Client) {
-    this.log(`Removing client ${client.id}`);
-    const index = this.clients.indexOf(client);
-    if (index !== -1) {
-      this.clients.splice(index, 1);
-      client.room = undefined;
+    case "mute":
+    case "unmute": {
+      const [clientId, minutesArg] = args;
+      const client = server.clients.find((c) =>
+        c.id === parseInt(clientId, 10)
+      );
+      const minutes = command === "unmute"
+        ? 0
+        : minutesArg === undefined
+        ? undefined
+        : parseFloat(minutesArg);
+      if (!client) {
+        console.log(`Client ${clientId} not found`);
+      } else if (minutes !== undefined && !(minutes >= 0)) {
+        console.log(`Invalid minutes ${minutesArg}`);
+      } else {
+        audit({ action: command, target: clientId, minutes });
+        client.mute(minutes);
+      }
+      break;
     }
-
-    if (this.clients.length) {
-      this.broadcastAllClientData();
-    } else {
-      this.log("No clients left, removing room");
-      this.server.removeRoom(this);
+    case "disableAll": {
+      const message = args.join(" ");
+      audit({ action: "disableAll", message }).then(() => {
+        server.runClusterAction({ action: "disableAll", message });
+      });
+      break;
     }
-  }
+    case "info": {
+      const [clientId] = args;
+      const client = server.clients.find((c) =>
+        c.id === parseInt(clientId, 10)
+      );
+      if (!client) {
+        printError(`Client ${clientId} not found`, json);
+        break;
+      }
+      if (json) {
+        console.log(JSON.stringify(client.summary()));
+        break;
+      }
 
-  broadcastAllClientData() {
-    if (!quietMode) {
-      this.log("<- ALL_CLIENT_DATA packet");
+      const clientVersion = client.data.clientVersion ?? "unknown";
+      const muted = client.muted
+        ? `until ${new Date(client.mutedUntil).toLocaleString()}`
+        : "no";
+      console.log(`Client ${client.id}:
+  Address: ${client.remoteAddress}
+  Connected: ${new Date(client.connectedAt).toLocaleString()}
+  Last activity: ${formatDuration(Date.now() - client.lastActivity)} ago
+  Room: ${client.room?.id ?? "none"}
+  Team: ${client.teamId}
+  Version: ${clientVersion}
+  Muted: ${muted}
+  RTT: ${client.rtt === undefined ? "?" : client.rtt}ms
+  Data: ${JSON.stringify(client.data, null, 2).replaceAll("\n", "\n  ")}`);
+      break;
     }
-    for (const client of this.clients) {
-      const packetObject = {
-        type: "ALL_CLIENT_DATA" as const,
-        roomId: this.id,
-        clients: this.clients.filter((c) => c !== client).map((c) => ({
-          clientId: c.id,
-          ...c.data,
-        })),
-      };
-
-      client.sendPacket(packetObject);
+    case "roomInfo": {
+      const [roomId] = args;
+      const room = server.rooms.find((r) => r.id === roomId);
+      if (!room) {
+        printError(`Room ${roomId} not found`, json);
+      } else if (json) {
+        console.log(JSON.stringify({
+          ...room.summary(),
+          clients: room.clients.map((client) => client.summary()),
+        }));
+      } else {
+        printRoomInfo(room);
+      }
+      break;
     }
-  }
+    case "events": {
+      const [roomId, sinceArg] = args;
+      const room = server.rooms.find((r) => r.id === roomId);
+      const since = parseInt(sinceArg ?? "0", 10);
+      if (!room) {
+        printError(`Room ${roomId} not found`, json);
+        break;
+      }
 
-  broadcastPacket(packetObject: Packet, sender: Client) {
-    if (!packetObject.quiet && !quietMode) {
-      this.log(`<- ${packetObject.type} packet from ${sender.id}`);
+      const events = room.events.filter((event) => event.seq > since);
+      if (json) {
+        console.log(JSON.stringify(events));
+        break;
+      }
+      for (const event of events) {
+        console.log(
+          `${event.seq} ${
+            new Date(event.timestamp).toLocaleTimeString()
+          } Client ${event.clientId} (team ${event.teamId}): ${
+            JSON.stringify(event.packet)
+          }`,
+        );
+      }
+      console.log(`${events.length} events, ${room.nextEventSeq - 1} in total`);
+      break;
     }
+    case "rebuild": {
+      const [roomId] = args;
+      const room = server.rooms.find((r) => r.id === roomId);
+      if (!room) {
+        console.log(`Room ${roomId} not found`);
+        break;
+      }
 
-    for (const client of this.clients) {
-      if (client !== sender) {
-        client.sendPacket(packetObject);
+      try {
+        const mismatches = room.rebuild();
+        audit({ action: "rebuild", target: roomId, mismatches });
+        console.log(
+          mismatches.length
+            ? `Rebuilt room ${roomId}, the log disagreed on its ${
+              mismatches.join(", ")
+            }`
+            : `Rebuilt room ${roomId}, matching its live state`,
+        );
+      } catch (error) {
+        console.log(`Error rebuilding room ${roomId}: ${error.message}`);
       }
+      break;
     }
-  }
-
-  log(message: string) {
-    console.log(`[Room ${this.id}]: ${message}`);
-  }
-}
-
-function concatUint8Arrays(a: Uint8Array, b: Uint8Array): Uint8Array {
-  const result = new Uint8Array(a.length + b.length);
-  result.set(a, 0);
-  result.set(b, a.length);
-  return result;
-}
+    case "scoreboard": {
+      const [roomId] = args;
+      const room = server.rooms.find((r) => r.id === roomId);
+      if (!room) {
+        printError(`Room ${roomId} not found`, json);
+      } else if (json) {
+        console.log(JSON.stringify(room.scoreboard()));
+      } else {
+        printScoreboard(room);
+      }
+      break;
+    }
+    case "message": {
+      const [clientId, ...messageParts] = args;
+      const message = messageParts.join(" ");
+      const client = server.clients.find((c) =>
+        c.id === parseInt(clientId, 10)
+      );
+      if (client) {
+        sendServerMessage(client, message);
+      } else {
+        console.log(`Client ${clientId} not found`);
+      }
+      break;
+    }
+    case "messageAll": {
+      const message = args.join(" ");
+      server.runClusterAction({ action: "messageAll", message });
+      break;
+    }
+    case "messageRoom": {
+      const [roomId, ...messageWords] = args;
+      server.runClusterAction({
+        action: "messageRoom",
+        roomId,
+        message: messageWords.join(" "),
+      });
+      break;
+    }
+    case "cleanup": {
+      audit({ action: "cleanup" });
+      server.cleanup()
+        .then((deleted) => {
+          console.log(
+            deleted.length
+              ? `Deleted ${deleted.join(", ")}`
+              : "Nothing past its retention period",
+          );
+        })
+        .catch((error) => {
+          console.log(`Error cleaning up old data: ${error.message}`);
+        });
+      break;
+    }
+    case "purgeClient": {
+      const [clientIdArg] = args;
+      const clientId = parseInt(clientIdArg, 10);
+      if (isNaN(clientId)) {
+        console.log(`Invalid clientId ${clientIdArg}`);
+        break;
+      }
 
-function findDelimiterIndex(data: Uint8Array): number {
-  for (let i = 0; i < data.length; i++) {
-    if (data[i] === 0 /* null terminator */) {
-      return i;
+      audit({ action: "purgeClient", target: clientIdArg });
+      server.purgeClient(clientId)
+        .then((found) => {
+          console.log(
+            found.length
+              ? `Purged client ${clientId} from ${found.join(", ")}`
+              : `No trace of client ${clientId} found`,
+          );
+        })
+        .catch((error) => {
+          console.log(`Error purging client ${clientId}: ${error.message}`);
+        });
+      break;
+    }
+    case "restoreRoom": {
+      const [roomId] = args;
+      audit({ action: "restoreRoom", target: roomId });
+      server.restoreArchivedRoom(roomId)
+        .then(() => console.log(`Restored room ${roomId}`))
+        .catch((error) => {
+          console.log(`Error restoring room ${roomId}: ${error.message}`);
+        });
+      break;
+    }
+    case "drain": {
+      audit({ action: "drain" });
+      server.drain();
+      break;
+    }
+    case "migrate": {
+      const [roomId, address, urlArg] = args;
+      const room = server.rooms.find((room) => room.id === roomId);
+      const [, host, portArg] = address?.match(/^(.+):(\d+)$/) ?? [];
+      const url = urlArg ??
+        (config.httpPort ? `http://${host}:${config.httpPort}` : undefined);
+      if (!room) {
+        console.log(`Room ${roomId} not found`);
+      } else if (!host) {
+        console.log(`Invalid address ${address}, expected host:port`);
+      } else if (!url) {
+        console.log("No url given, and HTTP_PORT isn't set to guess it from");
+      } else {
+        audit({ action: "migrate", target: roomId, destination: address });
+        server.migrateRoom(room, host, parseInt(portArg, 10), url)
+          .then(() => console.log(`Migrated room ${roomId} to ${address}`))
+          .catch((error) => {
+            console.log(`Error migrating room ${roomId}: ${error.message}`);
+          });
+      }
+      break;
+    }
+    case "handover": {
+      audit({ action: "handover" })
+        .then(() => server.handover())
+        .catch((error) => {
+          console.log(`Error handing over: ${error.message}`);
+        });
+      break;
+    }
+    case "maintenance": {
+      const [minutes, ...messageParts] = args;
+      if (minutes === "cancel") {
+        audit({ action: "cancelMaintenance" });
+        console.log(
+          server.cancelMaintenance()
+            ? "Maintenance cancelled"
+            : "No maintenance scheduled",
+        );
+      } else if (isNaN(parseInt(minutes, 10))) {
+        console.log("Usage: maintenance <minutes> <message>");
+      } else {
+        const message = messageParts.join(" ");
+        audit({ action: "maintenance", target: minutes, message });
+        server.startMaintenance(parseInt(minutes, 10), message);
+      }
+      break;
+    }
+    case "stop": {
+      const message = args.join(" ");
+      audit({ action: "stop", message }).then(() => server.stop(message));
+      break;
     }
   }
-  return -1;
 }
 
-const server = new Server();
-server.start().catch((error) => {
-  console.error("Error starting server: ", error);
-  Deno.exit(1);
-});
-
-globalThis.addEventListener("unhandledrejection", (e) => {
-  console.error("Unhandled rejection at:", e.promise, "reason:", e.reason);
-  e.preventDefault();
-  Deno.exit(1);
-});
-
-function sendServerMessage(client: Client, message: string) {
-  return client.sendPacket({
-    type: "SERVER_MESSAGE",
-    message,
-  });
+// One command per line, blank lines and lines starting with # are skipped
+async function runCommandFile(path: string) {
+  const commands = (await Deno.readTextFile(path)).split("\n")
+    .map((line) => line.trim())
+    .filter((line) => line && !line.startsWith("#"));
+  for (const line of commands) {
+    console.log(`> ${line}`);
+    runCommand(line);
+  }
 }
 
-function sendDisable(client: Client, message: string) {
-  sendServerMessage(client, message)
-    .finally(() =>
-      client.sendPacket({
-        type: "DISABLE_ANCHOR",
-      })
-    );
+try {
+  dashboard?.start();
+} catch (error) {
+  writeLog("error", `Error starting dashboard: ${error.message}`);
 }
 
-async function stop(message = "Server restarting") {
-  await Promise.all(
-    server.clients.map((client) =>
-      sendServerMessage(client, message)
-        .finally(() => {
-          client.disconnect();
-        })
-    ),
+// Started after the dashboard, so it mirrors console output the dashboard
+// would otherwise swallow
+async function startSshConsole() {
+  const hostKey = await loadHostKey(config.sshHostKeyPath);
+  const sshConsole = new SshConsole({
+    hostKey,
+    authorizedKeysPath: config.sshAuthorizedKeysPath,
+    runCommand,
+  });
+  const listener = Deno.listen({
+    hostname: config.listenHostname,
+    port: config.sshPort,
+  });
+  console.log(
+    `SSH console listening on port ${config.sshPort}, host key ${hostKey.fingerprint}`,
   );
+  await sshConsole.serve(listener);
+}
 
-  Deno.exit();
+if (config.sshPort) {
+  startSshConsole().catch((error) => {
+    writeLog("error", `Error starting SSH console: ${error.stack ?? error}`);
+  });
 }
 
+// The dashboard reads commands itself once it's running
 (async function processStdin() {
+  if (dashboard?.isRunning) {
+    return;
+  }
+
   try {
     for await (const line of readLines(Deno.stdin)) {
-      const [command, ...args] = line.split(" ");
-
-      switch (command) {
-        default:
-        case "help": {
-          console.log(
-            `Available commands:
-  help: Show this help message
-  stats: Print server stats
-  quiet: Toggle quiet mode
-  roomCount: Show the number of rooms
-  clientCount: Show the number of clients
-  list: List all rooms and clients
-  stop <message>: Stop the server
-  message <clientId> <message>: Send a message to a client
-  messageAll <message>: Send a message to all clients
-  disable <clientId> <message>: Disable anchor on a client
-  disableAll <message>: Disable anchor on all clients`,
-          );
-          break;
-        }
-        case "roomCount": {
-          console.log(`Room count: ${server.rooms.length}`);
-          break;
-        }
-        case "clientCount": {
-          console.log(`Client count: ${server.clients.length}`);
-          break;
-        }
-        case "quiet": {
-          quietMode = !quietMode;
-          console.log(`Quiet mode: ${quietMode}`);
-          break;
-        }
-        case "stats": {
-          const { clientSHAs: _, ...stats } = server.stats;
-          console.log(stats);
-          break;
-        }
-        case "list": {
-          for (const room of server.rooms) {
-            console.log(`Room ${room.id}:`);
-            for (const client of room.clients) {
-              console.log(
-                `  Client ${client.id}: ${JSON.stringify(client.data)}`,
-              );
-            }
-          }
-          break;
-        }
-        case "disable": {
-          const [clientId, ...messageParts] = args;
-          const message = messageParts.join(" ");
-          const client = server.clients.find((c) =>
-            c.id === parseInt(clientId, 10)
-          );
-          if (client) {
-            sendDisable(client, message);
-          } else {
-            console.log(`Client ${clientId} not found`);
-          }
-          break;
-        }
-        case "disableAll": {
-          const message = args.join(" ");
-          for (const client of server.clients) {
-            sendDisable(client, message);
-          }
-          break;
-        }
-        case "message": {
-          const [clientId, ...messageParts] = args;
-          const message = messageParts.join(" ");
-          const client = server.clients.find((c) =>
-            c.id === parseInt(clientId, 10)
-          );
-          if (client) {
-            sendServerMessage(client, message);
-          } else {
-            console.log(`Client ${clientId} not found`);
-          }
-          break;
-        }
-        case "messageAll": {
-          const message = args.join(" ");
-          for (const client of server.clients) {
-            sendServerMessage(client, message);
-          }
-          break;
-        }
-        case "stop": {
-          const message = args.join(" ");
-          stop(message);
-          break;
-        }
-      }
+      runCommand(line);
     }
   } catch (error) {
-    console.error("Error reading from stdin: ", error.message);
+    writeLog("error", `Error reading from stdin: ${error.message}`);
     processStdin();
   }
 })();
@@ -0,0 +1,416 @@
+// The packets shared by the server and clients. Each is JSON terminated by a
+// null byte
+import {
+  decodeBase64,
+  encodeBase64,
+} from "https://deno.land/std@0.208.0/encoding/base64.ts";
+
+const decoder = new TextDecoder();
+const encoder = new TextEncoder();
+
+export type ClientData = Record<string, any>;
+
+// Only read from the packet that creates a room, ignored afterwards
+export interface RoomOptions {
+  public?: boolean; // listed in LIST_ROOMS responses
+  metadata?: ClientData; // game info shown to clients browsing rooms
+  // Shown to clients browsing rooms and filtered on by LIST_ROOMS
+  title?: string;
+  description?: string;
+  tags?: string[];
+  region?: string; // e.g. "eu" or "us-east"
+  teamScoped?: boolean; // relay packets only between clients on the same team
+  retentionMinutes?: number; // overrides ROOM_RETENTION_MINUTES, up to the max
+  encrypted?: boolean; // only relay packets sealed with encryptPacket
+  gameId?: string; // defaults to the creator's data.gameId, see GAMES_PATH
+  minClientVersion?: string; // oldest data.clientVersion that can join
+  requireMatchingVersion?: boolean; // joiners need the creator's clientVersion
+  flagMerge?: FlagMerge; // how UPDATE_FLAGS are merged, "union" by default
+}
+
+export type FlagValue = boolean | number | string;
+
+// "union" keeps booleans set once true and ORs integer bitfields, other
+// values and "lastWriteWins" take the latest update
+export type FlagMerge = "union" | "lastWriteWins";
+
+export interface BasePacket {
+  clientId?: number;
+  roomId?: string;
+  roomOptions?: RoomOptions;
+  quickJoin?: boolean; // without a roomId, join any compatible public room
+  eventId?: string; // unique id, packets repeating a recent one are dropped
+  quiet?: boolean;
+  targetClientId?: number;
+  udpToken?: string; // only in datagrams, see UDP_INFO
+  seq?: number; // set by the server on packets kept in the room's event log
+  deliverySeq?: number; // set by the server on packets it wants an ACK for
+}
+
+interface UpdateClientDataPacket extends BasePacket {
+  type: "UPDATE_CLIENT_DATA";
+  data: ClientData;
+  // Receive CLIENT_DATA_DELTA instead of other clients' full updates
+  deltas?: boolean;
+  // A JWT from the server's identity provider, never relayed
+  authToken?: string;
+  // Generated once per install and kept, so the server can give the client
+  // back its clientId. Never relayed
+  clientUuid?: string;
+  // The highest seq received before reconnecting, when joining the same room
+  // again. Missed events are resent, never relayed
+  lastSeq?: number;
+}
+
+// Sent by clients with the flags they changed, relayed with the merged values
+// of those that changed the room's state, and sent with every flag to joiners
+interface UpdateFlagsPacket extends BasePacket {
+  type: "UPDATE_FLAGS";
+  flags: Record<string, FlagValue>;
+}
+
+// The top level fields of a client's data that changed since its last update
+interface ClientDataDeltaPacket extends BasePacket {
+  type: "CLIENT_DATA_DELTA";
+  changed: ClientData;
+  removed: string[];
+}
+
+interface AllClientDataPacket extends BasePacket {
+  type: "ALL_CLIENT_DATA";
+  clients: ClientData[];
+}
+
+interface ServerMessagePacket extends BasePacket {
+  type: "SERVER_MESSAGE";
+  message: string;
+}
+
+interface DisableAnchorPacket extends BasePacket {
+  type: "DISABLE_ANCHOR";
+}
+
+interface TeamChatPacket extends BasePacket {
+  type: "TEAM_CHAT";
+  message: string;
+}
+
+// Only delivered to targetClientId, who must be in the sender's room
+interface WhisperPacket extends BasePacket {
+  type: "WHISPER";
+  targetClientId: number;
+  message: string;
+}
+
+interface ChangeTeamPacket extends BasePacket {
+  type: "CHANGE_TEAM";
+  teamId: string;
+}
+
+interface ClientRttPacket extends BasePacket {
+  type: "CLIENT_RTT";
+  rtt: number;
+}
+
+// The answer to REQUEST_UDP, port is 0 when the server has no UDP channel
+interface UdpInfoPacket extends BasePacket {
+  type: "UDP_INFO";
+  port: number;
+  token?: string; // included in every datagram the client sends
+}
+
+// Sent by the room owner to promote or demote the client in targetClientId
+interface SetRolePacket extends BasePacket {
+  type: "SET_ROLE";
+  targetClientId: number;
+  role: "moderator" | "member";
+}
+
+// Sent by the owner or a moderator to remove targetClientId from the room
+interface KickPacket extends BasePacket {
+  type: "KICK";
+  targetClientId: number;
+}
+
+// Sent by the owner or a moderator, 0 minutes unmutes
+interface MutePacket extends BasePacket {
+  type: "MUTE";
+  targetClientId: number;
+  minutes?: number; // 10 by default
+}
+
+export type RoomSort = "clientCount" | "title" | "createdAt";
+
+// Every filter given must match
+interface ListRoomsPacket extends BasePacket {
+  type: "LIST_ROOMS";
+  gameId?: string;
+  region?: string;
+  tags?: string[]; // rooms with all of them
+  search?: string; // case insensitive, in the title or description
+  sort?: RoomSort; // most clients, alphabetical or newest first
+}
+
+interface RoomListPacket extends BasePacket {
+  type: "ROOM_LIST";
+  rooms: {
+    roomId: string;
+    clientCount: number;
+    metadata: ClientData;
+    encrypted: boolean;
+    gameId?: string;
+    title?: string;
+    description?: string;
+    tags: string[];
+    region?: string;
+  }[];
+}
+
+export interface TeamScore {
+  teamId: string;
+  checks: number; // SCOREBOARD_CHECK_TYPES packets sent by the team
+  items: number; // SCOREBOARD_ITEM_TYPES packets sent by the team
+  completionMs?: number; // from the room's creation to its first GAME_COMPLETE
+}
+
+// Answers REQUEST_SERVER_INFO
+export interface ServerInfo {
+  version: string;
+  commit: string;
+  runtime: string; // e.g. deno 2.2.0
+  startedAt: number;
+}
+
+interface ServerInfoPacket extends BasePacket, ServerInfo {
+  type: "SERVER_INFO";
+}
+
+// Sent just before the server closes the connection when the room moves to
+// another instance. The client should reconnect to host and port and join
+// roomId again, with its clientUuid or authToken and lastSeq, to carry on
+interface RedirectPacket extends BasePacket {
+  type: "REDIRECT";
+  roomId: string;
+  host: string;
+  port: number;
+}
+
+// What a client can handle, so servers and newer clients don't send older ones
+// packets they'd misread. Clients offer the ones they support, and the server
+// answers with those it agreed to. Unknown names are ignored
+export const capabilities = ["deltas", "chat", "acks"] as const;
+export type Capability = typeof capabilities[number];
+
+interface HandshakePacket extends BasePacket {
+  type: "HANDSHAKE";
+  capabilities: string[];
+}
+
+// Sent by clients that agreed to "acks", for every packet up to deliverySeq
+interface AckPacket extends BasePacket {
+  type: "ACK";
+  deliverySeq: number;
+}
+
+// Finished teams fastest first, then the rest by checks and items
+interface ScoreboardPacket extends BasePacket {
+  type: "SCOREBOARD";
+  teams: TeamScore[];
+}
+
+interface OtherPackets extends BasePacket {
+  type:
+    | "REQUEST_SAVE_STATE"
+    | "REQUEST_SCOREBOARD"
+    | "REQUEST_SERVER_INFO"
+    | "REQUEST_UDP"
+    | "PUSH_SAVE_STATE"
+    | "GAME_COMPLETE"
+    | "HEARTBEAT"
+    | "PING"
+    | "PONG";
+}
+
+export type Packet =
+  | UpdateClientDataPacket
+  | ClientDataDeltaPacket
+  | UpdateFlagsPacket
+  | DisableAnchorPacket
+  | ServerMessagePacket
+  | AllClientDataPacket
+  | TeamChatPacket
+  | WhisperPacket
+  | ChangeTeamPacket
+  | ClientRttPacket
+  | UdpInfoPacket
+  | SetRolePacket
+  | KickPacket
+  | MutePacket
+  | ListRoomsPacket
+  | RoomListPacket
+  | ScoreboardPacket
+  | ServerInfoPacket
+  | RedirectPacket
+  | HandshakePacket
+  | AckPacket
+  | OtherPackets;
+
+// Packets the server doesn't know are relayed as they are
+export interface GamePacket extends BasePacket {
+  type: string;
+  [field: string]: unknown;
+}
+
+// Fields the server routes packets by, left readable by encryptPacket
+export const routingFields = [
+  "type",
+  "clientId",
+  "roomId",
+  "roomOptions",
+  "quickJoin",
+  "eventId",
+  "quiet",
+  "targetClientId",
+  "udpToken",
+  "seq",
+  "deliverySeq",
+];
+
+// Packets the server reads beyond their routing fields, so they are never
+// encrypted. Chat is included, the server filters it
+export const readableTypes = [
+  "UPDATE_CLIENT_DATA",
+  "ALL_CLIENT_DATA",
+  "CLIENT_DATA_DELTA",
+  "UPDATE_FLAGS",
+  "SERVER_MESSAGE",
+  "DISABLE_ANCHOR",
+  "TEAM_CHAT",
+  "WHISPER",
+  "CHANGE_TEAM",
+  "SET_ROLE",
+  "KICK",
+  "MUTE",
+  "CLIENT_RTT",
+  "UDP_INFO",
+  "LIST_ROOMS",
+  "ROOM_LIST",
+  "REQUEST_SAVE_STATE",
+  "REQUEST_SCOREBOARD",
+  "SCOREBOARD",
+  "REQUEST_SERVER_INFO",
+  "SERVER_INFO",
+  "REDIRECT",
+  "HANDSHAKE",
+  "ACK",
+  "REQUEST_UDP",
+  "GAME_COMPLETE",
+  "HEARTBEAT",
+  "PING",
+  "PONG",
+];
+
+// Everyone in the room derives the same key from a passphrase shared outside
+// of anchor, so the server only ever sees ciphertext
+export async function deriveRoomKey(passphrase: string, roomId: string) {
+  const material = await crypto.subtle.importKey(
+    "raw",
+    encoder.encode(passphrase),
+    "PBKDF2",
+    false,
+    ["deriveKey"],
+  );
+  return crypto.subtle.deriveKey(
+    {
+      name: "PBKDF2",
+      hash: "SHA-256",
+      salt: encoder.encode(`anchor:${roomId}`),
+      iterations: 100000,
+    },
+    material,
+    { name: "AES-GCM", length: 256 },
+    false,
+    ["encrypt", "decrypt"],
+  );
+}
+
+// Moves every non routing field into payload, base64 of the IV followed by the
+// AES-GCM ciphertext of their JSON
+export async function encryptPacket<T extends Packet | GamePacket>(
+  packet: T,
+  key: CryptoKey,
+): Promise<T | GamePacket> {
+  if (readableTypes.includes(packet.type)) {
+    return packet;
+  }
+
+  const routing: Record<string, unknown> = {};
+  const secret: Record<string, unknown> = {};
+  for (const [field, value] of Object.entries(packet)) {
+    (routingFields.includes(field) ? routing : secret)[field] = value;
+  }
+
+  const iv = crypto.getRandomValues(new Uint8Array(12));
+  const ciphertext = new Uint8Array(
+    await crypto.subtle.encrypt(
+      { name: "AES-GCM", iv },
+      key,
+      encoder.encode(JSON.stringify(secret)),
+    ),
+  );
+  const sealed = new Uint8Array(iv.length + ciphertext.length);
+  sealed.set(iv);
+  sealed.set(ciphertext, iv.length);
+
+  return {
+    ...routing,
+    type: packet.type,
+    payload: encodeBase64(sealed),
+  };
+}
+
+// Throws if the payload was sealed with a different key or tampered with
+export async function decryptPacket<T extends Packet | GamePacket>(
+  packet: T,
+  key: CryptoKey,
+): Promise<T | GamePacket> {
+  if (!("payload" in packet) || typeof packet.payload !== "string") {
+    return packet;
+  }
+
+  const sealed = decodeBase64(packet.payload);
+  const plaintext = await crypto.subtle.decrypt(
+    { name: "AES-GCM", iv: sealed.subarray(0, 12) },
+    key,
+    sealed.subarray(12),
+  );
+  const { payload: _, ...routing } = packet;
+  return { ...routing, ...JSON.parse(decoder.decode(plaintext)) };
+}
+
+// Without the null terminator. Throws unless the JSON is an object with a type,
+// the other fields are only as trustworthy as the sender
+export function decodePacket(data: Uint8Array): Packet {
+  const packet = JSON.parse(decoder.decode(data));
+  if (typeof packet !== "object" || packet === null || Array.isArray(packet)) {
+    throw new Error("Packet is not an object");
+  }
+  if (typeof packet.type !== "string" || !packet.type) {
+    throw new Error("Packet has no type");
+  }
+  return packet;
+}
+
+export function encodePacket(packet: Packet | GamePacket): Uint8Array {
+  return encoder.encode(JSON.stringify(packet) + "\0");
+}
+
+// Starting from an offset already known to have no delimiter before it
+export function findDelimiterIndex(data: Uint8Array, from = 0): number {
+  for (let i = from; i < data.length; i++) {
+    if (data[i] === 0 /* null terminator */) {
+      return i;
+    }
+  }
+  return -1;
+}
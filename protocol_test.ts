@@ -0,0 +1,22 @@
+import { assertEquals } from "https://deno.land/std@0.208.0/assert/mod.ts";
+import { decodePacket, encodePacket, findDelimiterIndex } from "./protocol.ts";
+
+const trickyMessages = [
+  'She said "hi"',
+  "C:\\Users\\anchor\\",
+  "first line\nsecond line\r\n",
+  "tab\there, null-ish \\0 and \\u0000",
+  "\" \\\" \\\\\" '",
+  "emoji 🎈 and ünïcödé",
+  "}\0{",
+];
+
+Deno.test("round trips server messages with characters JSON escapes", () => {
+  for (const message of trickyMessages) {
+    const packet = { type: "SERVER_MESSAGE" as const, message };
+    const encoded = encodePacket(packet);
+    // The terminator is the only null byte, even when the message has one
+    assertEquals(findDelimiterIndex(encoded), encoded.length - 1);
+    assertEquals(decodePacket(encoded.subarray(0, -1)), packet);
+  }
+});
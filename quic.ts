@@ -0,0 +1,92 @@
+// Experimental QUIC transport, the same packets as over TCP on a single
+// bidirectional stream the client opens right after connecting. QUIC is still
+// unstable in Deno, so this needs Deno 2.2 or newer run with --unstable-net
+import type { Connection, Listener } from "./server.ts";
+
+// Clients must offer this ALPN protocol
+export const alpnProtocol = "anchor";
+
+export interface QuicListenOptions {
+  hostname: string;
+  port: number;
+  // PEM encoded, QUIC always uses TLS
+  cert: string;
+  key: string;
+}
+
+class QuicConnection implements Connection {
+  private connection: Deno.QuicConn;
+  private stream: Promise<Deno.QuicBidirectionalStream>;
+  private reader?: ReadableStreamDefaultReader<Uint8Array>;
+  private writer?: WritableStreamDefaultWriter<Uint8Array>;
+  // Left over from a chunk bigger than the caller's buffer
+  private pending = new Uint8Array(0);
+
+  constructor(connection: Deno.QuicConn) {
+    this.connection = connection;
+    this.stream = connection.incomingBidirectionalStreams.getReader().read()
+      .then(({ value, done }) => {
+        if (done) {
+          throw new Error("Closed before opening a stream");
+        }
+        return value;
+      });
+  }
+
+  get remoteAddr() {
+    return this.connection.remoteAddr;
+  }
+
+  async read(buffer: Uint8Array) {
+    if (!this.pending.length) {
+      this.reader ??= (await this.stream).readable.getReader();
+      const { value, done } = await this.reader.read();
+      if (done) {
+        return null;
+      }
+      this.pending = value;
+    }
+
+    const count = Math.min(buffer.length, this.pending.length);
+    buffer.set(this.pending.subarray(0, count));
+    this.pending = this.pending.subarray(count);
+    return count;
+  }
+
+  async write(data: Uint8Array) {
+    this.writer ??= (await this.stream).writable.getWriter();
+    await this.writer.write(data);
+    return data.length;
+  }
+
+  close() {
+    this.connection.close();
+  }
+}
+
+export function listenQuic(options: QuicListenOptions): Listener {
+  if (!("QuicEndpoint" in Deno)) {
+    throw new Error("QUIC needs Deno 2.2 or newer run with --unstable-net");
+  }
+
+  const endpoint = new Deno.QuicEndpoint({
+    hostname: options.hostname,
+    port: options.port,
+  });
+  const listener = endpoint.listen({
+    cert: options.cert,
+    key: options.key,
+    alpnProtocols: [alpnProtocol],
+  });
+
+  return {
+    async *[Symbol.asyncIterator]() {
+      for await (const connection of listener) {
+        yield new QuicConnection(connection);
+      }
+    },
+    close() {
+      endpoint.close();
+    },
+  };
+}
@@ -0,0 +1,294 @@
+// Just enough of RESP2 to run commands and subscribe to channels on Redis, see
+// https://redis.io/docs/reference/protocol-spec/. Commands sent while the
+// connection is down fail, subscriptions are renewed once it's back
+import { writeLog } from "./server.ts";
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+
+const reconnectDelayMs = 5000;
+const redisDefaultPort = 6379;
+
+// Error replies are Error values rather than thrown, so arrays can hold them
+export type RedisReply = string | number | null | Error | RedisReply[];
+
+export class RedisClient {
+  private commands: RedisConnection;
+  // Only created for the first subscription, a subscribed connection can't
+  // run other commands
+  private subscriber?: RedisConnection;
+  private handlers = new Map<string, (message: string) => void>();
+
+  // url is redis://[[user]:password@]host[:port][/db]
+  constructor(public readonly url: string) {
+    this.commands = new RedisConnection(url);
+  }
+
+  // Rejects with the error Redis replied with, or if not connected
+  command(...args: (string | number)[]) {
+    return this.commands.send(args);
+  }
+
+  // Resolves once commands can be sent
+  ready() {
+    return this.commands.ready();
+  }
+
+  // Messages published to channel, including by this process
+  subscribe(channel: string, handler: (message: string) => void) {
+    this.handlers.set(channel, handler);
+    if (this.subscriber) {
+      this.subscriber.write(["SUBSCRIBE", channel]);
+      return;
+    }
+
+    this.subscriber = new RedisConnection(
+      this.url,
+      (reply) => this.dispatch(reply),
+      () => {
+        if (this.handlers.size) {
+          this.subscriber?.write(["SUBSCRIBE", ...this.handlers.keys()]);
+        }
+      },
+    );
+  }
+
+  unsubscribe(channel: string) {
+    if (this.handlers.delete(channel)) {
+      this.subscriber?.write(["UNSUBSCRIBE", channel]);
+    }
+  }
+
+  close() {
+    this.commands.close();
+    this.subscriber?.close();
+  }
+
+  private dispatch(reply: RedisReply) {
+    if (Array.isArray(reply) && reply[0] === "message") {
+      this.handlers.get(reply[1] as string)?.(reply[2] as string);
+    } else if (reply instanceof Error) {
+      writeLog("error", `Error from Redis: ${reply.message}`);
+    }
+  }
+}
+
+class RedisConnection {
+  private connection?: Deno.Conn;
+  private writing = Promise.resolve();
+  private closed = false;
+  // Replies arrive in the order commands were sent
+  private pending: ((reply: RedisReply) => void)[] = [];
+  private readyWaiters: (() => void)[] = [];
+
+  // With onPush, every reply goes to it instead, for subscriptions
+  constructor(
+    private readonly url: string,
+    private readonly onPush?: (reply: RedisReply) => void,
+    private readonly onConnect?: () => void,
+  ) {
+    this.connect();
+  }
+
+  send(args: (string | number)[]) {
+    if (!this.connection) {
+      return Promise.reject(new Error("Not connected to Redis"));
+    }
+
+    return new Promise<RedisReply>((resolve, reject) => {
+      this.pending.push((reply) =>
+        reply instanceof Error ? reject(reply) : resolve(reply)
+      );
+      this.write(args);
+    });
+  }
+
+  ready() {
+    return this.connection
+      ? Promise.resolve()
+      : new Promise<void>((resolve) => this.readyWaiters.push(resolve));
+  }
+
+  write(args: (string | number)[]) {
+    const { connection } = this;
+    if (!connection) {
+      return;
+    }
+
+    const data = encoder.encode(encodeCommand(args));
+    this.writing = this.writing.then(async () => {
+      let written = 0;
+      while (written < data.length) {
+        written += await connection.write(data.subarray(written));
+      }
+    }).catch(() => {
+      // The read loop notices the connection closing and reconnects
+    });
+  }
+
+  close() {
+    this.closed = true;
+    this.connection?.close();
+    this.connection = undefined;
+  }
+
+  private async connect() {
+    while (!this.closed) {
+      try {
+        const { hostname, port, username, password, pathname } = new URL(
+          this.url,
+        );
+        const connection = await Deno.connect({
+          hostname,
+          port: port ? parseInt(port, 10) : redisDefaultPort,
+        });
+        this.connection = connection;
+        // Without a user, the password is the default user's
+        if (password) {
+          this.sendFirst(
+            username
+              ? [
+                "AUTH",
+                decodeURIComponent(username),
+                decodeURIComponent(password),
+              ]
+              : ["AUTH", decodeURIComponent(password)],
+          );
+        }
+        const database = pathname.slice(1);
+        if (database) {
+          this.sendFirst(["SELECT", database]);
+        }
+        this.onConnect?.();
+        this.readyWaiters.splice(0).forEach((resolve) => resolve());
+        writeLog("info", `Connected to Redis ${redact(this.url)}`);
+
+        await this.read(connection);
+      } catch (error) {
+        writeLog("error", `Error connecting to Redis: ${error.message}`);
+      }
+
+      this.connection = undefined;
+      this.pending.splice(0).forEach((resolve) =>
+        resolve(new Error("Connection to Redis closed"))
+      );
+      if (!this.closed) {
+        await new Promise((resolve) => setTimeout(resolve, reconnectDelayMs));
+      }
+    }
+  }
+
+  // Setup commands, whose replies only matter if they fail
+  private sendFirst(args: string[]) {
+    if (this.onPush) {
+      this.write(args);
+      return;
+    }
+    this.send(args).catch((error) => {
+      writeLog("error", `Error from Redis: ${error.message}`);
+    });
+  }
+
+  private async read(connection: Deno.Conn) {
+    let buffered = new Uint8Array(0);
+    const chunk = new Uint8Array(16 * 1024);
+    while (true) {
+      const read = await connection.read(chunk);
+      if (read === null) {
+        return;
+      }
+      const merged = new Uint8Array(buffered.length + read);
+      merged.set(buffered);
+      merged.set(chunk.subarray(0, read), buffered.length);
+      buffered = merged;
+
+      let offset = 0;
+      let parsed;
+      while ((parsed = parseReply(buffered, offset))) {
+        const [reply, next] = parsed;
+        offset = next;
+        if (this.onPush) {
+          this.onPush(reply);
+        } else {
+          this.pending.shift()?.(reply);
+        }
+      }
+      buffered = buffered.slice(offset);
+    }
+  }
+}
+
+function encodeCommand(args: (string | number)[]) {
+  return `*${args.length}\r\n` + args.map((arg) => {
+    const text = String(arg);
+    return `$${encoder.encode(text).length}\r\n${text}\r\n`;
+  }).join("");
+}
+
+// The reply starting at offset and where the next one starts, or undefined if
+// it hasn't all arrived yet. Bulk strings are read by their byte length, so
+// they can contain anything
+export function parseReply(
+  buffer: Uint8Array,
+  offset = 0,
+): [RedisReply, number] | undefined {
+  const lineEnd = indexOfCrlf(buffer, offset);
+  if (lineEnd === -1) {
+    return;
+  }
+  const line = decoder.decode(buffer.subarray(offset + 1, lineEnd));
+  let next = lineEnd + 2;
+
+  switch (String.fromCharCode(buffer[offset])) {
+    case "+":
+      return [line, next];
+    case "-":
+      return [new Error(line), next];
+    case ":":
+      return [parseInt(line, 10), next];
+    case "$": {
+      const length = parseInt(line, 10);
+      if (length < 0) {
+        return [null, next];
+      }
+      if (buffer.length < next + length + 2) {
+        return;
+      }
+      return [
+        decoder.decode(buffer.subarray(next, next + length)),
+        next + length + 2,
+      ];
+    }
+    case "*": {
+      const count = parseInt(line, 10);
+      if (count < 0) {
+        return [null, next];
+      }
+      const items: RedisReply[] = [];
+      for (let i = 0; i < count; i++) {
+        const parsed = parseReply(buffer, next);
+        if (!parsed) {
+          return;
+        }
+        items.push(parsed[0]);
+        next = parsed[1];
+      }
+      return [items, next];
+    }
+  }
+  throw new Error(`Unexpected reply from Redis: ${line}`);
+}
+
+function indexOfCrlf(buffer: Uint8Array, offset: number) {
+  for (let i = offset; i < buffer.length - 1; i++) {
+    if (buffer[i] === 13 && buffer[i + 1] === 10) {
+      return i;
+    }
+  }
+  return -1;
+}
+
+// Without any credentials, for logging
+function redact(url: string) {
+  return url.replace(/\/\/[^@/]*@/, "//");
+}
@@ -0,0 +1,5883 @@
+// The relay server. mod.ts runs it from the command line, to embed it in
+// another program create a Server and call start(). Configuration is read from
+// the environment and CONFIG_PATH either way
+import {
+  writeAll,
+  writeAllSync,
+} from "https://deno.land/std@0.208.0/streams/write_all.ts";
+import { encodeHex } from "https://deno.land/std@0.208.0/encoding/hex.ts";
+import {
+  timingSafeEqual,
+} from "https://deno.land/std@0.208.0/crypto/timing_safe_equal.ts";
+import { load } from "https://deno.land/std@0.208.0/dotenv/mod.ts";
+import {
+  basename,
+  dirname,
+  join,
+  resolve,
+  toFileUrl,
+} from "https://deno.land/std@0.208.0/path/mod.ts";
+import {
+  capabilities,
+  type Capability,
+  type ClientData,
+  decodePacket,
+  encodePacket,
+  findDelimiterIndex,
+  type FlagMerge,
+  type FlagValue,
+  type GamePacket,
+  type Packet,
+  readableTypes,
+  type RoomOptions,
+  routingFields,
+  type ServerInfo,
+  type TeamScore,
+} from "./protocol.ts";
+import { listenQuic } from "./quic.ts";
+import { listenWebSocket } from "./websocket.ts";
+import {
+  createServiceRegistry,
+  redact,
+  type ServiceRegistry,
+} from "./discovery.ts";
+import { importJwtKey, type JwtKey, verifyJwt } from "./jwt.ts";
+import { StatsdClient } from "./statsd.ts";
+import { postWebhook, sign } from "./webhooks.ts";
+import { createEventPublisher, type EventPublisher } from "./eventbus.ts";
+import { Cluster, type RoomMessage, type SharedRoom } from "./cluster.ts";
+
+export type { ClientData, Packet, RoomOptions } from "./protocol.ts";
+
+const encoder = new TextEncoder();
+
+export interface ServerStats {
+  lastStatsHeartbeat: number;
+  clientSHAs: Record<string, boolean>;
+  onlineCount: number;
+  gamesCompleted: number;
+  leaderboard: LeaderboardEntry[];
+  pid: number;
+  // Kept so clientIds stay unique, and clientUuids valid, across restarts
+  lastClientId: number;
+  // By clientUuid, the clientId that install last had
+  clientUuids: Record<string, number>;
+  // By clientUuid, when it last connected, for CLIENT_RETENTION_DAYS
+  clientUuidLastSeen: Record<string, number>;
+}
+
+// The first GAME_COMPLETE from each team in a room
+export interface LeaderboardEntry {
+  roomId: string;
+  teamId: string;
+  elapsedMs: number; // Since the room was created
+  playerCount: number;
+  completedAt: number;
+}
+
+// Posted to another instance's /rooms by migrateRoom
+interface RoomMigration {
+  snapshot: RoomSnapshot;
+  // Those of the room's members, so they keep their clientIds
+  clientUuids?: Record<string, number>;
+  accountClientIds?: Record<string, number>;
+}
+
+// Everything needed to recreate a room in another process
+export interface RoomSnapshot extends RoomOptions {
+  id: string;
+  createdAt?: number;
+  seedHash?: string;
+  settings?: string;
+  requiredClientVersion?: string;
+  memberIds?: number[];
+  teamAssignments?: Record<number, string>;
+  scores?: TeamScore[];
+  flags?: Record<string, Record<string, FlagValue>>;
+  events?: RoomEvent[];
+  savedStates: Record<string, Packet>;
+  eventIds: string[];
+}
+
+// A packet that changed the room's state, in the order they were applied
+export interface RoomEvent {
+  seq: number;
+  timestamp: number;
+  clientId: number;
+  // The sender's team when it was sent
+  teamId: string;
+  packet: Packet;
+}
+
+// Rules for the rooms of one game, from GAMES_PATH
+interface GameRules {
+  // Game packets relayed in its rooms, any when unset. The server's own
+  // packets are always allowed
+  packetTypes?: string[];
+  // Checked on top of REQUIRED_CLIENT_DATA_FIELDS
+  requiredClientDataFields?: string[];
+}
+
+// Broadcast to every client whenever the cron style schedule matches
+interface Announcement {
+  message: string;
+  schedule: string; // minute hour day-of-month month day-of-week
+}
+
+// Extends the server without changing handlePacket, for custom stats or
+// tournament logic. Plugins are modules listed in PLUGINS with one as their
+// default export
+export interface Plugin {
+  name: string;
+  onJoin?(client: Client, room: Room): void;
+  // Returning false drops the packet
+  onPacket?(client: Client, packet: Packet): boolean | void;
+  onDisconnect?(client: Client): void;
+  onGameComplete?(client: Client, room: Room): void;
+}
+
+type PluginHook = Exclude<keyof Plugin, "name">;
+
+// Admin actions that reach every instance when clustered
+export type ClusterAction =
+  | { action: "messageAll"; message: string }
+  | { action: "disableAll"; message: string }
+  | { action: "messageRoom"; roomId: string; message: string };
+
+// What a client needs from its socket, so transports other than TCP, and
+// stand ins for tests or replays, can be used
+export interface Connection {
+  readonly remoteAddr: Deno.Addr;
+  read(buffer: Uint8Array): Promise<number | null>;
+  write(data: Uint8Array): Promise<number>;
+  close(): void;
+}
+
+// Yields a Connection per client, Deno.Listener satisfies this
+export interface Listener extends AsyncIterable<Connection> {
+  close(): void;
+}
+
+// Which of a room's clients a broadcast goes to, every given filter must match
+export interface BroadcastFilter {
+  exclude?: Client; // usually the sender
+  teamId?: string;
+  online?: boolean; // skip clients that are disconnecting
+  where?: (client: Client) => boolean;
+}
+
+interface PacketTypeStats {
+  received: number;
+  sent: number;
+  bytesReceived: number;
+  bytesSent: number;
+  // Dropped from a slow client's queue in favour of a newer one
+  superseded: number;
+  // Times one waited at the head of a queue for MAX_CLIENT_BYTES_PER_SECOND
+  throttled: number;
+}
+
+// Packets of ACKED_PACKET_TYPES sent to a client in its room, numbered from 1
+// and kept until the client acknowledges them
+interface Deliveries {
+  nextSeq: number;
+  unacked: Packet[];
+}
+
+interface QueuedPacket {
+  type: string;
+  packet: Uint8Array;
+  supersedeKey?: string;
+  // Queued ahead of every packet that isn't, see urgentPacketTypes
+  urgent: boolean;
+  resolve: () => void;
+}
+
+// Settings from the config file, real environment variables take precedence
+const configPath = Deno.env.get("CONFIG_PATH") ?? "./.env";
+let configFile: Record<string, string> = {};
+
+function env(name: string): string | undefined {
+  return Deno.env.get(name) ?? configFile[name];
+}
+
+function envInt(name: string, fallback: number): number {
+  const value = parseInt(env(name) ?? "", 10);
+  return isNaN(value) ? fallback : value;
+}
+
+const logFormats = ["text", "json"] as const;
+type LogFormat = typeof logFormats[number];
+
+function parseLogFormat(format?: string): LogFormat {
+  return logFormats.find((f) => f === format) ?? "text";
+}
+
+// Outside config as it's needed while the rest of the config loads
+let logFormat: LogFormat = "text";
+
+type LogLevel = "info" | "error";
+
+export interface LogFields {
+  clientId?: number;
+  roomId?: string;
+  // Short name for what happened, e.g. clientJoined, to query by
+  event?: string;
+}
+
+// With LOG_FORMAT=json a JSON object so logs can be shipped to Loki or
+// Elasticsearch and queried by room or client. source prefixes text lines,
+// e.g. "Room 1"
+function formatLog(
+  level: LogLevel,
+  message: string,
+  fields: LogFields,
+  source?: string,
+  timestamped = false,
+) {
+  if (logFormat === "json") {
+    return JSON.stringify({
+      timestamp: new Date().toISOString(),
+      level,
+      ...fields,
+      message,
+    });
+  }
+
+  const line = source ? `[${source}]: ${message}` : message;
+  return timestamped ? `${new Date().toISOString()} ${line}` : line;
+}
+
+// Writes one line to the console, see formatLog
+export function writeLog(
+  level: LogLevel,
+  message: string,
+  fields: LogFields = {},
+  source?: string,
+) {
+  const print = level === "error" ? console.error : console.log;
+  print(formatLog(level, message, fields, source));
+}
+
+// Numbers, ranges or * with an optional /step, comma separated
+const cronFieldPattern =
+  /^(\*|\d+(-\d+)?)(\/[1-9]\d*)?(,(\*|\d+(-\d+)?)(\/[1-9]\d*)?)*$/;
+// Lowest and highest value of each cron field
+const cronFieldRanges = [[0, 59], [0, 23], [1, 31], [1, 12], [0, 6]];
+
+function cronFieldMatches(field: string, value: number, [low, high]: number[]) {
+  return field.split(",").some((part) => {
+    const [range, stepString] = part.split("/");
+    const step = stepString === undefined ? 1 : parseInt(stepString, 10);
+    const [start, end] = range === "*"
+      ? [low, high]
+      : range.split("-").map((n) => parseInt(n, 10));
+
+    return value >= start && value <= (end ?? start) &&
+      (value - start) % step === 0;
+  });
+}
+
+function isValidCronSchedule(schedule: unknown) {
+  if (typeof schedule !== "string") {
+    return false;
+  }
+
+  const fields = schedule.trim().split(/\s+/);
+  return fields.length === 5 &&
+    fields.every((field) => cronFieldPattern.test(field));
+}
+
+function cronScheduleMatches(schedule: string, date: Date) {
+  const values = [
+    date.getMinutes(),
+    date.getHours(),
+    date.getDate(),
+    date.getMonth() + 1,
+    date.getDay(),
+  ];
+
+  return schedule.trim().split(/\s+/).every((field, i) =>
+    cronFieldMatches(field, values[i], cronFieldRanges[i])
+  );
+}
+
+async function loadAnnouncements(path: string): Promise<Announcement[]> {
+  let announcements: Announcement[];
+  try {
+    announcements = JSON.parse(await Deno.readTextFile(path));
+  } catch (error) {
+    if (!(error instanceof Deno.errors.NotFound)) {
+      writeLog("error", `Error reading ${path}: ${error.message}`);
+    }
+    return [];
+  }
+
+  return announcements.filter((announcement) => {
+    if (
+      typeof announcement.message !== "string" ||
+      !isValidCronSchedule(announcement.schedule)
+    ) {
+      writeLog(
+        "error",
+        `Ignoring invalid announcement ${JSON.stringify(announcement)}`,
+      );
+      return false;
+    }
+    return true;
+  });
+}
+
+// JWT_SECRET for HS256 tokens, otherwise the identity provider's public key
+async function loadJwtKey(): Promise<JwtKey | undefined> {
+  const secret = env("JWT_SECRET");
+  const publicKeyPath = env("JWT_PUBLIC_KEY_PATH");
+  try {
+    if (secret) {
+      return await importJwtKey("HS256", secret);
+    }
+    if (publicKeyPath) {
+      return await importJwtKey(
+        env("JWT_ALGORITHM") ?? "RS256",
+        await Deno.readTextFile(publicKeyPath),
+      );
+    }
+  } catch (error) {
+    writeLog("error", `Error loading JWT key: ${error.message}`);
+  }
+}
+
+// By gameId, empty when the file doesn't exist so rooms can be for any game
+async function loadGames(path: string): Promise<Record<string, GameRules>> {
+  let games: Record<string, GameRules>;
+  try {
+    games = JSON.parse(await Deno.readTextFile(path));
+  } catch (error) {
+    if (!(error instanceof Deno.errors.NotFound)) {
+      writeLog("error", `Error reading ${path}: ${error.message}`);
+    }
+    return {};
+  }
+
+  for (const [gameId, rules] of Object.entries(games)) {
+    const isStringArray = (value: unknown) =>
+      value === undefined ||
+      (Array.isArray(value) && value.every((item) => typeof item === "string"));
+    if (
+      typeof rules !== "object" || rules === null ||
+      !isStringArray(rules.packetTypes) ||
+      !isStringArray(rules.requiredClientDataFields)
+    ) {
+      writeLog("error", `Ignoring invalid rules for game ${gameId}`);
+      delete games[gameId];
+    }
+  }
+  return games;
+}
+
+const contentFilterActions = ["mask", "drop", "disconnect"] as const;
+type ContentFilterAction = typeof contentFilterActions[number];
+
+function compileContentFilter(source?: string) {
+  if (!source) {
+    return undefined;
+  }
+
+  try {
+    return new RegExp(source, "gi");
+  } catch (error) {
+    writeLog("error", `Ignoring invalid CONTENT_FILTER: ${error.message}`);
+    return undefined;
+  }
+}
+
+function parseContentFilterAction(action?: string): ContentFilterAction {
+  return contentFilterActions.find((a) => a === action) ?? "mask";
+}
+
+// What happens when an account signs in while it's connected elsewhere
+const duplicateLoginActions = ["takeover", "reject"] as const;
+type DuplicateLoginAction = typeof duplicateLoginActions[number];
+
+function parseDuplicateLoginAction(action?: string): DuplicateLoginAction {
+  return duplicateLoginActions.find((a) => a === action) ?? "takeover";
+}
+
+// Behaviour operators can switch off, or roll out to some clients first, see
+// FEATURES. Each is on for a percentage of clients, all of them by default
+export const features = ["deltas", "udp", "whispers"] as const;
+export type Feature = typeof features[number];
+
+// Comma separated name=on|off|<percent>, e.g. deltas=off,whispers=25. A bare
+// name is on
+export function parseFeatures(value = "") {
+  const percents = Object.fromEntries(
+    features.map((feature) => [feature, 100]),
+  ) as Record<Feature, number>;
+  for (const entry of value.split(",").map((e) => e.trim()).filter(Boolean)) {
+    const [name, setting = "on"] = entry.split("=").map((part) => part.trim());
+    const feature = features.find((f) => f === name);
+    const percent = parseFeaturePercent(setting);
+    if (!feature) {
+      throw new Error(
+        `Unknown feature ${name}, can be any of ${features.join(", ")}`,
+      );
+    }
+    if (percent === undefined) {
+      throw new Error(
+        `Invalid setting ${setting} for ${name}, use on, off or 0-100`,
+      );
+    }
+    percents[feature] = percent;
+  }
+  return percents;
+}
+
+export function parseFeaturePercent(setting: string) {
+  const percent = setting === "on"
+    ? 100
+    : setting === "off"
+    ? 0
+    : Number(setting.replace(/%$/, ""));
+  return Number.isInteger(percent) && percent >= 0 && percent <= 100
+    ? percent
+    : undefined;
+}
+
+// Posted to WEBHOOK_URLS and published to EVENT_BUS_URL as they happen
+export const serverEventTypes = [
+  "clientConnected",
+  "clientDisconnected",
+  "roomCreated",
+  "roomDeleted",
+  "gameCompleted",
+] as const;
+export type ServerEventType = typeof serverEventTypes[number];
+
+function parseServerEventTypes(value: string | undefined): ServerEventType[] {
+  if (!value) {
+    return [...serverEventTypes];
+  }
+
+  const types = value.split(",").map((type) => type.trim()).filter(Boolean);
+  for (const type of types) {
+    if (!serverEventTypes.includes(type as ServerEventType)) {
+      throw new Error(
+        `Unknown event ${type}, can be any of ${serverEventTypes.join(", ")}`,
+      );
+    }
+  }
+  return types as ServerEventType[];
+}
+
+// Transports LISTENERS can use
+const listenTransports = ["tcp", "tls", "ws", "wss"] as const;
+type ListenTransport = typeof listenTransports[number];
+
+export interface ListenAddress {
+  transport: ListenTransport;
+  hostname: string;
+  port: number;
+}
+
+// Comma separated, e.g. tcp://:43383,tls://0.0.0.0:43384,ws://[::]:8080. An
+// empty hostname is LISTEN_HOSTNAME
+function parseListenAddresses(value: string, defaultHostname: string) {
+  return value.split(",").map((address) => address.trim()).filter(Boolean)
+    .map((address): ListenAddress => {
+      const [, scheme, hostname, port] =
+        address.match(/^(\w+):\/\/(.*):(\d+)$/) ?? [];
+      const transport = listenTransports.find((t) => t === scheme);
+      if (!transport) {
+        throw new Error(
+          `Invalid listener ${address}, expected ${
+            listenTransports.map((t) => `${t}://`).join(", ")
+          } followed by host:port`,
+        );
+      }
+      return {
+        transport,
+        hostname: hostname.replace(/^\[(.*)\]$/, "$1") || defaultHostname,
+        port: parseInt(port, 10),
+      };
+    });
+}
+
+function formatListenAddress({ transport, hostname, port }: ListenAddress) {
+  const host = hostname.includes(":") ? `[${hostname}]` : hostname;
+  return `${transport}://${host}:${port}`;
+}
+
+async function loadConfig() {
+  try {
+    configFile = await load({ envPath: configPath });
+  } catch (error) {
+    writeLog("error", `Error reading ${configPath}: ${error.message}`);
+  }
+  logFormat = parseLogFormat(env("LOG_FORMAT"));
+
+  const announcementsPath = env("ANNOUNCEMENTS_PATH") ??
+    "./announcements.json";
+
+  const port = envInt("PORT", 43385);
+  const listenHostname = env("LISTEN_HOSTNAME") ?? "0.0.0.0";
+
+  return {
+    port,
+    // Comma separated module paths or URLs, loaded once at startup
+    plugins: (env("PLUGINS") ?? "").split(",").map((path) => path.trim())
+      .filter(Boolean),
+    // Address every listener binds to, e.g. 127.0.0.1 behind a proxy
+    listenHostname,
+    // Every address clients can connect to, all feeding the same rooms. Just
+    // PORT over TCP unless set
+    listeners: parseListenAddresses(
+      env("LISTENERS") ?? `tcp://:${port}`,
+      listenHostname,
+    ),
+    // For tls:// and wss:// listeners
+    tlsCertPath: env("TLS_CERT_PATH") ?? "./cert.pem",
+    tlsKeyPath: env("TLS_KEY_PATH") ?? "./key.pem",
+    // Applied to each connection as it's accepted. NODELAY sends small packets
+    // right away, keepalive notices peers that vanished behind a NAT
+    tcpNoDelay: env("TCP_NO_DELAY") !== undefined,
+    tcpKeepAlive: env("TCP_KEEPALIVE") !== undefined,
+    // Experimental QUIC listener alongside TCP, 0 disables. QUIC always uses
+    // TLS, so it needs a PEM certificate and key
+    quicPort: envInt("QUIC_PORT", 0),
+    quicCertPath: env("QUIC_CERT_PATH") ?? "./cert.pem",
+    quicKeyPath: env("QUIC_KEY_PATH") ?? "./key.pem",
+    // Side channel for loss tolerant game packets like positions, 0 disables
+    udpPort: envInt("UDP_PORT", 0),
+    // Serves the HTTP endpoints below, 0 disables
+    httpPort: envInt("HTTP_PORT", 0),
+    // Serve the fastest completions as JSON at /leaderboard
+    publicLeaderboard: env("PUBLIC_LEADERBOARD") !== undefined,
+    // Faster completions are still scored but kept off the leaderboard, as a
+    // client can send GAME_COMPLETE as soon as it creates a room
+    leaderboardMinSeconds: envInt("LEADERBOARD_MIN_SECONDS", 60),
+    // Save states are by far the largest packets, so leave plenty of headroom
+    maxPacketSize: envInt("MAX_PACKET_SIZE", 1024 * 1024 * 8),
+    // Past either of these new connections are turned away, so the players
+    // already here keep a responsive server. 0 disables
+    shedMemoryMb: envInt("SHED_MEMORY_MB", 0),
+    shedEventLoopLagMs: envInt("SHED_EVENT_LOOP_LAG_MS", 0),
+    // Connections past this are turned away, 0 for no limit. The maxConnections
+    // console command changes it until the config is next reloaded
+    maxConnections: envInt("MAX_CONNECTIONS", 0),
+    // How long an empty room holding a saved state is kept for late joiners
+    roomRetentionMinutes: envInt("ROOM_RETENTION_MINUTES", 60 * 6),
+    // Upper bound for rooms asking for a longer retention period
+    maxRoomRetentionMinutes: envInt("MAX_ROOM_RETENTION_MINUTES", 60 * 24 * 7),
+    // How often a client in each room is asked for a fresh save state
+    saveStateSnapshotMinutes: envInt("SAVE_STATE_SNAPSHOT_MINUTES", 5),
+    // A client whose writes time out this many times in a row is disconnected,
+    // so one stalled connection can't hold up its packets forever
+    writeTimeoutSeconds: envInt("WRITE_TIMEOUT_SECONDS", 10),
+    maxWriteTimeouts: envInt("MAX_WRITE_TIMEOUTS", 3),
+    // Outbound to each client over TCP, 0 for no limit. Queued packets wait
+    // and can be superseded meanwhile, so one huge room can't use the uplink
+    maxClientBytesPerSecond: envInt("MAX_CLIENT_BYTES_PER_SECOND", 0),
+    // Client data is sent to every client in the room on each join and leave
+    maxClientDataSize: envInt("MAX_CLIENT_DATA_SIZE", 1024 * 4),
+    requiredClientDataFields: (env("REQUIRED_CLIENT_DATA_FIELDS") ?? "")
+      .split(",").map((field) => field.trim()).filter(Boolean),
+    // Checked against relayed chat messages and client names
+    contentFilter: compileContentFilter(env("CONTENT_FILTER")),
+    contentFilterAction: parseContentFilterAction(env("CONTENT_FILTER_ACTION")),
+    // Sent as a SERVER_MESSAGE to every client joining a room
+    motd: env("MOTD") ?? "",
+    announcements: await loadAnnouncements(announcementsPath),
+    // Games this server hosts and their rules, rooms can be for any game when
+    // the file doesn't exist
+    games: await loadGames(env("GAMES_PATH") ?? "./games.json"),
+    // How often clients are pinged to measure round trip time, 0 disables
+    pingIntervalSeconds: envInt("PING_INTERVAL_SECONDS", 30),
+    // How often clients are sent a HEARTBEAT, 0 disables this
+    heartbeatIntervalSeconds: envInt("HEARTBEAT_INTERVAL_SECONDS", 30),
+    // How often stats are saved, the Discord bot reads them
+    statsIntervalMs: envInt("STATS_INTERVAL_MS", 2500),
+    cleanupIntervalHours: envInt("CLEANUP_INTERVAL_HOURS", 24),
+    // How long a dropped client keeps its place in its room, 0 removes it
+    // right away
+    reconnectGraceSeconds: envInt("RECONNECT_GRACE_SECONDS", 0),
+    // How often clients receiving deltas are sent everyone's full client data
+    // to resync, 0 disables
+    clientDataSyncSeconds: envInt("CLIENT_DATA_SYNC_SECONDS", 60),
+    // Game packets carrying a player's full latest state, like positions. Only
+    // the newest from each player is kept while a client's connection is
+    // backed up
+    supersededPacketTypes: (env("SUPERSEDED_PACKET_TYPES") ?? "")
+      .split(",").map((type) => type.trim()).filter(Boolean),
+    // Game packets counted on the scoreboard as a check or an item found
+    scoreboardCheckTypes: (env("SCOREBOARD_CHECK_TYPES") ?? "")
+      .split(",").map((type) => type.trim()).filter(Boolean),
+    scoreboardItemTypes: (env("SCOREBOARD_ITEM_TYPES") ?? "")
+      .split(",").map((type) => type.trim()).filter(Boolean),
+    // Resent after reconnecting until acknowledged, to clients that agree to
+    // "acks" in their HANDSHAKE
+    ackedPacketTypes: (
+      env("ACKED_PACKET_TYPES") ?? "GIVE_ITEM,DISABLE_ANCHOR,GAME_COMPLETE"
+    ).split(",").map((type) => type.trim()).filter(Boolean),
+    // Send each measured round trip time to the rest of the client's room
+    relayRtt: env("RELAY_RTT") !== undefined,
+    recordingsDir: env("RECORDINGS_DIR") ?? "./recordings",
+    // Events kept in memory per room, older ones are only in EVENT_LOG_DIR
+    roomEventLogSize: envInt("ROOM_EVENT_LOG_SIZE", 5000),
+    eventLogDir: env("EVENT_LOG_DIR"),
+    // State dumps written on SIGUSR1
+    dumpsDir: env("DUMPS_DIR") ?? "./dumps",
+    // Rooms removed after their retention period are saved here
+    roomArchiveDir: env("ROOM_ARCHIVE_DIR") ?? "./archive",
+    // Where the roomLog console command writes a room's log file
+    roomLogsDir: env("ROOM_LOGS_DIR") ?? "./roomLogs",
+    statsPath: env("STATS_PATH") ?? "./stats.json",
+    // How many timestamped copies of stats.json to keep, and how often to make
+    // them. Loaded from if stats.json itself is corrupt
+    statsBackups: envInt("STATS_BACKUPS", 5),
+    statsBackupMinutes: envInt("STATS_BACKUP_MINUTES", 60),
+    // Online, room and completion counts are sampled here for the history
+    // command, 0 disables sampling
+    historyPath: env("HISTORY_PATH") ?? "./history.csv",
+    historySampleMinutes: envInt("HISTORY_SAMPLE_MINUTES", 5),
+    // host:port of a StatsD daemon to push metrics to, unset disables this
+    statsdAddress: env("STATSD_ADDRESS"),
+    statsdPrefix: env("STATSD_PREFIX") ?? "anchor.",
+    statsdIntervalSeconds: envInt("STATSD_INTERVAL_SECONDS", 10),
+    // Deleted by the scheduled cleanup once they're this old, 0 keeps them
+    archiveRetentionDays: envInt("ARCHIVE_RETENTION_DAYS", 0),
+    eventLogRetentionDays: envInt("EVENT_LOG_RETENTION_DAYS", 0),
+    recordingRetentionDays: envInt("RECORDING_RETENTION_DAYS", 0),
+    clientRetentionDays: envInt("CLIENT_RETENTION_DAYS", 0),
+    // The admin console over SSH, public key authentication only, 0 disables
+    sshPort: envInt("SSH_PORT", 0),
+    sshHostKeyPath: env("SSH_HOST_KEY_PATH") ?? "./ssh_host_key.json",
+    sshAuthorizedKeysPath: env("SSH_AUTHORIZED_KEYS_PATH") ??
+      "./authorized_keys",
+    // Server events are POSTed to each of these as JSON
+    webhookUrls: (env("WEBHOOK_URLS") ?? "")
+      .split(",").map((url) => url.trim()).filter(Boolean),
+    // Signs each request, unset sends them unsigned
+    webhookSecret: env("WEBHOOK_SECRET"),
+    webhookRetries: envInt("WEBHOOK_RETRIES", 3),
+    // Which events are posted, all of them when unset
+    webhookEvents: parseServerEventTypes(env("WEBHOOK_EVENTS")),
+    // nats:// or kafka:// URL every server event is also published to
+    eventBusUrl: env("EVENT_BUS_URL"),
+    // The NATS subject prefix, or the Kafka topic
+    eventBusTopic: env("EVENT_BUS_TOPIC") ?? "anchor",
+    // Relay admin actions like messageAll to every instance on the same Redis,
+    // or the same NATS event bus without one
+    cluster: env("CLUSTER") !== undefined,
+    // Signs admin actions relayed between instances, which all need the same
+    // one. Clustering stays off without it
+    clusterSecret: env("CLUSTER_SECRET"),
+    // Shares rooms with every instance using the same Redis, so clients in a
+    // room can be on different instances. Read at startup
+    redisUrl: env("REDIS_URL"),
+    // Prefixes keys and channels, for instances sharing Redis with other apps
+    redisPrefix: env("REDIS_PREFIX") ?? "anchor",
+    // Append only record of admin actions affecting players
+    auditLogPath: env("AUDIT_LOG_PATH") ?? "./audit.log",
+    // Lets other instances migrate rooms here with POST /rooms on HTTP_PORT,
+    // and this one migrate rooms to them. Unset disables both
+    migrationSecret: env("MIGRATION_SECRET"),
+    // consul:// or http(s):// registry launchers find this server in, with the
+    // host[:port] players should connect to, PORT if not given
+    discoveryUrl: env("DISCOVERY_URL"),
+    discoveryAddress: env("DISCOVERY_ADDRESS"),
+    discoveryIntervalSeconds: envInt("DISCOVERY_INTERVAL_SECONDS", 30),
+    // Where this server is, e.g. eu-west, for launchers picking the nearest
+    region: env("REGION"),
+    // How long SIGTERM waits for players to leave before stopping, within
+    // Kubernetes' default 30 second terminationGracePeriodSeconds
+    shutdownGraceSeconds: envInt("SHUTDOWN_GRACE_SECONDS", 25),
+    // Written by the handover command, read back (and removed) on startup
+    roomSnapshotPath: env("ROOM_SNAPSHOT_PATH") ?? "./rooms.json",
+    quiet: env("QUIET") !== undefined,
+    // Verifies the authToken clients can send when joining, binding them to the
+    // account in its JWT_ACCOUNT_CLAIM
+    jwtKey: await loadJwtKey(),
+    jwtIssuer: env("JWT_ISSUER"),
+    jwtAudience: env("JWT_AUDIENCE"),
+    jwtAccountClaim: env("JWT_ACCOUNT_CLAIM") ?? "sub",
+    // Clients with an older data.clientVersion, or none, are disconnected
+    minClientVersion: env("MIN_CLIENT_VERSION"),
+    // Only clients with a valid authToken can join rooms
+    requireAuth: env("REQUIRE_AUTH") !== undefined,
+    duplicateLogin: parseDuplicateLoginAction(env("DUPLICATE_LOGIN")),
+    // Percentage of clients each feature is on for, see features
+    features: parseFeatures(env("FEATURES")),
+    // Drop connections sending anything the server can't validate
+    strict: env("STRICT") !== undefined,
+    // Game defined packets relayed in strict mode, their fields aren't checked
+    strictAllowedTypes: (env("STRICT_ALLOWED_TYPES") ?? "")
+      .split(",").map((type) => type.trim()).filter(Boolean),
+  };
+}
+
+export let config = await loadConfig();
+export let quietMode = config.quiet;
+
+export function setQuietMode(quiet: boolean) {
+  quietMode = quiet;
+}
+
+export function setMaxConnections(maxConnections: number) {
+  config = { ...config, maxConnections };
+}
+
+// Until the config is next reloaded, like the feature console command
+export function setFeature(feature: Feature, percent: number) {
+  config = { ...config, features: { ...config.features, [feature]: percent } };
+}
+
+// Everything but the ports can change without restarting, PORT and QUIC_PORT
+// apply to listeners bound again by rebindListeners
+export async function reloadConfig() {
+  const {
+    httpPort: newHttpPort,
+    listenHostname: newListenHostname,
+    udpPort: newUdpPort,
+    sshPort: newSshPort,
+    plugins: _,
+    ...newConfig
+  } = await loadConfig();
+  if (
+    newHttpPort !== config.httpPort ||
+    newListenHostname !== config.listenHostname ||
+    newUdpPort !== config.udpPort || newSshPort !== config.sshPort
+  ) {
+    writeLog("info", "Port changes need a restart to take effect");
+  }
+  if (
+    newConfig.port !== config.port || newConfig.quicPort !== config.quicPort
+  ) {
+    writeLog("info", "PORT and QUIC_PORT changes apply once rebind is run");
+  } else if (
+    JSON.stringify(newConfig.listeners) !== JSON.stringify(config.listeners)
+  ) {
+    writeLog("info", "LISTENERS changes apply once rebind is run");
+  }
+
+  config = { ...config, ...newConfig };
+  quietMode = config.quiet;
+  writeLog("info", `Reloaded config from ${configPath}`);
+}
+
+// Set from the commit being built in the Docker image
+export const version = Deno.env.get("ANCHOR_VERSION") ?? "dev";
+export const commit = Deno.env.get("ANCHOR_COMMIT") ?? "unknown";
+
+// The parts of @opentelemetry/api used here. It's only downloaded when
+// tracing is enabled, see loadTracer
+type Attributes = Record<string, string | number | boolean | undefined>;
+interface Span {
+  setAttribute(key: string, value: string | number | boolean): unknown;
+  end(): void;
+}
+interface Tracer {
+  startActiveSpan<T>(
+    name: string,
+    options: { attributes: Attributes },
+    fn: (span: Span) => T,
+  ): T;
+}
+
+// Set by loadTracer, without it traced runs fn with a span that does nothing
+let tracer: Tracer | undefined;
+const noopSpan: Span = { setAttribute() {}, end() {} };
+
+// Spans are exported by Deno's own tracer provider, registered with
+// OTEL_DENO=true
+async function loadTracer() {
+  if (Deno.env.get("OTEL_DENO") !== "true") {
+    return;
+  }
+  const { trace } = await import("npm:@opentelemetry/api@1.9.0");
+  tracer = trace.getTracer("anchor", version);
+}
+
+// Clients that never set a data.teamId are all on this team
+const defaultTeamId = "default";
+const maxTeamIdLength = 64;
+// Per room, enough to cover a client resending its outbox after reconnecting
+const maxTrackedEventIds = 1000;
+// Per client, past this the oldest unacknowledged packets are forgotten
+const maxUnackedPackets = 1000;
+// Per read from a client's connection, packets up to MAX_PACKET_SIZE arrive
+// over several
+const readBufferSize = 64 * 1024;
+// Jump ahead of state broadcasts waiting on a backed up connection, in the
+// order they were sent among themselves
+const urgentPacketTypes = [
+  "SERVER_MESSAGE",
+  "DISABLE_ANCHOR",
+  "HEARTBEAT",
+  "PING",
+  "PONG",
+];
+// Set by systemd for Type=notify units, and when WatchdogSec is configured
+const notifySocket = Deno.env.get("NOTIFY_SOCKET");
+const watchdogMicroseconds = parseInt(Deno.env.get("WATCHDOG_USEC") ?? "", 10);
+
+const dayMs = 1000 * 60 * 60 * 24;
+
+// How late a heartbeat loop may run before /healthz reports it as stalled
+const heartbeatGraceMs = 1000 * 30;
+const defaultMuteMinutes = 10;
+// Joins, leaves and team changes within this window share one ALL_CLIENT_DATA
+const allClientDataDebounceMs = 50;
+// How often memory and event loop lag are checked for load shedding
+const loadCheckIntervalMs = 1000;
+// Only the fastest completions are kept in stats.json
+const maxLeaderboardEntries = 100;
+const clusterActions = ["messageAll", "disableAll", "messageRoom"];
+// How often rooms are registered and members shared on Redis, instances not
+// heard from in three times this are forgotten
+const clusterIntervalMs = 1000 * 10;
+const migrationTimeoutMs = 1000 * 30;
+// Doubled after each failed accept, up to 32 times this
+const acceptRetryMs = 100;
+// Failed accepts in a row before the listener is closed and bound again
+const maxAcceptFailures = 5;
+// Past this, events are dropped rather than queued behind a failing endpoint
+const maxPendingWebhooks = 1000;
+// Longer room listing fields are cut off
+const maxRoomTitleLength = 64;
+const maxRoomDescriptionLength = 256;
+const maxRoomTags = 10;
+const maxRoomTagLength = 32;
+// Per saveStateKey, new flags past this are ignored
+const maxRoomFlags = 10000;
+
+// Before any stats file is loaded
+function emptyStats(): ServerStats {
+  return {
+    lastStatsHeartbeat: Date.now(),
+    clientSHAs: {},
+    onlineCount: 0,
+    gamesCompleted: 0,
+    leaderboard: [],
+    pid: Deno.pid,
+    lastClientId: 0,
+    clientUuids: {},
+    clientUuidLastSeen: {},
+  };
+}
+
+export class Server {
+  private listeners: Listener[] = [];
+  public clients: Client[] = [];
+  public rooms: Room[] = [];
+  public stats = emptyStats();
+  // Kept in memory only, counts since the server started
+  public packetStats: Record<string, PacketTypeStats> = {};
+  public udpConnection?: Deno.DatagramConn;
+  private statsd?: StatsdClient;
+  // Totals as of the last StatsD export, its counters send the change
+  private statsdTotals = {
+    received: 0,
+    sent: 0,
+    bytesReceived: 0,
+    bytesSent: 0,
+    throttled: 0,
+    gamesCompleted: 0,
+    byType: {} as Record<string, PacketTypeStats>,
+  };
+  // By udpToken
+  public udpClients = new Map<string, Client>();
+  // The clientId each signed in account last had
+  public accountClientIds = new Map<string, number>();
+  // Set once new connections and rooms are no longer accepted
+  public draining = false;
+  // Set once the listener has been handed over to a new process
+  private handingOver = false;
+  // Stops the server once the grace period after SIGTERM is over
+  private terminateTimer?: number;
+  public maintenance?: { endsAt: number; message: string; timers: number[] };
+  // Why new connections are being turned away, see loadHeartbeat
+  public shedding?: string;
+  // Closed by rebindListeners, so bound again right away
+  private rebinding = new Set<Listener>();
+  private shedCount = 0;
+  public startedAt = Date.now();
+  public plugins: Plugin[] = [];
+  // When each heartbeat loop last ran, for /healthz
+  public heartbeats: Record<string, { lastRun: number; intervalMs: number }> =
+    {};
+  private heartbeatTimers: Record<string, number> = {};
+  private httpServer?: Deno.HttpServer;
+  // Events are only sent once started, not for replays or restored rooms
+  private started = false;
+  private pendingWebhooks = 0;
+  private eventBus?: EventPublisher;
+  private clusterSubscribed = false;
+  // Set when REDIS_URL is, see cluster.ts
+  public cluster?: Cluster;
+  private registry?: ServiceRegistry;
+  private registered = false;
+  // Tells this process's cluster messages apart from other instances'
+  public readonly instanceId = crypto.randomUUID();
+  private stopping = false;
+  private resolveStopped!: () => void;
+  // Resolves once stop() has finished, e.g. after maintenance or a handover
+  public readonly stopped = new Promise<void>((resolve) => {
+    this.resolveStopped = resolve;
+  });
+
+  async start() {
+    await loadTracer().catch((error) => {
+      this.logError(`Error loading OpenTelemetry: ${error.message}`);
+    });
+    await this.loadPlugins();
+    await this.parseStats();
+    if (config.redisUrl) {
+      await this.joinCluster(config.redisUrl);
+    }
+    await this.restoreRooms();
+    this.started = true;
+    // Listens for other instances' admin actions before any event is sent
+    if (config.cluster && !config.eventBusUrl && !config.redisUrl) {
+      this.logError(
+        "Error enabling clustering: neither REDIS_URL nor EVENT_BUS_URL is set",
+      );
+    } else if (config.cluster && !config.clusterSecret) {
+      this.logError("Error enabling clustering: CLUSTER_SECRET isn't set");
+    }
+    try {
+      this.connectEventBus();
+    } catch (error) {
+      this.logError(`Error connecting to event bus: ${error.message}`);
+    }
+
+    this.statsHeartbeat();
+    this.statsBackupHeartbeat();
+    this.historyHeartbeat();
+    this.statsdHeartbeat();
+    if (notifySocket && watchdogMicroseconds) {
+      this.watchdogHeartbeat();
+    }
+    this.clientHeartbeat();
+    this.saveStateSnapshotHeartbeat();
+    this.pingHeartbeat();
+    this.clientDataSyncHeartbeat();
+    this.announcementHeartbeat();
+    this.cleanupHeartbeat();
+    this.loadHeartbeat();
+    if (this.cluster) {
+      this.clusterHeartbeat();
+    }
+
+    this.startHttpServer();
+    this.startServer();
+    this.startUdpServer();
+    await this.startQuicServer();
+    // Once listening, so launchers aren't sent here before it's ready
+    this.discoveryHeartbeat();
+  }
+
+  async parseStats() {
+    const path = await resolveSymlink(config.statsPath);
+    for (const candidate of [path, ...await listStatsBackups(path)]) {
+      try {
+        const statsString = await Deno.readTextFile(candidate);
+        this.stats = Object.assign(this.stats, JSON.parse(statsString));
+        this.stats.pid = Deno.pid;
+        this.log(`Loaded stats from ${candidate}`);
+        return;
+      } catch (error) {
+        if (!(error instanceof Deno.errors.NotFound)) {
+          this.logError(
+            `Error loading stats from ${candidate}: ${error.message}`,
+          );
+        }
+      }
+    }
+    this.log("No stats file found");
+  }
+
+  // Replaces the stats in memory, e.g. from a backup or a restored file, then
+  // saves them right away so the next save doesn't undo it
+  async reloadStats(path?: string) {
+    path ??= await resolveSymlink(config.statsPath);
+    const stats = JSON.parse(await Deno.readTextFile(path));
+    const { lastClientId } = this.stats;
+    // Nothing carries over from the current stats, unlike when starting up
+    this.stats = { ...emptyStats(), ...stats };
+    this.stats.pid = Deno.pid;
+    this.stats.onlineCount = this.clients.length;
+    // Ids already handed out this run must not be reused
+    this.stats.lastClientId = Math.max(this.stats.lastClientId, lastClientId);
+    await this.saveStats();
+    this.log(`Reloaded stats from ${path}`);
+  }
+
+  async loadPlugins() {
+    for (const path of config.plugins) {
+      const url = /^\w+:/.test(path) ? path : toFileUrl(resolve(path)).href;
+      const { default: plugin } = await import(url);
+      this.use(plugin);
+    }
+  }
+
+  use(plugin: Plugin) {
+    this.plugins.push(plugin);
+    this.log(`Loaded plugin ${plugin.name}`);
+  }
+
+  // A throwing plugin is logged rather than breaking the connection
+  runHook<T extends PluginHook>(
+    hook: T,
+    ...args: Parameters<NonNullable<Plugin[T]>>
+  ) {
+    return this.plugins.map((plugin) => {
+      const handler = plugin[hook] as
+        | ((...args: Parameters<NonNullable<Plugin[T]>>) => unknown)
+        | undefined;
+      try {
+        return handler?.apply(plugin, args);
+      } catch (error) {
+        this.logError(
+          `Error in ${hook} of plugin ${plugin.name}: ${error.message}`,
+        );
+      }
+    });
+  }
+
+  // Heartbeats reschedule themselves rather than using setInterval, so a run
+  // that hangs stops the loop and shows up in /healthz
+  private scheduleHeartbeat(loop: () => void, intervalMs: number) {
+    if (this.stopping) {
+      return;
+    }
+
+    this.heartbeats[loop.name] = { lastRun: Date.now(), intervalMs };
+    this.heartbeatTimers[loop.name] = setTimeout(() => {
+      loop.call(this);
+    }, intervalMs);
+  }
+
+  // Stalled heartbeat loops, or the listener if it stopped unexpectedly
+  healthProblems() {
+    const problems = Object.entries(this.heartbeats)
+      .filter(([, { lastRun, intervalMs }]) =>
+        Date.now() - lastRun > intervalMs + heartbeatGraceMs
+      )
+      .map(([name]) => `${name} stalled`);
+    if (!this.listeners.length && !this.draining) {
+      problems.push("Listener not accepting connections");
+    }
+    return problems;
+  }
+
+  async statsHeartbeat() {
+    try {
+      this.stats.lastStatsHeartbeat = Date.now();
+      this.stats.onlineCount = this.clients.length;
+
+      // The new process owns the stats file now
+      if (!this.handingOver) {
+        await this.saveStats();
+      }
+    } catch (error) {
+      this.logError(`Error saving stats: ${error.message}`);
+    }
+
+    this.scheduleHeartbeat(this.statsHeartbeat, config.statsIntervalMs || 2500);
+  }
+
+  // Only pets the watchdog while healthy, so systemd restarts a wedged server
+  async watchdogHeartbeat() {
+    const problems = this.healthProblems();
+    if (problems.length) {
+      this.log(`Skipping watchdog ping: ${problems.join(", ")}`);
+    } else {
+      await sdNotify("WATCHDOG=1");
+    }
+
+    this.scheduleHeartbeat(this.watchdogHeartbeat, watchdogMicroseconds / 2000);
+  }
+
+  async clientHeartbeat() {
+    try {
+      if (config.heartbeatIntervalSeconds) {
+        await Promise.all(this.clients.map((client) => {
+          return client.sendPacket({
+            type: "HEARTBEAT",
+          }).catch((_) => {}); // Ignore errors, client will disconnect if it's a problem
+        }));
+      }
+    } catch (error) {
+      this.logError(`Error sending heartbeat to clients: ${error.message}`);
+    }
+
+    // Keep checking while disabled in case a config reload enables it
+    this.scheduleHeartbeat(
+      this.clientHeartbeat,
+      1000 * (config.heartbeatIntervalSeconds || 30),
+    );
+  }
+
+  saveStateSnapshotHeartbeat() {
+    try {
+      if (config.saveStateSnapshotMinutes) {
+        for (const room of this.rooms) {
+          room.requestSaveStateSnapshot();
+        }
+      }
+    } catch (error) {
+      this.logError(`Error requesting save state snapshots: ${error.message}`);
+    }
+
+    // Keep checking while disabled in case a config reload enables it
+    this.scheduleHeartbeat(
+      this.saveStateSnapshotHeartbeat,
+      1000 * 60 * (config.saveStateSnapshotMinutes || 1),
+    );
+  }
+
+  pingHeartbeat() {
+    try {
+      if (config.pingIntervalSeconds) {
+        for (const client of this.clients) {
+          client.ping();
+        }
+      }
+    } catch (error) {
+      this.logError(`Error pinging clients: ${error.message}`);
+    }
+
+    this.scheduleHeartbeat(
+      this.pingHeartbeat,
+      1000 * (config.pingIntervalSeconds || 30),
+    );
+  }
+
+  clientDataSyncHeartbeat() {
+    try {
+      if (config.clientDataSyncSeconds) {
+        for (const room of this.rooms) {
+          room.broadcastAllClientData({
+            online: true,
+            where: (client) => client.acceptsDeltas,
+          });
+        }
+      }
+    } catch (error) {
+      this.logError(`Error resyncing client data: ${error.message}`);
+    }
+
+    this.scheduleHeartbeat(
+      this.clientDataSyncHeartbeat,
+      1000 * (config.clientDataSyncSeconds || 60),
+    );
+  }
+
+  // Runs at the start of every minute, the resolution of announcement schedules
+  announcementHeartbeat() {
+    try {
+      const now = new Date();
+      for (const announcement of config.announcements) {
+        if (cronScheduleMatches(announcement.schedule, now)) {
+          this.log(`Announcing: ${announcement.message}`);
+          for (const client of this.clients) {
+            sendServerMessage(client, announcement.message);
+          }
+        }
+      }
+    } catch (error) {
+      this.logError(`Error sending announcements: ${error.message}`);
+    }
+
+    this.scheduleHeartbeat(
+      this.announcementHeartbeat,
+      1000 * 60 - Date.now() % (1000 * 60),
+    );
+  }
+
+  // Written to a temporary file first, so a crash mid-write can't corrupt it
+  async saveStats() {
+    const path = await resolveSymlink(config.statsPath);
+    const tempPath = `${path}.tmp`;
+    await Deno.writeTextFile(tempPath, JSON.stringify(this.stats, null, 4));
+    await Deno.rename(tempPath, path);
+  }
+
+  async statsBackupHeartbeat() {
+    try {
+      if (config.statsBackupMinutes && !this.handingOver) {
+        await this.backupStats();
+      }
+    } catch (error) {
+      // Nothing to back up until stats have been saved once
+      if (!(error instanceof Deno.errors.NotFound)) {
+        this.logError(`Error backing up stats: ${error.message}`);
+      }
+    }
+
+    // Keep checking while disabled in case a config reload enables it
+    this.scheduleHeartbeat(
+      this.statsBackupHeartbeat,
+      1000 * 60 * (config.statsBackupMinutes || 1),
+    );
+  }
+
+  async historyHeartbeat() {
+    try {
+      if (config.historySampleMinutes && !this.handingOver) {
+        const activeRooms = this.rooms.filter((room) => room.clients.length);
+        const sample = [
+          Date.now(),
+          this.clients.length,
+          activeRooms.length,
+          this.stats.gamesCompleted,
+        ];
+        await Deno.writeTextFile(config.historyPath, sample.join(",") + "\n", {
+          append: true,
+        });
+      }
+    } catch (error) {
+      this.logError(`Error recording history: ${error.message}`);
+    }
+
+    // Keep checking while disabled in case a config reload enables it
+    this.scheduleHeartbeat(
+      this.historyHeartbeat,
+      1000 * 60 * (config.historySampleMinutes || 1),
+    );
+  }
+
+  async statsdHeartbeat() {
+    try {
+      if (config.statsdAddress) {
+        await this.exportStatsd(config.statsdAddress);
+      } else if (this.statsd) {
+        this.statsd.close();
+        this.statsd = undefined;
+      }
+    } catch (error) {
+      this.logError(`Error exporting to StatsD: ${error.message}`);
+    }
+
+    // Keep checking while disabled in case a config reload enables it
+    this.scheduleHeartbeat(
+      this.statsdHeartbeat,
+      1000 * (config.statsdIntervalSeconds || 10),
+    );
+  }
+
+  async exportStatsd(address: string) {
+    const totals = {
+      received: 0,
+      sent: 0,
+      bytesReceived: 0,
+      bytesSent: 0,
+      throttled: 0,
+      gamesCompleted: this.stats.gamesCompleted,
+      byType: structuredClone(this.packetStats),
+    };
+    for (const stats of Object.values(this.packetStats)) {
+      totals.received += stats.received;
+      totals.sent += stats.sent;
+      totals.bytesReceived += stats.bytesReceived;
+      totals.bytesSent += stats.bytesSent;
+      totals.throttled += stats.throttled;
+    }
+    // gamesCompleted is kept across restarts, so start counting from now
+    if (this.statsd?.target !== address) {
+      this.statsd?.close();
+      this.statsd = new StatsdClient(address);
+      this.statsdTotals = totals;
+    }
+    const { statsd } = this;
+    statsd.prefix = config.statsdPrefix;
+    const last = this.statsdTotals;
+    this.statsdTotals = totals;
+
+    statsd.gauge("clients", this.clients.length);
+    statsd.gauge("rooms", this.rooms.length);
+    statsd.gauge(
+      "rooms.active",
+      this.rooms.filter((room) => room.clients.length).length,
+    );
+    statsd.count("packets.received", totals.received - last.received);
+    statsd.count("packets.sent", totals.sent - last.sent);
+    statsd.count("bytes.received", totals.bytesReceived - last.bytesReceived);
+    statsd.count("bytes.sent", totals.bytesSent - last.bytesSent);
+    statsd.count("packets.throttled", totals.throttled - last.throttled);
+    for (const [type, stats] of Object.entries(totals.byType)) {
+      const previous = last.byType[type];
+      statsd.count(
+        `packets.${type}.received`,
+        stats.received - (previous?.received ?? 0),
+      );
+      statsd.count(`packets.${type}.sent`, stats.sent - (previous?.sent ?? 0));
+      statsd.count(
+        `bytes.${type}.received`,
+        stats.bytesReceived - (previous?.bytesReceived ?? 0),
+      );
+      statsd.count(
+        `bytes.${type}.sent`,
+        stats.bytesSent - (previous?.bytesSent ?? 0),
+      );
+    }
+    statsd.gauge(
+      "clients.throttled",
+      this.clients.filter((client) => client.throttled).length,
+    );
+    statsd.count(
+      "games.completed",
+      totals.gamesCompleted - last.gamesCompleted,
+    );
+    await statsd.flush();
+  }
+
+  async cleanupHeartbeat() {
+    try {
+      if (!this.handingOver) {
+        await this.cleanup();
+      }
+    } catch (error) {
+      this.logError(`Error cleaning up old data: ${error.message}`);
+    }
+
+    this.scheduleHeartbeat(
+      this.cleanupHeartbeat,
+      1000 * 60 * 60 * (config.cleanupIntervalHours || 24),
+    );
+  }
+
+  // A busy event loop runs timers late, so this one's lateness is how far
+  // behind every client's packets are
+  loadHeartbeat() {
+    const lastRun = this.heartbeats.loadHeartbeat?.lastRun;
+    const lagMs = lastRun === undefined
+      ? 0
+      : Math.max(Date.now() - lastRun - loadCheckIntervalMs, 0);
+    const memoryMb = Math.round(Deno.memoryUsage().rss / (1024 * 1024));
+    const shedding = config.shedMemoryMb && memoryMb > config.shedMemoryMb
+      ? `using ${memoryMb}MB of memory`
+      : config.shedEventLoopLagMs && lagMs > config.shedEventLoopLagMs
+      ? `event loop ${lagMs}ms behind`
+      : undefined;
+
+    if (shedding && !this.shedding) {
+      this.log(`Turning away new connections, ${shedding}`);
+    } else if (!shedding && this.shedding) {
+      this.log(
+        `No longer turning away new connections, ${this.shedCount} turned away`,
+      );
+      this.shedCount = 0;
+    }
+    this.shedding = shedding;
+
+    this.scheduleHeartbeat(this.loadHeartbeat, loadCheckIntervalMs);
+  }
+
+  // Keeps this instance's rooms registered and their members known to the
+  // other instances, and forgets members of instances that went quiet
+  clusterHeartbeat() {
+    try {
+      for (const room of this.rooms) {
+        this.cluster?.report(room.id, room.clients.length).catch((error) => {
+          room.logError(`Error reporting room to Redis: ${error.message}`);
+        });
+        room.shareMembers();
+        room.pruneRemoteMembers(3 * clusterIntervalMs);
+      }
+    } catch (error) {
+      this.logError(`Error sharing rooms: ${error.message}`);
+    }
+
+    this.scheduleHeartbeat(this.clusterHeartbeat, clusterIntervalMs);
+  }
+
+  // Registers again each time, keeping the client count current and stopping
+  // registries that expire old entries from dropping this server
+  async discoveryHeartbeat() {
+    try {
+      if (!this.draining) {
+        await this.register();
+      }
+    } catch (error) {
+      this.logError(`Error registering for discovery: ${error.message}`);
+    }
+
+    this.scheduleHeartbeat(
+      this.discoveryHeartbeat,
+      1000 * (config.discoveryIntervalSeconds || 30),
+    );
+  }
+
+  private async register() {
+    const { discoveryUrl, discoveryAddress } = config;
+    if (this.registry?.url !== discoveryUrl) {
+      await this.deregister();
+      this.registry = discoveryUrl
+        ? createServiceRegistry(discoveryUrl)
+        : undefined;
+    }
+    if (!this.registry) {
+      return;
+    }
+    if (!discoveryAddress) {
+      throw new Error("DISCOVERY_ADDRESS isn't set");
+    }
+
+    const [, address, port] = discoveryAddress.match(/^(.+?)(?::(\d+))?$/)!;
+    // Set first, so stopping while this is in flight still deregisters
+    const first = !this.registered;
+    this.registered = true;
+    try {
+      await this.registry.register({
+        id: this.instanceId,
+        address,
+        port: port ? parseInt(port, 10) : config.port,
+        region: config.region,
+        clients: this.clients.length,
+        maxClients: config.maxConnections,
+        version,
+        healthUrl: config.httpPort
+          ? `http://${address}:${config.httpPort}/readyz`
+          : undefined,
+      });
+    } catch (error) {
+      if (first) {
+        this.registered = false;
+      }
+      throw error;
+    }
+    if (first) {
+      this.log(`Registered for discovery with ${redact(this.registry.url)}`);
+    }
+  }
+
+  // Before draining or stopping, so launchers stop sending players here
+  async deregister() {
+    if (!this.registry || !this.registered) {
+      return;
+    }
+
+    this.registered = false;
+    try {
+      await this.registry.deregister(this.instanceId);
+      this.log(`Deregistered from ${redact(this.registry.url)}`);
+    } catch (error) {
+      this.logError(`Error deregistering from discovery: ${error.message}`);
+    }
+  }
+
+  // Deletes archived rooms, event logs, recordings and install UUIDs past
+  // their retention period. Returns what was deleted
+  async cleanup() {
+    const deleted: string[] = [];
+    const directories = [
+      [config.roomArchiveDir, ".json", config.archiveRetentionDays],
+      [config.eventLogDir, ".jsonl", config.eventLogRetentionDays],
+      [config.recordingsDir, ".jsonl", config.recordingRetentionDays],
+    ] as const;
+    for (const [dir, extension, days] of directories) {
+      if (!dir || !days) {
+        continue;
+      }
+      for (const path of await listFiles(dir, extension)) {
+        const { mtime } = await Deno.stat(path);
+        if (mtime && Date.now() - mtime.getTime() > days * dayMs) {
+          await Deno.remove(path);
+          deleted.push(path);
+        }
+      }
+    }
+
+    if (config.clientRetentionDays) {
+      const { clientUuids, clientUuidLastSeen } = this.stats;
+      let expired = 0;
+      for (const clientUuid of Object.keys(clientUuids)) {
+        // Installs from before last seen times were kept start counting now
+        const lastSeen = clientUuidLastSeen[clientUuid] ??= Date.now();
+        if (Date.now() - lastSeen > config.clientRetentionDays * dayMs) {
+          delete clientUuids[clientUuid];
+          delete clientUuidLastSeen[clientUuid];
+          expired++;
+        }
+      }
+      if (expired) {
+        deleted.push(`${expired} install UUIDs`);
+        await this.saveStats();
+      }
+    }
+
+    if (deleted.length) {
+      this.log(`Deleted old data: ${deleted.join(", ")}`);
+    }
+    return deleted;
+  }
+
+  async backupStats() {
+    const path = await resolveSymlink(config.statsPath);
+    const timestamp = new Date().toISOString().replace(/[:.]/g, "-");
+    await Deno.copyFile(path, `${path}.${timestamp}.bak`);
+
+    const backups = await listStatsBackups(path);
+    for (const backup of backups.slice(config.statsBackups)) {
+      await Deno.remove(backup);
+    }
+  }
+
+  // Everything useful for debugging a hung server, written on SIGUSR1
+  async dumpState() {
+    const timestamp = new Date().toISOString().replace(/[:.]/g, "-");
+    const path = `${config.dumpsDir}/dump-${timestamp}.json`;
+    const dump = {
+      takenAt: Date.now(),
+      pid: Deno.pid,
+      version,
+      uptimeSeconds: Math.floor((Date.now() - this.startedAt) / 1000),
+      memory: Deno.memoryUsage(),
+      // Deno can't show stacks of pending async work, but a stalled loop shows
+      // up as a stale lastRun here
+      heartbeats: this.heartbeats,
+      listeners: this.listeners.length,
+      draining: this.draining,
+      shedding: this.shedding,
+      maintenance: this.maintenance &&
+        { endsAt: this.maintenance.endsAt, message: this.maintenance.message },
+      rooms: this.rooms.map((room) => room.summary()),
+      clients: this.clients.map((client) => client.summary()),
+    };
+
+    await Deno.mkdir(config.dumpsDir, { recursive: true });
+    await Deno.writeTextFile(path, JSON.stringify(dump, null, 2));
+    this.log(`Dumped state to ${path}`);
+  }
+
+  // Binds every listener before returning, so start() fails if a port is
+  // taken
+  startServer() {
+    const { listeners } = config;
+    const bound = listeners.map((address) => bindListener(address));
+
+    this.log(
+      `Server Started on ${listeners.map(formatListenAddress).join(", ")}`,
+    );
+    sdNotify("READY=1");
+    bound.forEach((listener, i) => {
+      this.serve(listener, async () => {
+        // The same entry after a config reload, so rebinding applies changes
+        const address = config.listeners[i];
+        if (!address) {
+          this.log(`${formatListenAddress(listeners[i])} no longer listed`);
+          return;
+        }
+        const listener = bindListener(address);
+        this.log(`Listening on ${formatListenAddress(address)} again`);
+        return listener;
+      });
+    });
+  }
+
+  startUdpServer() {
+    if (!config.udpPort) {
+      return;
+    }
+
+    try {
+      this.udpConnection = Deno.listenDatagram({
+        transport: "udp",
+        hostname: config.listenHostname,
+        port: config.udpPort,
+      });
+      this.log(`UDP listening on port ${config.udpPort}`);
+      this.serveUdp(this.udpConnection);
+    } catch (error) {
+      this.logError(`Error starting UDP listener: ${error.message}`);
+    }
+  }
+
+  async serveUdp(connection: Deno.DatagramConn) {
+    try {
+      for await (const [data, address] of connection) {
+        this.handleDatagram(data, address as Deno.NetAddr);
+      }
+    } catch (error) {
+      if (!this.stopping) {
+        this.logError(`Error receiving datagram: ${error.message}`);
+      }
+    }
+  }
+
+  // Each datagram is a single packet, the null terminator is optional. Anything
+  // malformed or without a known token is dropped silently, like lost packets
+  handleDatagram(data: Uint8Array, address: Deno.NetAddr) {
+    let packetObject;
+    try {
+      const delimiterIndex = findDelimiterIndex(data);
+      packetObject = decodePacket(
+        delimiterIndex === -1 ? data : data.subarray(0, delimiterIndex),
+      );
+    } catch (_) {
+      return;
+    }
+
+    const client = this.udpClients.get(packetObject.udpToken ?? "");
+    client?.handleDatagram(packetObject, address, data.length);
+  }
+
+  async startQuicServer() {
+    if (!config.quicPort) {
+      return;
+    }
+
+    // Rereads the certificate too, so rebinding picks up a renewed one
+    const bind = async () =>
+      listenQuic({
+        hostname: config.listenHostname,
+        port: config.quicPort,
+        cert: await Deno.readTextFile(config.quicCertPath),
+        key: await Deno.readTextFile(config.quicKeyPath),
+      });
+    try {
+      const listener = await bind();
+      this.log(`QUIC listening on port ${config.quicPort}`);
+      this.serve(listener, async () => {
+        if (!config.quicPort) {
+          this.log("QUIC_PORT unset, QUIC listener stopped");
+          return;
+        }
+        const listener = await bind();
+        this.log(`QUIC listening on port ${config.quicPort} again`);
+        return listener;
+      });
+    } catch (error) {
+      this.logError(`Error starting QUIC listener: ${error.message}`);
+    }
+  }
+
+  // Accepts clients from any transport until the server drains. Failed
+  // accepts are retried with backoff, and a listener that closes or keeps
+  // failing is replaced with one from rebind, if given
+  async serve(
+    listener: Listener,
+    rebind?: () => Promise<Listener | undefined>,
+  ) {
+    this.listeners.push(listener);
+    let failures = 0;
+    while (!this.draining) {
+      try {
+        for await (const connection of listener) {
+          failures = 0;
+          this.acceptConnection(connection);
+        }
+        if (this.draining || !rebind) {
+          break;
+        }
+        if (this.rebinding.delete(listener)) {
+          this.log("Listener closed, rebinding");
+        } else {
+          // Backed off like errors, in case it closes again straight away
+          const delayMs = acceptRetryDelayMs(++failures);
+          this.log(`Listener closed unexpectedly, rebinding in ${delayMs}ms`);
+          await new Promise((resolve) => setTimeout(resolve, delayMs));
+        }
+      } catch (error) {
+        if (this.draining) {
+          break;
+        }
+        const delayMs = acceptRetryDelayMs(++failures);
+        this.logError(
+          `Error accepting connection, retrying in ${delayMs}ms: ${error.message}`,
+        );
+        await new Promise((resolve) => setTimeout(resolve, delayMs));
+        if (failures < maxAcceptFailures || !rebind) {
+          continue;
+        }
+        this.log(`${failures} accept errors in a row, rebinding`);
+        try {
+          listener.close();
+        } catch (_) {
+          // Already closed
+        }
+      }
+
+      // Out of the list meanwhile, so /healthz reports it if binding fails
+      this.listeners = this.listeners.filter((l) => l !== listener);
+      const replacement = await this.rebindListener(rebind);
+      if (!replacement) {
+        return;
+      }
+      listener = replacement;
+      this.listeners.push(listener);
+    }
+    this.listeners = this.listeners.filter((l) => l !== listener);
+  }
+
+  // Retries with backoff until it binds, or the server drains. Undefined if
+  // rebind no longer wants a listener
+  private async rebindListener(
+    rebind: () => Promise<Listener | undefined>,
+  ) {
+    for (let attempt = 0; !this.draining; attempt++) {
+      try {
+        const listener = await rebind();
+        if (this.draining) {
+          listener?.close();
+          return;
+        }
+        return listener;
+      } catch (error) {
+        const delayMs = acceptRetryDelayMs(attempt + 1);
+        this.logError(
+          `Error rebinding listener, retrying in ${delayMs}ms: ${error.message}`,
+        );
+        await new Promise((resolve) => setTimeout(resolve, delayMs));
+      }
+    }
+  }
+
+  // Closes every listener, which serve replaces with a freshly bound one on
+  // the configured port. Picks up PORT and QUIC_PORT changes, and recovers a
+  // listener that's stopped accepting without failing outright
+  rebindListeners() {
+    if (this.draining) {
+      throw new Error("Draining, listeners aren't rebound");
+    }
+    this.listeners.forEach((listener) => this.rebinding.add(listener));
+    this.closeListeners();
+  }
+
+  private acceptConnection(connection: Connection) {
+    if (this.shedding) {
+      this.shedCount++;
+      this.turnAway(connection);
+      return;
+    }
+    if (
+      config.maxConnections && this.clients.length >= config.maxConnections
+    ) {
+      this.log(
+        `At MAX_CONNECTIONS (${config.maxConnections}), turning away connection`,
+      );
+      this.turnAway(connection);
+      return;
+    }
+
+    try {
+      traced("acceptConnection", {}, (span) => {
+        applyTcpOptions(connection);
+        const client = new Client(connection, this, this.nextClientId());
+        this.clients.push(client);
+        span.setAttribute("anchor.client.id", client.id);
+      });
+    } catch (error) {
+      this.logError(`Error connecting client: ${error.message}`);
+    }
+  }
+
+  // Tells a new connection the server is full without making it a Client, so
+  // it costs next to nothing while the server is struggling
+  private turnAway(connection: Connection) {
+    connection.write(encodePacket({
+      type: "SERVER_MESSAGE",
+      message: "Server full, try again later",
+    }))
+      .catch(() => {})
+      .finally(() => {
+        try {
+          connection.close();
+        } catch (_) {
+          // Already closed by the client
+        }
+      });
+  }
+
+  // Server activity for community sites and analytics, posted to each of
+  // WEBHOOK_URLS and published to EVENT_BUS_URL
+  emitEvent(event: ServerEventType, fields: Record<string, unknown> = {}) {
+    if (!this.started) {
+      return;
+    }
+
+    const body = JSON.stringify({
+      event,
+      timestamp: new Date().toISOString(),
+      ...fields,
+    });
+    this.publishEvent(event, body);
+    if (!config.webhookEvents.includes(event)) {
+      return;
+    }
+
+    for (const url of config.webhookUrls) {
+      if (this.pendingWebhooks >= maxPendingWebhooks) {
+        this.logError(
+          `Error posting ${event} webhook to ${url}: too many pending`,
+        );
+        continue;
+      }
+
+      this.pendingWebhooks++;
+      postWebhook(url, body, config.webhookSecret, config.webhookRetries)
+        .catch((error) => {
+          this.logError(
+            `Error posting ${event} webhook to ${url}: ${error.message}`,
+          );
+        })
+        .finally(() => this.pendingWebhooks--);
+    }
+  }
+
+  private publishEvent(event: ServerEventType | "cluster", body: string) {
+    try {
+      this.connectEventBus()?.publish(event, body);
+    } catch (error) {
+      this.logError(`Error publishing ${event}: ${error.message}`);
+    }
+  }
+
+  // Connects on first use, and again if the bus changes on reload
+  private connectEventBus() {
+    const { eventBusUrl, eventBusTopic } = config;
+    if (
+      this.eventBus?.url !== eventBusUrl ||
+      this.eventBus?.topic !== eventBusTopic
+    ) {
+      this.eventBus?.close();
+      this.eventBus = undefined;
+      this.clusterSubscribed = false;
+    }
+    if (!eventBusUrl) {
+      return;
+    }
+
+    this.eventBus ??= createEventPublisher(eventBusUrl, eventBusTopic);
+    // Admin actions go through Redis instead when there's one
+    if (config.cluster && !this.cluster && !this.clusterSubscribed) {
+      if (this.eventBus.subscribe) {
+        this.eventBus.subscribe(
+          "cluster",
+          (body) => this.handleClusterMessage(body),
+        );
+        this.clusterSubscribed = true;
+      } else {
+        this.logError("Error enabling clustering: it needs a NATS event bus");
+      }
+    }
+    return this.eventBus;
+  }
+
+  // Runs here and, when clustered, on every other instance too
+  runClusterAction(action: ClusterAction) {
+    this.applyClusterAction(action);
+    const { clusterSecret } = config;
+    if (!config.cluster || !clusterSecret) {
+      return;
+    }
+
+    // Signed, as anything else able to publish there could send actions too
+    const body = JSON.stringify({ instanceId: this.instanceId, ...action });
+    sign(clusterSecret, body).then((signature) => {
+      const message = JSON.stringify({ body, signature });
+      if (this.cluster) {
+        this.cluster.publishAction(message);
+      } else {
+        this.publishEvent("cluster", message);
+      }
+    }).catch((error) => {
+      this.logError(`Error signing cluster message: ${error.message}`);
+    });
+  }
+
+  // Before restoring rooms, so they're shared, and before clients connect, so
+  // their ids are unique across the cluster
+  private async joinCluster(url: string) {
+    this.cluster = new Cluster(url, config.redisPrefix, this.instanceId);
+    try {
+      await this.cluster.reserveClientIds();
+    } catch (error) {
+      this.logError(`Error reserving clientIds on Redis: ${error.message}`);
+    }
+    if (config.cluster) {
+      this.cluster.subscribeActions((body) => this.handleClusterMessage(body));
+    }
+  }
+
+  private async handleClusterMessage(message: string) {
+    try {
+      const { clusterSecret } = config;
+      if (!config.cluster || !clusterSecret) {
+        return;
+      }
+      const { body, signature } = JSON.parse(message);
+      const expected = encoder.encode(await sign(clusterSecret, String(body)));
+      const actual = encoder.encode(String(signature));
+      if (
+        expected.length !== actual.length || !timingSafeEqual(expected, actual)
+      ) {
+        throw new Error("invalid signature");
+      }
+
+      const { instanceId, ...action } = JSON.parse(body);
+      // Messages this instance published come back to it too
+      if (instanceId === this.instanceId) {
+        return;
+      }
+      if (
+        !clusterActions.includes(action.action) ||
+        typeof action.message !== "string"
+      ) {
+        throw new Error(`invalid action ${JSON.stringify(action.action)}`);
+      }
+
+      this.log(`Running ${action.action} from instance ${instanceId}`);
+      this.applyClusterAction(action);
+    } catch (error) {
+      this.logError(`Error handling cluster message: ${error.message}`);
+    }
+  }
+
+  private applyClusterAction(action: ClusterAction) {
+    switch (action.action) {
+      case "messageAll":
+        for (const client of this.clients) {
+          sendServerMessage(client, action.message);
+        }
+        break;
+      case "disableAll":
+        for (const client of this.clients) {
+          sendDisable(client, action.message);
+        }
+        break;
+      case "messageRoom": {
+        const room = this.rooms.find((room) => room.id === action.roomId);
+        for (const client of room?.clients ?? []) {
+          if (client.connected) {
+            sendServerMessage(client, action.message);
+          }
+        }
+        break;
+      }
+    }
+  }
+
+  info(): ServerInfo {
+    return {
+      version,
+      commit,
+      runtime: `deno ${Deno.version.deno}`,
+      startedAt: this.startedAt,
+    };
+  }
+
+  // From the blocks reserved on Redis when clustered, so no other instance
+  // hands out the same id
+  nextClientId() {
+    const clusterId = this.cluster?.nextClientId();
+    if (clusterId !== undefined) {
+      this.stats.lastClientId = Math.max(this.stats.lastClientId, clusterId);
+      return clusterId;
+    }
+    if (this.cluster) {
+      this.log("No clientIds reserved on Redis, the next may clash");
+    }
+    return ++this.stats.lastClientId;
+  }
+
+  startHttpServer() {
+    if (!config.httpPort) {
+      return;
+    }
+
+    this.httpServer = Deno.serve({
+      hostname: config.listenHostname,
+      port: config.httpPort,
+      onListen: () => {
+        this.log(`HTTP Server Started on port ${config.httpPort}`);
+      },
+    }, (request) => this.handleHttpRequest(request));
+  }
+
+  // Read only, apart from rooms migrated here by other instances
+  handleHttpRequest(request: Request) {
+    const { pathname } = new URL(request.url);
+    if (request.method === "POST" && pathname === "/rooms") {
+      return this.receiveRoom(request);
+    }
+
+    if (request.method !== "GET") {
+      return new Response("Method Not Allowed", { status: 405 });
+    }
+
+    if (pathname === "/healthz") {
+      const problems = this.healthProblems();
+      return Response.json(
+        { healthy: !problems.length, problems },
+        { status: problems.length ? 503 : 200 },
+      );
+    }
+
+    // Whether new players should be sent here
+    if (pathname === "/readyz") {
+      const ready = this.listeners.length > 0 && !this.draining &&
+        !this.maintenance && !this.shedding;
+      return Response.json({ ready }, { status: ready ? 200 : 503 });
+    }
+
+    if (pathname === "/status") {
+      return Response.json({
+        onlineCount: this.clients.length,
+        roomCount: this.rooms.filter((room) => room.clients.length).length,
+        uptimeSeconds: Math.floor((Date.now() - this.startedAt) / 1000),
+        version,
+        commit,
+        packetStats: this.packetStats,
+      });
+    }
+
+    // So launchers and dashboards can tell what this server has turned on
+    if (pathname === "/features") {
+      return Response.json(config.features);
+    }
+
+    if (pathname === "/leaderboard" && config.publicLeaderboard) {
+      return Response.json(this.stats.leaderboard);
+    }
+
+    return new Response("Not Found", { status: 404 });
+  }
+
+  // Sent by migrateRoom on another instance
+  private async receiveRoom(request: Request) {
+    const expected = encoder.encode(`Bearer ${config.migrationSecret}`);
+    const actual = encoder.encode(request.headers.get("Authorization") ?? "");
+    if (
+      !config.migrationSecret || expected.length !== actual.length ||
+      !timingSafeEqual(expected, actual)
+    ) {
+      return new Response("Unauthorized", { status: 401 });
+    }
+    if (this.draining) {
+      return new Response("Draining", { status: 503 });
+    }
+
+    let migration: RoomMigration;
+    try {
+      migration = await request.json();
+    } catch (_) {
+      return new Response("Invalid JSON", { status: 400 });
+    }
+    const { snapshot, clientUuids, accountClientIds } = migration;
+    if (typeof snapshot?.id !== "string") {
+      return new Response("Invalid room", { status: 400 });
+    }
+    if (this.rooms.some((room) => room.id === snapshot.id)) {
+      return new Response("Room already exists", { status: 409 });
+    }
+
+    // Members this instance already knows by their install or account keep
+    // the id they have here, and ids someone else has here are replaced, so
+    // the room's members are still told apart
+    const remap = new Map<number, number>();
+    const migratedUuids = Object.entries(clientUuids ?? {});
+    const migratedAccounts = Object.entries(accountClientIds ?? {});
+    for (const [clientUuid, id] of migratedUuids) {
+      const localId = this.stats.clientUuids[clientUuid];
+      if (localId !== undefined) {
+        remap.set(id, localId);
+      }
+    }
+    for (const [accountId, id] of migratedAccounts) {
+      const localId = this.accountClientIds.get(accountId);
+      if (localId !== undefined && !remap.has(id)) {
+        remap.set(id, localId);
+      }
+    }
+    const taken = new Set([
+      ...this.clients.map((client) => client.id),
+      ...Object.values(this.stats.clientUuids),
+      ...this.accountClientIds.values(),
+      ...this.rooms.flatMap((room) => [...room.memberIds]),
+    ]);
+    // New ids can't clash with the migrated ones either
+    this.stats.lastClientId = Math.max(
+      this.stats.lastClientId,
+      ...snapshot.memberIds ?? [],
+    );
+    for (const id of snapshot.memberIds ?? []) {
+      if (taken.has(id) && !remap.has(id)) {
+        remap.set(id, this.nextClientId());
+      }
+    }
+    if (remap.size) {
+      remapSnapshot(snapshot, remap);
+      this.log(`Gave ${remap.size} clients of room ${snapshot.id} new ids`);
+    }
+
+    this.getOrCreateRoom(snapshot.id, snapshot).restore(snapshot);
+    // So its clients get their clientIds back when they reconnect
+    for (const [clientUuid, id] of migratedUuids) {
+      if (this.stats.clientUuids[clientUuid] === undefined) {
+        this.stats.clientUuids[clientUuid] = remap.get(id) ?? id;
+        this.stats.clientUuidLastSeen[clientUuid] = Date.now();
+      }
+    }
+    for (const [accountId, id] of migratedAccounts) {
+      if (!this.accountClientIds.has(accountId)) {
+        this.accountClientIds.set(accountId, remap.get(id) ?? id);
+      }
+    }
+
+    this.log(`Received room ${snapshot.id} from another instance`);
+    return new Response(null, { status: 204 });
+  }
+
+  // Moves a room to another instance without ending its sessions. Its
+  // snapshot is posted to url, the other instance's HTTP server, then its
+  // clients are sent a REDIRECT to host and port there
+  async migrateRoom(room: Room, host: string, port: number, url: string) {
+    if (!config.migrationSecret) {
+      throw new Error("MIGRATION_SECRET isn't set");
+    }
+    if (room.migrating) {
+      throw new Error(`Room ${room.id} is already migrating`);
+    }
+
+    // Packets arriving from now on would be missing from the snapshot, so
+    // they're dropped. Clients resend their outbox after reconnecting
+    room.migrating = true;
+    try {
+      const snapshot = room.toSnapshot();
+      const ids = new Set(snapshot.memberIds);
+      const migration: RoomMigration = {
+        snapshot,
+        clientUuids: Object.fromEntries(
+          Object.entries(this.stats.clientUuids).filter(([, id]) =>
+            ids.has(id)
+          ),
+        ),
+        accountClientIds: Object.fromEntries(
+          [...this.accountClientIds].filter(([, id]) => ids.has(id)),
+        ),
+      };
+      const response = await fetch(new URL("/rooms", url), {
+        method: "POST",
+        headers: {
+          "Authorization": `Bearer ${config.migrationSecret}`,
+          "Content-Type": "application/json",
+        },
+        body: JSON.stringify(migration),
+        signal: AbortSignal.timeout(migrationTimeoutMs),
+      });
+      if (!response.ok) {
+        throw new Error(
+          `${url} answered ${response.status} ${await response.text()}`,
+        );
+      }
+    } catch (error) {
+      room.migrating = false;
+      throw error;
+    }
+
+    await Promise.all(room.clients.map((client) =>
+      client.sendPacket({ type: "REDIRECT", roomId: room.id, host, port })
+        .catch(() => {})
+        .finally(() => client.disconnect())
+    ));
+    this.removeRoom(room);
+    room.log(`Migrated to ${host}:${port}`);
+  }
+
+  recordCompletion(entry: LeaderboardEntry) {
+    const { leaderboard } = this.stats;
+    leaderboard.push(entry);
+    leaderboard.sort((a, b) => a.elapsedMs - b.elapsedMs);
+    leaderboard.splice(maxLeaderboardEntries);
+  }
+
+  async restoreRooms() {
+    let snapshots: RoomSnapshot[];
+    try {
+      const snapshotString = await Deno.readTextFile(config.roomSnapshotPath);
+      snapshots = JSON.parse(snapshotString);
+    } catch (_) {
+      return; // Nothing was handed over
+    }
+
+    for (const snapshot of snapshots) {
+      this.getOrCreateRoom(snapshot.id, snapshot).restore(snapshot);
+    }
+    this.log(
+      `Restored ${snapshots.length} rooms from ${config.roomSnapshotPath}`,
+    );
+
+    try {
+      await Deno.remove(config.roomSnapshotPath);
+    } catch (error) {
+      this.logError(`Error removing room snapshot: ${error.message}`);
+    }
+  }
+
+  archivePath(roomId: string) {
+    return `${config.roomArchiveDir}/${encodeURIComponent(roomId)}.json`;
+  }
+
+  async archiveRoom(room: Room) {
+    await Deno.mkdir(config.roomArchiveDir, { recursive: true });
+    await Deno.writeTextFile(
+      this.archivePath(room.id),
+      JSON.stringify(room.toSnapshot()),
+    );
+    room.log(`Archived to ${this.archivePath(room.id)}`);
+  }
+
+  async restoreArchivedRoom(roomId: string) {
+    if (this.rooms.some((room) => room.id === roomId)) {
+      throw new Error(`Room ${roomId} already exists`);
+    }
+
+    const snapshot: RoomSnapshot = JSON.parse(
+      await Deno.readTextFile(this.archivePath(roomId)),
+    );
+    this.getOrCreateRoom(snapshot.id, snapshot).restore(snapshot);
+  }
+
+  // Removes every trace of a client from memory and disk, for players asking
+  // for their data to be deleted. Returns where it was found
+  async purgeClient(clientId: number) {
+    const found: string[] = [];
+    for (const client of this.clients.filter((c) => c.id === clientId)) {
+      client.disconnect();
+      found.push("connection");
+    }
+    // Copied, a room can be removed once the client leaves it
+    for (const room of [...this.rooms]) {
+      if (room.purgeClient(clientId)) {
+        found.push(`room ${room.id}`);
+      }
+    }
+
+    for (const [accountId, id] of this.accountClientIds) {
+      if (id === clientId) {
+        this.accountClientIds.delete(accountId);
+        found.push(`account ${accountId}`);
+      }
+    }
+    if (purgeStats(this.stats, clientId)) {
+      found.push("install UUID");
+    }
+    await this.saveStats();
+    const statsPath = await resolveSymlink(config.statsPath);
+    for (const path of await listStatsBackups(statsPath)) {
+      const stats: ServerStats = JSON.parse(await Deno.readTextFile(path));
+      if (purgeStats(stats, clientId)) {
+        await Deno.writeTextFile(path, JSON.stringify(stats));
+        found.push(path);
+      }
+    }
+
+    for (const path of await listFiles(config.roomArchiveDir, ".json")) {
+      const snapshot: RoomSnapshot = JSON.parse(await Deno.readTextFile(path));
+      if (purgeSnapshot(snapshot, clientId)) {
+        await Deno.writeTextFile(path, JSON.stringify(snapshot));
+        found.push(path);
+      }
+    }
+
+    // Reopened by the next event, after the purge rather than during it
+    await Promise.all(this.rooms.map((room) => room.closeEventLog()));
+    // Written by JSON.stringify, so lines that don't mention the client come
+    // out the same
+    const logDirs = [config.recordingsDir, config.eventLogDir];
+    for (const dir of logDirs) {
+      for (const path of dir ? await listFiles(dir, ".jsonl") : []) {
+        const text = await Deno.readTextFile(path);
+        const purged = text.split("\n").filter(Boolean)
+          .map((line) => purgeRecord(JSON.parse(line), clientId))
+          .filter((record) => record !== null)
+          .map((record) => JSON.stringify(record) + "\n").join("");
+        if (purged !== text) {
+          await Deno.writeTextFile(path, purged);
+          found.push(path);
+        }
+      }
+    }
+
+    // SIGUSR1 dumps, see dumpState
+    for (const path of await listFiles(config.dumpsDir, ".json")) {
+      const dump = JSON.parse(await Deno.readTextFile(path));
+      if (purgeDump(dump, clientId)) {
+        await Deno.writeTextFile(path, JSON.stringify(dump, null, 2));
+        found.push(path);
+      }
+    }
+
+    this.log(`Purged client ${clientId}`);
+    return found;
+  }
+
+  // Stops accepting connections so a new process can bind the port. Existing
+  // sessions carry on, and the server stops once the last one leaves
+  async handover() {
+    await Deno.writeTextFile(
+      config.roomSnapshotPath,
+      JSON.stringify(this.rooms.map((room) => room.toSnapshot())),
+    );
+    this.log(
+      `Saved ${this.rooms.length} rooms to ${config.roomSnapshotPath}`,
+    );
+
+    this.handingOver = true;
+    this.drain();
+    this.stopOnceEmpty();
+  }
+
+  // For SIGTERM, e.g. from Kubernetes. Turns away new players, warns those
+  // still here and stops once they've left or SHUTDOWN_GRACE_SECONDS is up. A
+  // second call stops right away
+  terminate() {
+    if (this.terminateTimer !== undefined) {
+      this.log("Terminated again, stopping now");
+      this.stop("Server shutting down");
+      return;
+    }
+
+    const graceSeconds = config.shutdownGraceSeconds;
+    this.log(`Terminating, stopping within ${graceSeconds} seconds`);
+    this.terminateTimer = setTimeout(() => {
+      this.log("Grace period over, stopping");
+      this.stop("Server shutting down");
+    }, 1000 * graceSeconds);
+    this.drain();
+    for (const client of this.clients) {
+      sendServerMessage(
+        client,
+        `Server shutting down in ${graceSeconds} seconds, reconnect to carry on`,
+      );
+    }
+    this.stopOnceEmpty();
+  }
+
+  // Disconnects every client and stops the listeners and background loops,
+  // without exiting so the server can be embedded in another process
+  async stop(message = "Server restarting") {
+    if (this.stopping) {
+      return this.stopped;
+    }
+    this.stopping = true;
+    await sdNotify("STOPPING=1");
+
+    this.cancelMaintenance();
+    clearTimeout(this.terminateTimer);
+    if (!this.draining) {
+      this.draining = true;
+      this.closeListeners();
+    }
+    await this.deregister();
+    Object.values(this.heartbeatTimers).forEach((timer) => clearTimeout(timer));
+    await this.httpServer?.shutdown();
+
+    await Promise.all(
+      this.clients.map((client) =>
+        sendServerMessage(client, message)
+          .finally(() => {
+            client.disconnect();
+          })
+      ),
+    );
+    try {
+      this.udpConnection?.close();
+    } catch (error) {
+      this.logError(`Error closing UDP listener: ${error.message}`);
+    }
+    this.statsd?.close();
+    this.eventBus?.close();
+    // Other instances stop relaying to this one and listing its clients
+    if (this.cluster) {
+      await Promise.all(this.rooms.map((room) => room.leaveCluster()));
+      this.cluster.close();
+    }
+    // After disconnecting, as the last client leaving starts the retention timer
+    for (const room of this.rooms) {
+      clearTimeout(room.retentionTimer);
+      clearTimeout(room.allClientDataTimer);
+      room.clients.forEach((client) => clearTimeout(client.graceTimer));
+      room.forgetDeliveries();
+      room.stopRecording();
+      room.stopLog();
+    }
+    await Promise.all(this.rooms.map((room) => room.closeEventLog()));
+
+    try {
+      // The new process owns the stats file after a handover
+      if (!this.handingOver) {
+        await this.saveStats();
+      }
+    } catch (error) {
+      this.logError(`Error saving stats: ${error.message}`);
+    }
+
+    this.log("Stopped");
+    this.resolveStopped();
+  }
+
+  closeListeners() {
+    for (const listener of this.listeners) {
+      try {
+        listener.close();
+      } catch (error) {
+        this.logError(`Error closing listener: ${error.message}`);
+      }
+    }
+  }
+
+  // Lets existing sessions finish, but accepts no new connections or rooms
+  drain() {
+    if (this.draining) {
+      return;
+    }
+
+    this.draining = true;
+    this.closeListeners();
+    this.deregister();
+    this.log("Listener closed, draining");
+    this.drainProgress();
+  }
+
+  drainProgress() {
+    if (!this.clients.length) {
+      this.log("All clients gone, safe to stop");
+      return;
+    }
+
+    const activeRooms = this.rooms.filter((room) => room.clients.length);
+    this.log(
+      `Draining, ${this.clients.length} clients in ${activeRooms.length} rooms remaining`,
+    );
+    setTimeout(() => {
+      this.drainProgress();
+    }, 1000 * 30);
+  }
+
+  // Counts down to a graceful stop, turning away new room joins meanwhile
+  startMaintenance(minutes: number, message: string) {
+    this.cancelMaintenance();
+
+    const endsAt = Date.now() + 1000 * 60 * minutes;
+    const timers = [30, 15, 10, 5, 2, 1]
+      .filter((remaining) => remaining < minutes)
+      .map((remaining) =>
+        setTimeout(() => {
+          this.announceMaintenance(remaining);
+        }, endsAt - 1000 * 60 * remaining - Date.now())
+      );
+    timers.push(setTimeout(() => {
+      this.stop(message);
+    }, endsAt - Date.now()));
+
+    this.maintenance = { endsAt, message, timers };
+    this.announceMaintenance(minutes);
+  }
+
+  cancelMaintenance() {
+    if (!this.maintenance) {
+      return false;
+    }
+
+    this.maintenance.timers.forEach((timer) => clearTimeout(timer));
+    this.maintenance = undefined;
+    return true;
+  }
+
+  maintenanceNotice() {
+    if (!this.maintenance) {
+      return "";
+    }
+
+    const minutes = Math.ceil(
+      (this.maintenance.endsAt - Date.now()) / (1000 * 60),
+    );
+    return `Server going down for maintenance in ${minutes} minute${
+      minutes === 1 ? "" : "s"
+    }: ${this.maintenance.message}`;
+  }
+
+  announceMaintenance(minutes: number) {
+    this.log(`Maintenance in ${minutes} minutes`);
+    for (const client of this.clients) {
+      sendServerMessage(client, this.maintenanceNotice());
+    }
+  }
+
+  // After a handover or SIGTERM
+  stopOnceEmpty() {
+    if (this.clients.length || this.stopping) {
+      return;
+    }
+    if (this.handingOver) {
+      this.log("All clients left after handover, stopping");
+      this.stop();
+    } else if (this.terminateTimer !== undefined) {
+      this.log("All clients left, stopping");
+      this.stop("Server shutting down");
+    }
+  }
+
+  removeClient(client: Client) {
+    const index = this.clients.indexOf(client);
+    if (index !== -1) {
+      this.clients.splice(index, 1);
+    }
+    if (client.udpToken) {
+      this.udpClients.delete(client.udpToken);
+    }
+    this.stopOnceEmpty();
+  }
+
+  // shared is what another instance decided for the room, see claimSharedRoom
+  getOrCreateRoom(id: string, options: RoomOptions = {}, shared?: SharedRoom) {
+    const room = this.rooms.find((room) => room.id === id);
+    if (room) {
+      return room;
+    }
+
+    const newRoom = new Room(id, this, options);
+    if (shared) {
+      newRoom.adopt(shared);
+    }
+    this.rooms.push(newRoom);
+    this.cluster?.joinRoom(id, (message) => {
+      newRoom.handleClusterMessage(message);
+    });
+    this.emitEvent("roomCreated", { roomId: id, gameId: newRoom.gameId });
+    return newRoom;
+  }
+
+  // Why a room with these options can't be created, if it can't
+  newRoomError(options: RoomOptions = {}, creator: Client) {
+    const gameId = options.gameId ?? creator.data.gameId;
+    const hostedGames = Object.keys(config.games);
+    if (
+      hostedGames.length && typeof gameId === "string" &&
+      !hostedGames.includes(gameId)
+    ) {
+      return `This server doesn't host ${gameId} rooms, only ${
+        hostedGames.join(", ")
+      }`;
+    }
+  }
+
+  // Rooms are compatible when their metadata matches exactly
+  findOrCreateQuickJoinRoom(options: RoomOptions = {}, client?: Client) {
+    const metadata = options.metadata ?? {};
+    // Strangers matched together can't have agreed on a passphrase
+    const room = this.rooms.find((room) =>
+      room.public && !room.encrypted &&
+      metadataMatches(room.metadata, metadata) &&
+      (!client || !room.joinError(client))
+    );
+    if (room) {
+      return room;
+    }
+
+    return this.getOrCreateRoom(crypto.randomUUID(), {
+      ...options,
+      public: true,
+    });
+  }
+
+  // Registers the room on Redis with the creator's settings, unless another
+  // instance already has, and returns the settings that stuck. Undefined when
+  // Redis can't be reached, the room is then only this instance's
+  async claimSharedRoom(
+    roomId: string,
+    options: RoomOptions = {},
+    creator: Client,
+  ) {
+    if (!this.cluster) {
+      return;
+    }
+
+    const { seedHash, settings, gameId, clientVersion } = creator.data;
+    const shared: SharedRoom = { options };
+    if (typeof seedHash === "string") {
+      shared.seedHash = seedHash;
+      shared.settings = typeof settings === "string" ? settings : undefined;
+    }
+    shared.gameId = typeof options.gameId === "string"
+      ? options.gameId
+      : typeof gameId === "string"
+      ? gameId
+      : undefined;
+    if (
+      options.requireMatchingVersion === true &&
+      typeof clientVersion === "string"
+    ) {
+      shared.requiredClientVersion = clientVersion;
+    }
+    try {
+      return await this.cluster.claimRoom(roomId, shared);
+    } catch (error) {
+      creator.logError(
+        `Error claiming room ${roomId} on Redis: ${error.message}`,
+      );
+    }
+  }
+
+  removeRoom(room: Room) {
+    const index = this.rooms.indexOf(room);
+    if (index !== -1) {
+      this.rooms.splice(index, 1);
+      this.emitEvent("roomDeleted", { roomId: room.id });
+      if (this.cluster) {
+        room.leaveCluster();
+      }
+    }
+    clearTimeout(room.retentionTimer);
+    clearTimeout(room.allClientDataTimer);
+    room.forgetDeliveries();
+    room.stopRecording();
+    room.stopLog();
+    room.closeEventLog();
+  }
+
+  recordPacket(
+    type: string,
+    direction: "received" | "sent" | "superseded" | "throttled",
+    bytes: number,
+  ) {
+    const key = isKnownPacketType(type) ? type : "other";
+    const stats = this.packetStats[key] ??= {
+      received: 0,
+      sent: 0,
+      bytesReceived: 0,
+      bytesSent: 0,
+      superseded: 0,
+      throttled: 0,
+    };
+
+    if (direction === "received") {
+      stats.received++;
+      stats.bytesReceived += bytes;
+    } else if (direction === "sent") {
+      stats.sent++;
+      stats.bytesSent += bytes;
+    } else if (direction === "superseded") {
+      stats.superseded++;
+    } else {
+      stats.throttled++;
+    }
+  }
+
+  log(...data: any[]) {
+    writeLog("info", data.join(" "), {}, "Server");
+  }
+
+  logError(message: string) {
+    writeLog("error", message, {}, "Server");
+  }
+}
+
+export class Client {
+  public id: number;
+  public data: ClientData = {};
+  public connection: Connection;
+  public server: Server;
+  public room?: Room;
+  // Round trip time in ms of the last answered PING
+  public rtt?: number;
+  private pingSentAt?: number;
+  private disconnected = false;
+  // Asked for CLIENT_DATA_DELTA rather than full UPDATE_CLIENT_DATA packets
+  public wantsDeltas = false;
+  // Agreed in HANDSHAKE, unset for clients that never sent one
+  public capabilities?: Set<Capability>;
+  // Packets with a message are dropped until then
+  public mutedUntil = 0;
+  // See bindUuid
+  public clientUuid?: string;
+  // From a verified authToken, see authenticate
+  public accountId?: string;
+  // Set by REQUEST_UDP, the address is where its datagrams last came from
+  public udpToken?: string;
+  public udpAddress?: Deno.NetAddr;
+  // Handed back by the room when the client rejoins it, see Room.addClient
+  public deliveries: Deliveries = { nextSeq: 1, unacked: [] };
+  // Packets waiting for the previous write to finish
+  private outbox: QueuedPacket[] = [];
+  private flushing = false;
+  // Consecutive timed out writes, see writeWithDeadline
+  private writeTimeouts = 0;
+  // Bytes that can go out right away under MAX_CLIENT_BYTES_PER_SECOND, see
+  // sendDelayMs. Starts full
+  private sendAllowance = Infinity;
+  private allowanceUpdatedAt = Date.now();
+  // Set while the next packet waits for sendAllowance, and the total waited
+  public throttled = false;
+  public throttledMs = 0;
+  public connectedAt = Date.now();
+  // Removes the client from its room once its grace period is over
+  public graceTimer?: number;
+  // Last time anything was received
+  public lastActivity = Date.now();
+  // Set by the trace console command, packets go to the log without a file
+  private tracing = false;
+  private traceFile?: Deno.FsFile;
+
+  constructor(connection: Connection, server: Server, id: number) {
+    this.connection = connection;
+    this.server = server;
+    this.id = id;
+
+    // SHA256 to get a rough idea of how many unique players there are
+    const { remoteAddr } = this.connection;
+    crypto.subtle.digest(
+      "SHA-256",
+      encoder.encode(
+        "hostname" in remoteAddr ? remoteAddr.hostname : remoteAddr.path,
+      ),
+    )
+      .then((hasBuffer) => {
+        this.server.stats.onlineCount++;
+        this.server.stats.clientSHAs[encodeHex(hasBuffer)] = true;
+      })
+      .catch((error) => {
+        this.logError(`Error hashing client: ${error.message}`);
+      });
+
+    this.waitForData();
+    this.log("Connected", "connected");
+    this.server.emitEvent("clientConnected", { clientId: this.id });
+  }
+
+  get connected() {
+    return !this.disconnected;
+  }
+
+  get muted() {
+    return Date.now() < this.mutedUntil;
+  }
+
+  // 0 minutes unmutes
+  mute(minutes = defaultMuteMinutes) {
+    this.mutedUntil = minutes > 0 ? Date.now() + 1000 * 60 * minutes : 0;
+    if (minutes > 0) {
+      this.log(`Muted for ${minutes} minutes`);
+      sendServerMessage(this, `You have been muted for ${minutes} minutes`);
+    } else {
+      this.log("Unmuted");
+      sendServerMessage(this, "You have been unmuted");
+    }
+  }
+
+  // Sent CLIENT_DATA_DELTA rather than full UPDATE_CLIENT_DATA packets. Checked
+  // as they're sent, so turning deltas off applies to clients already here
+  get acceptsDeltas() {
+    return this.wantsDeltas && this.hasFeature("deltas");
+  }
+
+  // Clients without a HANDSHAKE get chat, as they always have
+  get acceptsChat() {
+    return this.capabilities?.has("chat") ?? true;
+  }
+
+  // Agrees to whichever of the offered capabilities this server supports, so
+  // anything else, like compression or binary framing, is left out
+  negotiate(offered: unknown) {
+    const offeredNames = new Set(Array.isArray(offered) ? offered : []);
+    this.wantsDeltas = offeredNames.has("deltas");
+    this.capabilities = new Set(
+      capabilities.filter((capability) =>
+        offeredNames.has(capability) &&
+        (capability !== "deltas" || this.hasFeature("deltas"))
+      ),
+    );
+    this.log(
+      `Agreed capabilities: ${[...this.capabilities].join(", ") || "none"}`,
+    );
+    this.sendPacket({
+      type: "HANDSHAKE",
+      capabilities: [...this.capabilities],
+    });
+  }
+
+  // By clientId, so a client keeps the same features when it reconnects
+  hasFeature(feature: Feature) {
+    return this.id % 100 < config.features[feature];
+  }
+
+  get remoteAddress() {
+    const { remoteAddr } = this.connection;
+    return "hostname" in remoteAddr
+      ? `${remoteAddr.hostname}:${remoteAddr.port}`
+      : remoteAddr.path;
+  }
+
+  // What a kick is remembered by, so coming back on a new connection with a
+  // new clientId doesn't get around it
+  get identities() {
+    const identities = [`client:${this.id}`];
+    if (this.accountId !== undefined) {
+      identities.push(`account:${this.accountId}`);
+    }
+    if (this.clientUuid !== undefined) {
+      identities.push(`install:${this.clientUuid}`);
+    }
+    // Behind a local proxy, or over a Unix socket, every client shares it
+    const { remoteAddr } = this.connection;
+    if ("hostname" in remoteAddr && !isLoopback(remoteAddr.hostname)) {
+      identities.push(`address:${remoteAddr.hostname}`);
+    }
+    return identities;
+  }
+
+  // Shared by state dumps and JSON console output
+  summary() {
+    return {
+      id: this.id,
+      accountId: this.accountId,
+      clientUuid: this.clientUuid,
+      mutedUntil: this.muted ? this.mutedUntil : undefined,
+      roomId: this.room?.id,
+      teamId: this.teamId,
+      remoteAddress: this.remoteAddress,
+      connectedAt: this.connectedAt,
+      lastActivity: this.lastActivity,
+      rtt: this.rtt,
+      connected: this.connected,
+      capabilities: this.capabilities && [...this.capabilities],
+      unacked: this.deliveries.unacked.length || undefined,
+      throttledMs: this.throttledMs || undefined,
+      data: this.data,
+    };
+  }
+
+  get teamId(): string {
+    return typeof this.data.teamId === "string"
+      ? this.data.teamId
+      : defaultTeamId;
+  }
+
+  async waitForData() {
+    const buffer = new Uint8Array(readBufferSize);
+    // Bytes received but not handled yet are data[start, end), with no
+    // delimiter before scanned
+    let data = new Uint8Array(readBufferSize);
+    let start = 0;
+    let end = 0;
+    let scanned = 0;
+
+    while (true) {
+      let count: null | number = 0;
+
+      try {
+        count = await this.connection.read(buffer);
+      } catch (error) {
+        this.logError(`Error reading from connection: ${error.message}`);
+        this.disconnect(true);
+        break;
+      }
+
+      if (!count) {
+        this.disconnect(true);
+        break;
+      }
+      this.lastActivity = Date.now();
+
+      // Append to the unhandled bytes, moving them to the front first and
+      // doubling the buffer when they don't fit, so a large packet isn't
+      // copied again on every read
+      if (end + count > data.length) {
+        const pending = data.subarray(start, end);
+        if (pending.length + count > data.length) {
+          data = new Uint8Array(
+            Math.max(2 * data.length, pending.length + count),
+          );
+        }
+        data.set(pending);
+        scanned -= start;
+        end = pending.length;
+        start = 0;
+      }
+      data.set(buffer.subarray(0, count), end);
+      end += count;
+
+      // Handle all complete packets (while loop in case multiple packets were received at once)
+      while (true) {
+        const delimiterIndex = findDelimiterIndex(
+          data.subarray(start, end),
+          scanned - start,
+        );
+        if (delimiterIndex === -1) {
+          scanned = end;
+          break; // Incomplete packet, wait for more data
+        }
+
+        if (delimiterIndex > config.maxPacketSize) {
+          this.rejectOversizedPacket(delimiterIndex);
+          return;
+        }
+
+        // Extract the packet
+        const packet = data.subarray(start, start + delimiterIndex);
+        start += delimiterIndex + 1;
+        scanned = start;
+
+        // Awaited so packets waiting on authentication keep their order
+        await this.handlePacket(packet);
+      }
+
+      // Whatever is left is an incomplete packet, don't let it grow unbounded
+      if (end - start > config.maxPacketSize) {
+        this.rejectOversizedPacket(end - start);
+        return;
+      }
+      if (start === end) {
+        start = end = scanned = 0;
+      }
+    }
+  }
+
+  rejectOversizedPacket(size: number) {
+    this.log(
+      `Packet of at least ${size} bytes exceeds the ${config.maxPacketSize} byte limit, disconnecting`,
+    );
+    this.sendPacket({
+      type: "SERVER_MESSAGE",
+      message:
+        `Packet too large (limit is ${config.maxPacketSize} bytes), disconnecting`,
+    }).finally(() => {
+      this.disconnect();
+    });
+  }
+
+  handlePacket(packet: Uint8Array) {
+    return traced("handlePacket", {
+      "anchor.client.id": this.id,
+      "anchor.packet.bytes": packet.length,
+    }, (span) => this.processPacket(packet, span));
+  }
+
+  private async processPacket(packet: Uint8Array, span: Span) {
+    try {
+      const packetObject = decodePacket(packet);
+      span.setAttribute("anchor.packet.type", packetObject.type);
+      if (this.room) {
+        span.setAttribute("anchor.room.id", this.room.id);
+      }
+
+      if (config.strict) {
+        const reason = strictPacketError(packetObject);
+        if (reason) {
+          this.log(`Strict mode, disconnecting: ${reason}`);
+          this.disconnect();
+          return;
+        }
+      }
+
+      if (
+        packetObject.type === "UPDATE_CLIENT_DATA" &&
+        packetObject.authToken !== undefined
+      ) {
+        // Deleted first so it's never relayed or recorded
+        const { authToken } = packetObject;
+        delete packetObject.authToken;
+        if (!await this.authenticate(authToken)) {
+          return;
+        }
+      }
+
+      if (
+        packetObject.type === "UPDATE_CLIENT_DATA" &&
+        packetObject.clientUuid !== undefined
+      ) {
+        const { clientUuid } = packetObject;
+        delete packetObject.clientUuid;
+        if (typeof clientUuid !== "string" || !uuidPattern.test(clientUuid)) {
+          this.log(`Invalid clientUuid ${JSON.stringify(clientUuid)}`);
+          sendServerMessage(this, "Invalid clientUuid");
+          return;
+        }
+        if (clientUuid !== this.clientUuid && !this.bindUuid(clientUuid)) {
+          return;
+        }
+      }
+
+      // Only used when joining, see Room.catchUp
+      let lastSeq: number | undefined;
+      if (packetObject.type === "UPDATE_CLIENT_DATA") {
+        if (typeof packetObject.lastSeq === "number") {
+          lastSeq = packetObject.lastSeq;
+        }
+        delete packetObject.lastSeq;
+      }
+
+      packetObject.clientId = this.id;
+      this.server.recordPacket(packetObject.type, "received", packet.length);
+      this.tracePacket("in", packetObject);
+
+      if (!packetObject.quiet && !quietMode) {
+        this.log(`-> ${packetObject.type} packet`, "packetReceived");
+      }
+
+      if (!this.applyContentFilter(packetObject)) {
+        return;
+      }
+
+      // Chat and other text, state sync carries on as normal
+      const { message } = packetObject as GamePacket;
+      if (this.muted && typeof message === "string") {
+        this.log(`Muted, dropping ${packetObject.type} packet`);
+        return;
+      }
+
+      if (this.server.runHook("onPacket", this, packetObject).includes(false)) {
+        this.log(`Plugin dropped ${packetObject.type} packet`);
+        return;
+      }
+
+      // Its snapshot has already been sent to the instance it's moving to
+      if (this.room?.migrating) {
+        this.log(`Room migrating, dropping ${packetObject.type} packet`);
+        return;
+      }
+
+      let dataDelta: ClientDataDelta | undefined;
+      if (packetObject.type === "UPDATE_CLIENT_DATA") {
+        const error = clientDataError(packetObject.data);
+        if (error) {
+          this.log(`Rejecting client data: ${error}`);
+          sendServerMessage(this, `Client data rejected: ${error}`);
+          return;
+        }
+
+        const gameError = this.room?.clientDataError(packetObject.data);
+        if (gameError) {
+          this.log(`Rejecting client data: ${gameError}`);
+          sendServerMessage(this, `Client data rejected: ${gameError}`);
+          return;
+        }
+
+        const versionError = clientVersionError(packetObject.data);
+        if (versionError) {
+          this.log(`Disconnecting: ${versionError}`);
+          sendServerMessage(this, versionError).finally(() => {
+            this.disconnect();
+          });
+          return;
+        }
+
+        if (packetObject.deltas === true) {
+          this.wantsDeltas = true;
+        }
+
+        const previousData = this.data;
+        this.data = packetObject.data;
+        this.room?.rememberTeam(this);
+        // Also renames it in the packet relayed below, it's the same object
+        this.room?.assignUniqueName(this, previousData.name);
+        dataDelta = clientDataDelta(previousData, this.data);
+      }
+
+      if (
+        packetObject.type === "GAME_COMPLETE" &&
+        this.room?.recordCompletion(this, packetObject)
+      ) {
+        this.server.stats.gamesCompleted++;
+        this.server.runHook("onGameComplete", this, this.room);
+        this.server.emitEvent("gameCompleted", {
+          clientId: this.id,
+          name: this.data.name,
+          roomId: this.room?.id,
+          teamId: this.teamId,
+        });
+      }
+
+      if (packetObject.type === "PING") {
+        this.sendPacket({ type: "PONG", quiet: true });
+        return;
+      }
+
+      if (packetObject.type === "PONG") {
+        this.handlePong();
+        return;
+      }
+
+      if (packetObject.type === "HANDSHAKE") {
+        this.negotiate(packetObject.capabilities);
+        return;
+      }
+
+      if (packetObject.type === "ACK") {
+        this.acknowledge(packetObject.deliverySeq);
+        return;
+      }
+      // Only the server numbers packets, see sendPacket
+      delete packetObject.deliverySeq;
+
+      if (packetObject.type === "REQUEST_SERVER_INFO") {
+        this.sendPacket({ type: "SERVER_INFO", ...this.server.info() });
+        return;
+      }
+
+      if (packetObject.type === "REQUEST_UDP") {
+        const enabled = !!this.server.udpConnection && this.hasFeature("udp");
+        this.sendPacket({
+          type: "UDP_INFO",
+          port: enabled ? config.udpPort : 0,
+          token: enabled ? this.allocateUdpToken() : undefined,
+        });
+        return;
+      }
+
+      if (packetObject.type === "LIST_ROOMS") {
+        const publicRooms = this.server.rooms.filter((room) =>
+          room.public && room.matchesListing(packetObject)
+        );
+        this.sendPacket({
+          type: "ROOM_LIST",
+          rooms: sortRooms(publicRooms, packetObject.sort).map((room) => ({
+            roomId: room.id,
+            clientCount: room.clients.length,
+            metadata: room.metadata,
+            encrypted: room.encrypted,
+            gameId: room.gameId,
+            title: room.title,
+            description: room.description,
+            tags: room.tags,
+            region: room.region,
+          })),
+        });
+        return;
+      }
+
+      const joining = !this.room &&
+        (!!packetObject.roomId || !!packetObject.quickJoin);
+      if (joining && config.requireAuth && !this.accountId) {
+        this.log("Not signed in, not joining");
+        sendServerMessage(this, "This server requires signing in");
+        return;
+      }
+
+      if (joining && this.server.maintenance) {
+        this.log("Maintenance scheduled, turning away client");
+        sendDisable(this, this.server.maintenanceNotice());
+        return;
+      }
+
+      let existingRoom = this.server.rooms.find((room) =>
+        room.id === packetObject.roomId
+      );
+      if (joining && this.server.draining && !existingRoom) {
+        this.log("Draining, not creating a new room");
+        sendServerMessage(this, "Server is shutting down, try again later");
+        return;
+      }
+
+      // When clustered, the room may already be another instance's, in which
+      // case the settings it was created with are checked like a local room's
+      let claimedRoom: Room | undefined;
+      if (
+        joining && packetObject.roomId && !existingRoom &&
+        this.server.cluster &&
+        !this.server.newRoomError(packetObject.roomOptions, this)
+      ) {
+        const shared = await this.server.claimSharedRoom(
+          packetObject.roomId,
+          packetObject.roomOptions,
+          this,
+        );
+        existingRoom = this.server.rooms.find((room) =>
+          room.id === packetObject.roomId
+        );
+        if (shared && !existingRoom) {
+          claimedRoom = this.server.getOrCreateRoom(
+            packetObject.roomId,
+            shared.options,
+            shared,
+          );
+          existingRoom = claimedRoom;
+        }
+      }
+
+      const joinError = !joining
+        ? undefined
+        : existingRoom
+        ? existingRoom.joinError(this)
+        : this.server.newRoomError(packetObject.roomOptions, this);
+      if (joinError) {
+        this.log(`Can't join room ${packetObject.roomId}: ${joinError}`);
+        sendServerMessage(this, joinError);
+        if (claimedRoom && !claimedRoom.clients.length) {
+          this.server.removeRoom(claimedRoom);
+        }
+        return;
+      }
+
+      if (packetObject.roomId && !this.room) {
+        this.server.getOrCreateRoom(
+          packetObject.roomId,
+          packetObject.roomOptions,
+        ).addClient(this, lastSeq);
+      } else if (packetObject.quickJoin && !this.room) {
+        this.server.findOrCreateQuickJoinRoom(packetObject.roomOptions, this)
+          .addClient(this);
+      }
+
+      if (!this.room) {
+        this.log("Not in a room, ignoring packet");
+        return;
+      }
+
+      this.room.lastActivity = Date.now();
+      this.room.capturePacket("in", this, packetObject);
+
+      if (
+        typeof packetObject.eventId === "string" &&
+        !this.room.trackEventId(packetObject.eventId)
+      ) {
+        this.log(`Dropping duplicate event ${packetObject.eventId}`);
+        return;
+      }
+
+      if (!this.room.allowsPacketType(packetObject.type)) {
+        this.log(
+          `Dropping ${packetObject.type} packet, not a ${this.room.gameId} packet`,
+        );
+        return;
+      }
+
+      if (this.room.encrypted && !isSealed(packetObject)) {
+        this.log(`Dropping unencrypted ${packetObject.type} packet`);
+        return;
+      }
+
+      if (
+        packetObject.type === "SET_ROLE" || packetObject.type === "KICK" ||
+        packetObject.type === "MUTE"
+      ) {
+        this.room.moderate(this, packetObject);
+        return;
+      }
+
+      if (packetObject.type === "WHISPER") {
+        if (!this.hasFeature("whispers")) {
+          sendServerMessage(this, "Whispers are turned off on this server");
+          return;
+        }
+        const target = this.room.clients.find((client) =>
+          client.id === packetObject.targetClientId
+        );
+        if (target && !target.acceptsChat) {
+          sendServerMessage(
+            this,
+            `Client ${packetObject.targetClientId} can't receive whispers`,
+          );
+          return;
+        }
+        const sent = this.room.broadcast(packetObject, {
+          exclude: this,
+          online: true,
+          where: (client) => client.id === packetObject.targetClientId,
+        });
+        if (!sent.length && this.room.hasRemoteMember(packetObject)) {
+          this.room.shareWithCluster(packetObject);
+        } else if (!sent.length) {
+          sendServerMessage(
+            this,
+            `Client ${packetObject.targetClientId} is not in this room`,
+          );
+        }
+        return;
+      }
+
+      if (packetObject.type === "REQUEST_SCOREBOARD") {
+        this.sendPacket({ type: "SCOREBOARD", teams: this.room.scoreboard() });
+        return;
+      }
+
+      this.room.recordScore(this, packetObject.type);
+      // CHANGE_TEAM, UPDATE_FLAGS and GAME_COMPLETE are logged once applied
+      if (
+        packetObject.type === "UPDATE_CLIENT_DATA" || isGameEvent(packetObject)
+      ) {
+        this.room.recordEvent(this, packetObject);
+      }
+
+      if (packetObject.type === "UPDATE_FLAGS") {
+        this.room.mergeFlags(packetObject, this);
+        return;
+      }
+
+      if (packetObject.targetClientId) {
+        const sent = this.room.broadcast(packetObject, {
+          where: (client) => client.id === packetObject.targetClientId,
+        });
+        if (!sent.length && this.room.hasRemoteMember(packetObject)) {
+          this.room.shareWithCluster(packetObject);
+        } else if (!sent.length) {
+          this.log(`Target client ${packetObject.targetClientId} not found`);
+        }
+        return;
+      }
+
+      if (packetObject.type === "REQUEST_SAVE_STATE") {
+        if (
+          this.room.peersOf(this).length || this.room.hasRemotePeers(this)
+        ) {
+          this.room.requestingStateClients.push(this);
+          this.room.broadcastPacket(packetObject, this);
+        } else {
+          // Nobody online to ask, fall back to the last state we were sent
+          const savedState =
+            this.room.savedStates[this.room.saveStateKey(this)];
+          if (savedState) {
+            this.sendPacket(savedState);
+          }
+        }
+      } else if (packetObject.type === "PUSH_SAVE_STATE") {
+        const saveStateKey = this.room.saveStateKey(this);
+        this.room.savedStates[saveStateKey] = packetObject;
+        this.server.cluster?.publish(this.room.id, {
+          savedState: packetObject,
+          saveStateKey,
+        });
+
+        // Only answer requests from clients that can see this client's state
+        const peers = this.room.peersOf(this);
+        this.room.requestingStateClients = this.room.requestingStateClients
+          .filter((client) => {
+            if (!peers.includes(client)) {
+              return true;
+            }
+            client.sendPacket(packetObject);
+            return false;
+          });
+      } else if (packetObject.type === "TEAM_CHAT") {
+        this.room.broadcastTeamPacket(packetObject, this);
+      } else if (packetObject.type === "CHANGE_TEAM") {
+        const { teamId } = packetObject;
+        if (!isValidTeamId(teamId)) {
+          this.log(`Invalid teamId ${JSON.stringify(teamId)}`);
+          sendServerMessage(this, "Invalid team");
+          return;
+        }
+
+        this.log(`Changing team from ${this.teamId} to ${teamId}`);
+        this.data.teamId = teamId;
+        this.room.rememberTeam(this);
+        this.room.recordEvent(this, packetObject);
+        this.room.scheduleAllClientData();
+      } else if (packetObject.type === "UPDATE_CLIENT_DATA" && dataDelta) {
+        this.room.broadcastClientData(packetObject, this, dataDelta);
+      } else {
+        this.room.broadcastPacket(packetObject, this);
+      }
+    } catch (error) {
+      this.logError(`Error handling packet: ${error.message}`);
+      if (config.strict) {
+        this.log("Strict mode, disconnecting");
+        this.disconnect();
+      }
+    }
+  }
+
+  // Returns false if the token is rejected, the packet carrying it is dropped
+  async authenticate(authToken: unknown) {
+    if (!config.jwtKey) {
+      this.log("Ignoring auth token, no JWT key is configured");
+      return true;
+    }
+
+    try {
+      const claims = await verifyJwt(String(authToken), config.jwtKey, {
+        issuer: config.jwtIssuer,
+        audience: config.jwtAudience,
+      });
+      const accountId = claims[config.jwtAccountClaim];
+      if (typeof accountId !== "string" && typeof accountId !== "number") {
+        throw new Error(`Token has no ${config.jwtAccountClaim} claim`);
+      }
+      return this.bindAccount(String(accountId));
+    } catch (error) {
+      this.log(`Rejecting auth token: ${error.message}`);
+      sendServerMessage(this, `Signing in failed: ${error.message}`);
+      return false;
+    }
+  }
+
+  bindAccount(accountId: string) {
+    const previousId = this.server.accountClientIds.get(accountId);
+    if (!this.reclaimId(previousId, `Signed in as ${accountId}`)) {
+      return false;
+    }
+
+    this.accountId = accountId;
+    this.server.accountClientIds.set(accountId, this.id);
+    return true;
+  }
+
+  bindUuid(clientUuid: string) {
+    const { clientUuids } = this.server.stats;
+    // A signed in account's id wins, the install is tied to it from now on
+    const previousId = this.accountId ? undefined : clientUuids[clientUuid];
+    if (!this.reclaimId(previousId, `Identified as ${clientUuid}`)) {
+      return false;
+    }
+
+    this.clientUuid = clientUuid;
+    clientUuids[clientUuid] = this.id;
+    this.server.stats.clientUuidLastSeen[clientUuid] = Date.now();
+    return true;
+  }
+
+  // Takes back previousId, the clientId this account or install had last
+  // time, so peers and tools see the same id across reconnects, machines and
+  // restarts, unless the client is already known by its current one in a
+  // room. If it's still connected elsewhere, DUPLICATE_LOGIN decides which
+  // connection stays. Returns false if it's this one that's turned away
+  private reclaimId(previousId: number | undefined, identity: string) {
+    const elsewhere = this.server.clients.find((client) =>
+      client !== this && client.id === previousId
+    );
+    if (elsewhere && config.duplicateLogin === "reject") {
+      this.log(`${identity}, already connected as client ${elsewhere.id}`);
+      sendServerMessage(this, "You're already connected elsewhere")
+        .finally(() => {
+          this.disconnect();
+        });
+      return false;
+    }
+    if (elsewhere) {
+      elsewhere.log("Signed in elsewhere, disconnecting");
+      // Out of the room right away, so the new connection takes its place
+      elsewhere.room?.removeClient(elsewhere);
+      this.server.removeClient(elsewhere);
+      sendServerMessage(elsewhere, "Logged in elsewhere").finally(() => {
+        elsewhere.disconnect();
+      });
+    }
+
+    if (
+      previousId !== undefined && previousId !== this.id && !this.room &&
+      !this.server.clients.some((client) => client.id === previousId)
+    ) {
+      this.log(`${identity}, now client ${previousId}`);
+      this.id = previousId;
+    } else {
+      this.log(identity);
+    }
+    return true;
+  }
+
+  allocateUdpToken() {
+    if (!this.udpToken) {
+      this.udpToken = crypto.randomUUID();
+      this.server.udpClients.set(this.udpToken, this);
+    }
+    return this.udpToken;
+  }
+
+  // Only SUPERSEDED_PACKET_TYPES are relayed over UDP, as losing one costs
+  // nothing once the next arrives. Game events and the server's own packets
+  // need TCP's guarantees, and are dropped. A PING is answered over UDP so
+  // clients can check the path
+  handleDatagram(packetObject: Packet, address: Deno.NetAddr, size: number) {
+    // Follows the client to a new address, e.g. after a NAT rebinding
+    this.udpAddress = address;
+    this.lastActivity = Date.now();
+    delete packetObject.udpToken;
+    delete packetObject.deliverySeq;
+    packetObject.clientId = this.id;
+    this.server.recordPacket(packetObject.type, "received", size);
+    this.tracePacket("in", packetObject);
+
+    if (packetObject.type === "PING") {
+      this.sendUnreliable({ type: "PONG", quiet: true });
+      return;
+    }
+    if (
+      !this.room || packetObject.type in strictPacketFields ||
+      !config.supersededPacketTypes.includes(packetObject.type) ||
+      !this.room.allowsPacketType(packetObject.type) ||
+      isGameEvent(packetObject) ||
+      (this.room.encrypted && !isSealed(packetObject)) ||
+      (this.muted && typeof (packetObject as GamePacket).message === "string")
+    ) {
+      return;
+    }
+    this.room.capturePacket("in", this, packetObject);
+    if (!this.applyContentFilter(packetObject)) {
+      return;
+    }
+    if (this.server.runHook("onPacket", this, packetObject).includes(false)) {
+      return;
+    }
+
+    this.room.lastActivity = Date.now();
+    const { targetClientId } = packetObject;
+    for (const client of this.room.peersOf(this)) {
+      if (targetClientId === undefined || client.id === targetClientId) {
+        client.sendUnreliable(packetObject);
+      }
+    }
+    this.room.shareWithCluster(
+      packetObject,
+      this.room.peerFilter(this).teamId,
+      true,
+    );
+  }
+
+  // Everything up to deliverySeq arrived and doesn't need resending
+  acknowledge(deliverySeq: unknown) {
+    if (typeof deliverySeq !== "number") {
+      return;
+    }
+    this.deliveries.unacked = this.deliveries.unacked.filter((packet) =>
+      packet.deliverySeq! > deliverySeq
+    );
+  }
+
+  // After rejoining a room, for whatever the last connection to it never
+  // acknowledged, e.g. because it died mid-send. Skipped packets are dropped
+  // rather than resent, the client has them some other way
+  resendUnacked(skip = (_packet: Packet) => false) {
+    const unacked = this.deliveries.unacked.filter((packet) => !skip(packet));
+    this.deliveries.unacked = unacked;
+    if (!unacked.length) {
+      return;
+    }
+    this.log(`Resending ${unacked.length} unacknowledged packets`);
+    for (const packet of unacked) {
+      this.sendPacket(packet);
+    }
+  }
+
+  // Over UDP once the client has sent a datagram, over TCP until then
+  sendUnreliable(packetObject: Packet) {
+    const { udpConnection } = this.server;
+    if (!udpConnection || !this.udpAddress) {
+      return this.sendPacket(packetObject);
+    }
+
+    const packet = encodePacket(packetObject);
+    this.server.recordPacket(packetObject.type, "sent", packet.length);
+    this.tracePacket("out", packetObject);
+    return udpConnection.send(packet, this.udpAddress).then(
+      () => {},
+      (error) => this.logError(`Error sending datagram: ${error.message}`),
+    );
+  }
+
+  // Returns false if the packet should be dropped
+  applyContentFilter(packetObject: Packet) {
+    const filter = config.contentFilter;
+    if (!filter) {
+      return true;
+    }
+
+    const packet = packetObject as ClientData;
+    const fields: [ClientData, string][] = [[packet, "message"]];
+    if (packet.type === "UPDATE_CLIENT_DATA" && packet.data) {
+      fields.push([packet.data, "name"]);
+    }
+
+    for (const [object, key] of fields) {
+      const text = object[key];
+      if (typeof text !== "string" || text.search(filter) === -1) {
+        continue;
+      }
+
+      switch (config.contentFilterAction) {
+        case "drop":
+          this.log(`Dropping ${packet.type} packet, ${key} failed filter`);
+          return false;
+        case "disconnect":
+          this.log(`Disconnecting, ${key} in ${packet.type} failed filter`);
+          this.disconnect();
+          return false;
+        default:
+          object[key] = text.replace(
+            filter,
+            (match) => "*".repeat(match.length),
+          );
+      }
+    }
+    return true;
+  }
+
+  ping() {
+    this.pingSentAt = Date.now();
+    this.sendPacket({ type: "PING", quiet: true });
+  }
+
+  // Timed against when we sent the PING, so clients can't report their own
+  handlePong() {
+    if (this.pingSentAt === undefined) {
+      return;
+    }
+
+    this.rtt = Date.now() - this.pingSentAt;
+    this.pingSentAt = undefined;
+
+    if (config.relayRtt && this.room) {
+      this.room.broadcastPacket({
+        type: "CLIENT_RTT",
+        roomId: this.room.id,
+        clientId: this.id,
+        rtt: this.rtt,
+        quiet: true,
+      }, this);
+    }
+  }
+
+  // Resolves once the packet is written, or dropped because the client
+  // disconnected or a newer packet superseded it
+  sendPacket(packetObject: Packet) {
+    // Numbered and kept even while held after dropping, so it's resent once
+    // the client is back. Resent packets already have their deliverySeq
+    if (
+      this.room && this.capabilities?.has("acks") &&
+      packetObject.deliverySeq === undefined &&
+      config.ackedPacketTypes.includes(packetObject.type)
+    ) {
+      packetObject = {
+        ...packetObject,
+        deliverySeq: this.deliveries.nextSeq++,
+      };
+      const { unacked } = this.deliveries;
+      unacked.push(packetObject);
+      if (unacked.length > maxUnackedPackets) {
+        const [oldest] = unacked.splice(0, 1);
+        this.log(
+          `Too many unacknowledged packets, forgetting ${oldest.type} ${oldest.deliverySeq}`,
+        );
+      }
+    }
+    // Held in a room after dropping, see Room.holdSlot
+    if (this.disconnected) {
+      return Promise.resolve();
+    }
+    if (!packetObject.quiet && !quietMode) {
+      this.log(`<- ${packetObject.type} packet`, "packetSent");
+    }
+    this.room?.capturePacket("out", this, packetObject);
+    this.tracePacket("out", packetObject);
+
+    return new Promise<void>((resolve) => {
+      const queued = {
+        type: packetObject.type,
+        packet: encodePacket(packetObject),
+        supersedeKey: supersedeKey(packetObject),
+        urgent: urgentPacketTypes.includes(packetObject.type),
+        resolve,
+      };
+
+      // Anything still queued is waiting on a slow connection, so only the
+      // latest state from each peer is worth sending
+      const staleIndex = queued.supersedeKey === undefined
+        ? -1
+        : this.outbox.findIndex((packet) =>
+          packet.supersedeKey === queued.supersedeKey
+        );
+      if (staleIndex !== -1) {
+        const [stale] = this.outbox.splice(staleIndex, 1);
+        this.server.recordPacket(stale.type, "superseded", stale.packet.length);
+        stale.resolve();
+      }
+
+      const laneEnd = queued.urgent
+        ? this.outbox.findIndex((packet) => !packet.urgent)
+        : -1;
+      if (laneEnd === -1) {
+        this.outbox.push(queued);
+      } else {
+        this.outbox.splice(laneEnd, 0, queued);
+      }
+      this.flushOutbox();
+    });
+  }
+
+  // Writes queued packets one at a time, so they can't interleave
+  private async flushOutbox() {
+    if (this.flushing) {
+      return;
+    }
+    this.flushing = true;
+
+    while (this.outbox.length) {
+      // Waits with the packet still queued, so it can be superseded meanwhile
+      // and urgent packets can go ahead of it
+      const delayMs = this.sendDelayMs(this.outbox[0].packet.length);
+      if (delayMs) {
+        this.server.recordPacket(this.outbox[0].type, "throttled", 0);
+        this.throttled = true;
+        this.throttledMs += delayMs;
+        await new Promise((resolve) => setTimeout(resolve, delayMs));
+        this.throttled = false;
+        continue;
+      }
+
+      const queued = this.outbox.shift()!;
+      if (config.maxClientBytesPerSecond) {
+        this.sendAllowance -= queued.packet.length;
+      }
+      try {
+        await this.writeWithDeadline(queued.packet);
+        this.server.recordPacket(queued.type, "sent", queued.packet.length);
+      } catch (error) {
+        this.logError(`Error sending packet: ${error.message}`);
+        this.disconnect(true);
+        this.outbox.splice(0).forEach((packet) => packet.resolve());
+      }
+      queued.resolve();
+    }
+
+    this.flushing = false;
+  }
+
+  // How long until bytes more fit in MAX_CLIENT_BYTES_PER_SECOND. Up to a
+  // second's worth can go out at once, a bigger packet waits for a full second
+  // and overdraws the allowance, so the average still holds
+  private sendDelayMs(bytes: number) {
+    const rate = config.maxClientBytesPerSecond;
+    if (!rate) {
+      return 0;
+    }
+
+    const now = Date.now();
+    this.sendAllowance = Math.min(
+      rate,
+      this.sendAllowance + rate * (now - this.allowanceUpdatedAt) / 1000,
+    );
+    this.allowanceUpdatedAt = now;
+    const needed = Math.min(bytes, rate);
+    return this.sendAllowance >= needed
+      ? 0
+      : Math.ceil(1000 * (needed - this.sendAllowance) / rate);
+  }
+
+  // A write taking longer than WRITE_TIMEOUT_SECONDS counts as a timeout, and
+  // again for every further period it stays stuck. Writes finishing in time
+  // reset the count, too many in a row and the client is disconnected
+  private async writeWithDeadline(packet: Uint8Array) {
+    const written = writeAll(this.connection, packet);
+    // Still pending when giving up, it fails once the connection is closed
+    written.catch(() => {});
+
+    let timedOut = false;
+    while (true) {
+      let timer: number | undefined;
+      const deadline = new Promise<"timeout">((resolve) => {
+        timer = setTimeout(
+          () => resolve("timeout"),
+          1000 * config.writeTimeoutSeconds,
+        );
+      });
+      const result = await Promise.race([written, deadline])
+        .finally(() => clearTimeout(timer));
+      if (result !== "timeout") {
+        break;
+      }
+
+      timedOut = true;
+      this.writeTimeouts++;
+      this.log(
+        `Write took longer than ${config.writeTimeoutSeconds} seconds (${this.writeTimeouts} of ${config.maxWriteTimeouts} in a row)`,
+      );
+      if (this.writeTimeouts >= config.maxWriteTimeouts) {
+        throw new Error(
+          `Writes timed out ${this.writeTimeouts} times in a row`,
+        );
+      }
+    }
+
+    if (!timedOut) {
+      this.writeTimeouts = 0;
+    }
+  }
+
+  // Dropped connections, as opposed to ones the server closes, keep their
+  // place in the room for a while in case the client comes back
+  disconnect(dropped = false) {
+    if (this.disconnected) {
+      return;
+    }
+    this.disconnected = true;
+    this.server.runHook("onDisconnect", this);
+    this.server.emitEvent("clientDisconnected", {
+      clientId: this.id,
+      name: this.data.name,
+      roomId: this.room?.id,
+    });
+
+    try {
+      if (this.room && dropped && config.reconnectGraceSeconds) {
+        this.room.holdSlot(this);
+      } else if (this.room) {
+        this.room.removeClient(this);
+      }
+      this.server.removeClient(this);
+      this.stopTrace();
+      this.connection.close();
+    } catch (error) {
+      this.logError(`Error disconnecting: ${error.message}`);
+    } finally {
+      this.server.stats.onlineCount--;
+      this.log("Disconnected", "disconnected");
+    }
+  }
+
+  // Every packet to and from this client, even in quiet mode, to the log or
+  // appended to path as JSON lines
+  startTrace(path?: string) {
+    this.stopTrace();
+    if (path) {
+      this.traceFile = Deno.openSync(path, { create: true, append: true });
+    }
+    this.tracing = true;
+    this.log(`Tracing packets${path ? ` to ${path}` : ""}`);
+  }
+
+  stopTrace() {
+    if (!this.tracing) {
+      return;
+    }
+
+    try {
+      this.traceFile?.close();
+    } catch (error) {
+      this.logError(`Error closing trace: ${error.message}`);
+    }
+    this.traceFile = undefined;
+    this.tracing = false;
+    this.log("Stopped tracing packets");
+  }
+
+  get isTracing() {
+    return this.tracing;
+  }
+
+  tracePacket(direction: "in" | "out", packetObject: Packet) {
+    if (!this.tracing) {
+      return;
+    }
+
+    if (!this.traceFile) {
+      this.log(
+        `${new Date().toISOString()} ${direction === "in" ? "->" : "<-"} ${
+          JSON.stringify(packetObject)
+        }`,
+        "packetTraced",
+      );
+      return;
+    }
+
+    try {
+      const line = JSON.stringify({
+        timestamp: Date.now(),
+        direction,
+        clientId: this.id,
+        packet: packetObject,
+      });
+      writeAllSync(this.traceFile, encoder.encode(line + "\n"));
+    } catch (error) {
+      this.logError(`Error tracing packet: ${error.message}`);
+      this.stopTrace();
+    }
+  }
+
+  log(message: string, event?: string) {
+    this.logAt("info", message, event);
+  }
+
+  logError(message: string) {
+    this.logAt("error", message);
+  }
+
+  private logAt(level: LogLevel, message: string, event?: string) {
+    const fields = { clientId: this.id, roomId: this.room?.id, event };
+    writeLog(level, message, fields, `Client ${this.id}`);
+    this.room?.writeLogFile(level, message, fields, `Client ${this.id}`);
+  }
+}
+
+export class Room {
+  public id: string;
+  public server: Server;
+  public public: boolean;
+  public metadata: ClientData;
+  // Listing fields, for browsing public rooms
+  public title?: string;
+  public description?: string;
+  public tags: string[];
+  public region?: string;
+  public teamScoped: boolean;
+  public encrypted: boolean;
+  public retentionMinutes?: number;
+  public clients: Client[] = [];
+  public requestingStateClients: Client[] = [];
+  // Latest PUSH_SAVE_STATE per saveStateKey
+  public savedStates: Record<string, Packet> = {};
+  // Merged world flags per saveStateKey, the room's word over any client's
+  public flags = new Map<string, Map<string, FlagValue>>();
+  public flagMerge: FlagMerge;
+  // The latest ROOM_EVENT_LOG_SIZE events, oldest first
+  public events: RoomEvent[] = [];
+  public nextEventSeq = 1;
+  public retentionTimer?: number;
+  public allClientDataTimer?: number;
+  public createdAt = Date.now();
+  // Last time a member sent a packet
+  public lastActivity = Date.now();
+  // The first client to join, whether or not it's still here
+  public ownerId?: number;
+  // Promoted by the owner with SET_ROLE
+  public moderatorIds = new Set<number>();
+  // Refused if they try to join again, by each of Client.identities, to the
+  // clientId that was kicked
+  public kicked = new Map<string, number>();
+  // From the creator's data, joining clients with a different seed are refused
+  public seedHash?: string;
+  public settings?: string;
+  // Chooses the GameRules its packets and clients are checked against
+  public gameId?: string;
+  public minClientVersion?: string;
+  public requireMatchingVersion: boolean;
+  // The creator's clientVersion when requireMatchingVersion is set
+  public requiredClientVersion?: string;
+  // Every clientId that has joined, to tell returning clients apart
+  public memberIds = new Set<number>();
+  // By clientId, for clients that left, so their numbering carries on and
+  // unacknowledged packets are resent if they're back before the timer runs
+  // out
+  private deliveries = new Map<
+    number,
+    { deliveries: Deliveries; timer: number }
+  >();
+  // Set while migrateRoom is moving the room to another instance
+  public migrating = false;
+  // By instanceId, the room's clients on other instances when clustered
+  public remoteMembers = new Map<
+    string,
+    { clients: ClientData[]; receivedAt: number }
+  >();
+  // Whether this instance's members changed since they were last shared
+  private membersChanged = false;
+  // By clientId, so clients that come back are put on the same team
+  public teamAssignments = new Map<number, string>();
+  // By teamId, teams that finished already have a leaderboard entry
+  public scores = new Map<string, TeamScore>();
+  // Insertion ordered, so the oldest id is always evicted first
+  private eventIds = new Set<string>();
+  private recording?: Deno.FsFile;
+  // Opened by the first event while EVENT_LOG_DIR is set. Appends are chained
+  // so they land in order without holding up packet handling
+  private eventLog?: Deno.FsFile;
+  private eventLogWriting = Promise.resolve();
+  // Set by the roomLog console command
+  private logFile?: Deno.FsFile;
+
+  constructor(id: string, server: Server, options: RoomOptions) {
+    this.id = id;
+    this.server = server;
+    this.public = options.public === true;
+    this.metadata = options.metadata ?? {};
+    if (typeof options.title === "string") {
+      this.title = options.title.slice(0, maxRoomTitleLength);
+    }
+    if (typeof options.description === "string") {
+      this.description = options.description.slice(
+        0,
+        maxRoomDescriptionLength,
+      );
+    }
+    this.tags = Array.isArray(options.tags)
+      ? options.tags.filter((tag) => typeof tag === "string")
+        .map((tag) => tag.slice(0, maxRoomTagLength)).slice(0, maxRoomTags)
+      : [];
+    if (typeof options.region === "string") {
+      this.region = options.region;
+    }
+    this.teamScoped = options.teamScoped === true;
+    this.encrypted = options.encrypted === true;
+    if (typeof options.gameId === "string") {
+      this.gameId = options.gameId;
+    }
+    if (typeof options.minClientVersion === "string") {
+      this.minClientVersion = options.minClientVersion;
+    }
+    this.requireMatchingVersion = options.requireMatchingVersion === true;
+    this.flagMerge = options.flagMerge === "lastWriteWins"
+      ? "lastWriteWins"
+      : "union";
+    if (typeof options.retentionMinutes === "number") {
+      this.retentionMinutes = Math.max(0, options.retentionMinutes);
+    }
+    this.log("Created", { event: "roomCreated" });
+  }
+
+  // What the instance that created the room decided, kept over anything its
+  // first client here would otherwise decide
+  adopt(shared: SharedRoom) {
+    this.seedHash ??= shared.seedHash;
+    this.settings ??= shared.settings;
+    this.gameId ??= shared.gameId;
+    this.requiredClientVersion ??= shared.requiredClientVersion;
+  }
+
+  // lastSeq is the highest seq a returning client received before it
+  // disconnected, the events it missed since are resent
+  addClient(client: Client, lastSeq?: number) {
+    this.log(`Adding client ${client.id}`, {
+      clientId: client.id,
+      event: "clientJoined",
+    });
+    const returning = this.memberIds.has(client.id);
+    this.memberIds.add(client.id);
+    // Takes over from its dropped connection, peers never saw it leave
+    const held = this.clients.find((c) => c.id === client.id && !c.connected);
+    if (held) {
+      this.log(`Client ${client.id} is back`);
+      clearTimeout(held.graceTimer);
+      this.clients.splice(this.clients.indexOf(held), 1);
+      held.room = undefined;
+    }
+    const previousTeamId = this.teamAssignments.get(client.id);
+    if (previousTeamId !== undefined && client.data.teamId !== previousTeamId) {
+      this.log(`Putting client ${client.id} back on team ${previousTeamId}`);
+      client.data.teamId = previousTeamId;
+    }
+    this.rememberTeam(client);
+    // Like the seed, the creator's game is the room's unless it was chosen
+    if (this.ownerId === undefined && typeof client.data.gameId === "string") {
+      this.gameId ??= client.data.gameId;
+    }
+    // The creator's seed is the room's, restored rooms keep the one they had
+    const { seedHash, settings } = client.data;
+    if (
+      this.ownerId === undefined && this.seedHash === undefined &&
+      typeof seedHash === "string"
+    ) {
+      this.seedHash = seedHash;
+      this.settings = typeof settings === "string" ? settings : undefined;
+    }
+    const { clientVersion } = client.data;
+    if (
+      this.requireMatchingVersion && this.ownerId === undefined &&
+      typeof clientVersion === "string"
+    ) {
+      this.requiredClientVersion ??= clientVersion;
+    }
+    this.clients.push(client);
+    client.room = this;
+    this.ownerId ??= client.id;
+    const deliveries = held?.deliveries ??
+      this.deliveries.get(client.id)?.deliveries;
+    this.forgetDeliveries(client.id);
+    if (deliveries && client.capabilities?.has("acks")) {
+      client.deliveries = deliveries;
+    }
+    clearTimeout(this.retentionTimer);
+
+    this.assignUniqueName(client);
+    if (held) {
+      // Its join packet is relayed, the rest of the room has nothing new
+      this.broadcastAllClientData({ where: (c) => c === client });
+    } else {
+      this.scheduleAllClientData();
+    }
+
+    // Joiners start from the merged state rather than whatever a peer sends
+    const flags = this.flags.get(this.saveStateKey(client));
+    if (flags?.size) {
+      client.sendPacket({
+        type: "UPDATE_FLAGS",
+        roomId: this.id,
+        flags: Object.fromEntries(flags),
+      });
+    }
+    if (lastSeq !== undefined && returning) {
+      this.catchUp(client, lastSeq);
+    } else {
+      if (lastSeq !== undefined) {
+        this.log(`Client ${client.id} wasn't here before, ignoring lastSeq`);
+      }
+      client.resendUnacked();
+    }
+
+    if (config.motd) {
+      sendServerMessage(client, config.motd);
+    }
+    this.server.runHook("onJoin", client, this);
+  }
+
+  // Keeps a dropped client in the room without telling its peers, until it
+  // comes back or RECONNECT_GRACE_SECONDS pass
+  holdSlot(client: Client) {
+    this.log(
+      `Holding client ${client.id}'s place for ${config.reconnectGraceSeconds} seconds`,
+    );
+    client.graceTimer = setTimeout(() => {
+      client.graceTimer = undefined;
+      if (client.room === this) {
+        this.log(`Client ${client.id} didn't come back`);
+        this.removeClient(client);
+        this.forgetDeliveries(client.id);
+      }
+    }, 1000 * config.reconnectGraceSeconds);
+  }
+
+  removeClient(client: Client) {
+    this.log(`Removing client ${client.id}`, {
+      clientId: client.id,
+      event: "clientLeft",
+    });
+    clearTimeout(client.graceTimer);
+    const index = this.clients.indexOf(client);
+    if (index !== -1) {
+      this.clients.splice(index, 1);
+      client.room = undefined;
+      this.keepDeliveries(client);
+      client.deliveries = { nextSeq: 1, unacked: [] };
+    }
+
+    if (this.clients.length) {
+      this.scheduleAllClientData();
+    } else {
+      this.removeOrRetain();
+    }
+  }
+
+  // For as long as the room would be retained once empty, or the reconnect
+  // grace period if that's longer
+  private keepDeliveries(client: Client) {
+    this.forgetDeliveries(client.id);
+    const timer = setTimeout(
+      () => this.deliveries.delete(client.id),
+      1000 * Math.max(
+        60 * this.boundedRetentionMinutes(),
+        config.reconnectGraceSeconds,
+      ),
+    );
+    this.deliveries.set(client.id, { deliveries: client.deliveries, timer });
+  }
+
+  // Every client's when clientId is left out, once the room is going away
+  forgetDeliveries(clientId?: number) {
+    for (const [id, { timer }] of this.deliveries) {
+      if (clientId === undefined || id === clientId) {
+        clearTimeout(timer);
+        this.deliveries.delete(id);
+      }
+    }
+  }
+
+  // Why the client can't join, if it can't
+  joinError(client: Client) {
+    if (client.identities.some((identity) => this.kicked.has(identity))) {
+      return "You were kicked from this room";
+    }
+
+    const { gameId } = client.data;
+    if (
+      this.gameId !== undefined && typeof gameId === "string" &&
+      gameId !== this.gameId
+    ) {
+      return `This is a ${this.gameId} room, you're playing ${gameId}`;
+    }
+    const dataError = this.clientDataError(client.data);
+    if (dataError) {
+      return `Can't join this ${this.gameId} room, your ${dataError}`;
+    }
+
+    const clientVersion = client.data.clientVersion;
+    if (
+      this.minClientVersion !== undefined &&
+      (typeof clientVersion !== "string" ||
+        compareVersions(clientVersion, this.minClientVersion) < 0)
+    ) {
+      return `This room needs version ${this.minClientVersion} or newer, please update to join`;
+    }
+    if (
+      this.requiredClientVersion !== undefined &&
+      clientVersion !== this.requiredClientVersion
+    ) {
+      return `This room needs version ${this.requiredClientVersion} exactly, you have ${
+        clientVersion ?? "an unknown version"
+      }`;
+    }
+
+    // Clients that don't send a seed hash are let in, older ones can't
+    const { seedHash } = client.data;
+    if (
+      this.seedHash !== undefined && typeof seedHash === "string" &&
+      seedHash !== this.seedHash
+    ) {
+      const settings = this.settings ? ` (settings ${this.settings})` : "";
+      return `This room is playing seed ${this.seedHash}${settings} but yours is ${seedHash}, generate the room's seed to join`;
+    }
+  }
+
+  // Remembers the client's team, or puts it back on the remembered one when
+  // its data has no valid teamId, so a client resending its data without one
+  // doesn't silently end up on the default team
+  rememberTeam(client: Client) {
+    const { teamId } = client.data;
+    const previousTeamId = this.teamAssignments.get(client.id);
+    if (isValidTeamId(teamId)) {
+      this.teamAssignments.set(client.id, teamId);
+    } else if (previousTeamId !== undefined) {
+      client.data.teamId = previousTeamId;
+    }
+  }
+
+  // Whether the room matches every filter given, as sent in LIST_ROOMS
+  matchesListing(filter: RoomListingFilter) {
+    const search = filter.search?.toLowerCase();
+    return (filter.gameId === undefined || this.gameId === filter.gameId) &&
+      (filter.region === undefined || this.region === filter.region) &&
+      (filter.tags ?? []).every((tag) => this.tags.includes(tag)) &&
+      (search === undefined ||
+        [this.title, this.description].some((text) =>
+          text?.toLowerCase().includes(search)
+        ));
+  }
+
+  get game(): GameRules | undefined {
+    return this.gameId === undefined ? undefined : config.games[this.gameId];
+  }
+
+  allowsPacketType(type: string) {
+    const packetTypes = this.game?.packetTypes;
+    return !packetTypes || type in strictPacketFields ||
+      packetTypes.includes(type);
+  }
+
+  // The game's own requirements, on top of clientDataError's
+  clientDataError(data: ClientData) {
+    const missing = (this.game?.requiredClientDataFields ?? []).filter(
+      (field) => !(field in data),
+    );
+    if (missing.length) {
+      return `data is missing ${missing.join(", ")}`;
+    }
+  }
+
+  roleOf(client: Client) {
+    if (client.id === this.ownerId) {
+      return "owner";
+    }
+    return this.moderatorIds.has(client.id) ? "moderator" : undefined;
+  }
+
+  // Owners outrank moderators, who outrank everyone else
+  rank(client: Client) {
+    return client.id === this.ownerId
+      ? 2
+      : this.moderatorIds.has(client.id)
+      ? 1
+      : 0;
+  }
+
+  // Only the owner changes roles. Kicking and muting need a higher rank than
+  // the target's
+  moderate(sender: Client, packetObject: Packet) {
+    if (
+      packetObject.type !== "SET_ROLE" && packetObject.type !== "KICK" &&
+      packetObject.type !== "MUTE"
+    ) {
+      return;
+    }
+
+    const target = this.clients.find((client) =>
+      client.id === packetObject.targetClientId
+    );
+    if (!target) {
+      sendServerMessage(
+        sender,
+        `Client ${packetObject.targetClientId} is not in this room`,
+      );
+      return;
+    }
+
+    if (packetObject.type === "KICK" || packetObject.type === "MUTE") {
+      if (this.rank(sender) <= this.rank(target)) {
+        sendServerMessage(
+          sender,
+          `You can't ${packetObject.type.toLowerCase()} that client`,
+        );
+      } else if (packetObject.type === "KICK") {
+        this.kick(target, `by client ${sender.id}`);
+      } else if (!isValidMuteMinutes(packetObject.minutes)) {
+        sendServerMessage(
+          sender,
+          `Invalid minutes ${JSON.stringify(packetObject.minutes)}`,
+        );
+      } else {
+        this.log(`Client ${sender.id} muting client ${target.id}`);
+        target.mute(packetObject.minutes);
+      }
+      return;
+    }
+
+    if (sender.id !== this.ownerId || target === sender) {
+      sendServerMessage(sender, "Only the room owner can change roles");
+      return;
+    }
+    if (packetObject.role === "moderator") {
+      this.moderatorIds.add(target.id);
+    } else if (packetObject.role === "member") {
+      this.moderatorIds.delete(target.id);
+    } else {
+      sendServerMessage(sender, `Unknown role ${packetObject.role}`);
+      return;
+    }
+    this.log(
+      `Client ${sender.id} made client ${target.id} a ${packetObject.role}`,
+    );
+    this.scheduleAllClientData();
+  }
+
+  kick(client: Client, reason: string) {
+    this.log(`Kicking client ${client.id} ${reason}`);
+    for (const identity of client.identities) {
+      this.kicked.set(identity, client.id);
+    }
+    this.moderatorIds.delete(client.id);
+    sendServerMessage(client, "You were kicked from the room");
+    this.removeClient(client);
+  }
+
+  // Every player on the team sends GAME_COMPLETE, only the first one counts.
+  // Returns whether this was it
+  recordCompletion(client: Client, packetObject: Packet) {
+    const score = this.scoreOf(client.teamId);
+    if (score.completionMs !== undefined) {
+      return false;
+    }
+
+    const { teamId } = client;
+    const event = this.recordEvent(client, packetObject);
+    const elapsedMs = event.timestamp - this.createdAt;
+    score.completionMs = elapsedMs;
+    this.log(`Team ${teamId} completed in ${formatDuration(elapsedMs)}`);
+    if (elapsedMs < 1000 * config.leaderboardMinSeconds) {
+      this.log("Too fast to be a real run, not adding it to the leaderboard");
+    } else {
+      this.server.recordCompletion({
+        roomId: this.id,
+        teamId,
+        elapsedMs,
+        playerCount: this.clients.filter((c) => c.teamId === teamId).length,
+        completedAt: Date.now(),
+      });
+    }
+    this.broadcast({ type: "SCOREBOARD", teams: this.scoreboard() });
+    return true;
+  }
+
+  // Counts the packet towards the sender's team if it's a check or an item
+  recordScore(client: Client, type: string) {
+    if (config.scoreboardCheckTypes.includes(type)) {
+      this.scoreOf(client.teamId).checks++;
+    }
+    if (config.scoreboardItemTypes.includes(type)) {
+      this.scoreOf(client.teamId).items++;
+    }
+  }
+
+  scoreOf(teamId: string) {
+    let score = this.scores.get(teamId);
+    if (!score) {
+      score = { teamId, checks: 0, items: 0 };
+      this.scores.set(teamId, score);
+    }
+    return score;
+  }
+
+  // Finished teams fastest first, then the rest by checks and items. Teams
+  // with members but nothing scored yet are included
+  scoreboard(): TeamScore[] {
+    for (const client of this.clients) {
+      this.scoreOf(client.teamId);
+    }
+    return [...this.scores.values()].map((score) => ({ ...score })).sort(
+      (a, b) =>
+        (a.completionMs ?? Infinity) - (b.completionMs ?? Infinity) ||
+        b.checks - a.checks || b.items - a.items,
+    );
+  }
+
+  // Appends a number to the client's name if someone else in the room has it.
+  // The client is told, unless it was already using that name
+  assignUniqueName(client: Client, previousName?: string) {
+    const { name } = client.data;
+    if (typeof name !== "string") {
+      return;
+    }
+
+    const takenNames = new Set(
+      this.clients.filter((c) => c !== client).map((c) => c.data.name),
+    );
+    let uniqueName = name;
+    for (let i = 2; takenNames.has(uniqueName); i++) {
+      uniqueName = `${name} (${i})`;
+    }
+
+    if (uniqueName === name) {
+      return;
+    }
+
+    client.data.name = uniqueName;
+    if (uniqueName !== previousName) {
+      this.log(`Renamed client ${client.id} from ${name} to ${uniqueName}`);
+      sendServerMessage(
+        client,
+        `Someone in this room is already called ${name}, you will be shown as ${uniqueName}`,
+      );
+    }
+  }
+
+  // Bounded when used rather than at creation, so a config reload applies
+  boundedRetentionMinutes() {
+    return Math.min(
+      this.retentionMinutes ?? config.roomRetentionMinutes,
+      config.maxRoomRetentionMinutes,
+    );
+  }
+
+  // Empty rooms are only kept if they have a saved state to give late joiners
+  removeOrRetain() {
+    const roomRetentionMinutes = this.boundedRetentionMinutes();
+    if (Object.keys(this.savedStates).length && roomRetentionMinutes) {
+      this.log(
+        `No clients left, keeping saved state for ${roomRetentionMinutes} minutes`,
+      );
+      this.retentionTimer = setTimeout(() => {
+        this.log("Retention period over, archiving and removing room");
+        this.server.archiveRoom(this)
+          .catch((error) => {
+            this.logError(`Error archiving room: ${error.message}`);
+          })
+          .finally(() => {
+            // Someone may have joined while the archive was being written
+            if (this.clients.length) {
+              this.log("Client joined during archiving, keeping room");
+              return;
+            }
+            this.server.removeRoom(this);
+          });
+      }, 1000 * 60 * roomRetentionMinutes);
+    } else {
+      this.log("No clients left, removing room");
+      this.server.removeRoom(this);
+    }
+  }
+
+  // Shared by state dumps and JSON console output
+  summary() {
+    return {
+      id: this.id,
+      createdAt: this.createdAt,
+      lastActivity: this.lastActivity,
+      ownerId: this.ownerId,
+      moderatorIds: [...this.moderatorIds],
+      public: this.public,
+      teamScoped: this.teamScoped,
+      encrypted: this.encrypted,
+      gameId: this.gameId,
+      title: this.title,
+      description: this.description,
+      tags: this.tags,
+      region: this.region,
+      seedHash: this.seedHash,
+      settings: this.settings,
+      minClientVersion: this.minClientVersion,
+      requiredClientVersion: this.requiredClientVersion,
+      metadata: this.metadata,
+      recording: this.isRecording,
+      savedStates: Object.keys(this.savedStates),
+      savedStateBytes: JSON.stringify(this.savedStates).length,
+      flagMerge: this.flagMerge,
+      eventCount: this.nextEventSeq - 1,
+      flagCount: [...this.flags.values()]
+        .reduce((count, flags) => count + flags.size, 0),
+      waitingForSaveState: this.requestingStateClients.length,
+      clientIds: this.clients.map((client) => client.id),
+    };
+  }
+
+  toSnapshot(): RoomSnapshot {
+    return {
+      id: this.id,
+      createdAt: this.createdAt,
+      public: this.public,
+      metadata: this.metadata,
+      title: this.title,
+      description: this.description,
+      tags: this.tags,
+      region: this.region,
+      teamScoped: this.teamScoped,
+      encrypted: this.encrypted,
+      gameId: this.gameId,
+      retentionMinutes: this.retentionMinutes,
+      seedHash: this.seedHash,
+      settings: this.settings,
+      minClientVersion: this.minClientVersion,
+      requireMatchingVersion: this.requireMatchingVersion,
+      requiredClientVersion: this.requiredClientVersion,
+      memberIds: [...this.memberIds],
+      teamAssignments: Object.fromEntries(this.teamAssignments),
+      scores: [...this.scores.values()],
+      flags: Object.fromEntries(
+        [...this.flags].map(([key, flags]) => [key, Object.fromEntries(flags)]),
+      ),
+      events: this.events,
+      savedStates: this.savedStates,
+      eventIds: [...this.eventIds],
+    };
+  }
+
+  // Options are applied by the constructor, this restores the rest
+  restore(snapshot: RoomSnapshot) {
+    this.createdAt = snapshot.createdAt ?? this.createdAt;
+    this.seedHash = snapshot.seedHash;
+    this.settings = snapshot.settings;
+    this.requiredClientVersion = snapshot.requiredClientVersion;
+    this.memberIds = new Set(snapshot.memberIds);
+    const teamAssignments = Object.entries(snapshot.teamAssignments ?? {});
+    this.teamAssignments = new Map(
+      teamAssignments.map(([clientId, teamId]) => [Number(clientId), teamId]),
+    );
+    this.scores = new Map(
+      (snapshot.scores ?? []).map((score) => [score.teamId, score]),
+    );
+    const flags = Object.entries(snapshot.flags ?? {});
+    this.flags = new Map(
+      flags.map(([key, values]) => [key, new Map(Object.entries(values))]),
+    );
+    this.events = snapshot.events ?? [];
+    this.nextEventSeq = (this.events.at(-1)?.seq ?? 0) + 1;
+    this.savedStates = snapshot.savedStates;
+    this.eventIds = new Set(snapshot.eventIds);
+
+    if (!this.clients.length) {
+      this.removeOrRetain();
+    }
+  }
+
+  // Returns the path of the recording file
+  startRecording() {
+    Deno.mkdirSync(config.recordingsDir, { recursive: true });
+    const path = `${config.recordingsDir}/${
+      `${this.id}-${new Date().toISOString()}`.replace(/[^\w.-]/g, "-")
+    }.jsonl`;
+    this.recording = Deno.openSync(path, { create: true, append: true });
+    this.log(`Recording packets to ${path}`);
+    return path;
+  }
+
+  stopRecording() {
+    if (!this.recording) {
+      return;
+    }
+
+    try {
+      this.recording.close();
+    } catch (error) {
+      this.logError(`Error closing recording: ${error.message}`);
+    }
+    this.recording = undefined;
+    this.log("Stopped recording packets");
+  }
+
+  get isRecording() {
+    return !!this.recording;
+  }
+
+  capturePacket(direction: "in" | "out", client: Client, packetObject: Packet) {
+    if (!this.recording) {
+      return;
+    }
+
+    try {
+      const line = JSON.stringify({
+        timestamp: Date.now(),
+        direction,
+        roomId: this.id,
+        clientId: client.id,
+        packet: packetObject,
+      });
+      writeAllSync(this.recording, encoder.encode(line + "\n"));
+    } catch (error) {
+      this.logError(`Error recording packet: ${error.message}`);
+      this.stopRecording();
+    }
+  }
+
+  // Returns false if the event id has already been seen recently
+  trackEventId(eventId: string) {
+    if (this.eventIds.has(eventId)) {
+      return false;
+    }
+
+    this.eventIds.add(eventId);
+    if (this.eventIds.size > maxTrackedEventIds) {
+      this.eventIds.delete(this.eventIds.values().next().value);
+    }
+    return true;
+  }
+
+  // Teams don't share save state in team scoped rooms
+  saveStateKey(client: Client) {
+    return this.teamScoped ? client.teamId : defaultTeamId;
+  }
+
+  // Ask one client per saveStateKey for its state, the replies are only stored
+  requestSaveStateSnapshot() {
+    const requestedKeys = new Set<string>();
+    for (const client of this.clients) {
+      const key = this.saveStateKey(client);
+      if (requestedKeys.has(key)) {
+        continue;
+      }
+
+      requestedKeys.add(key);
+      client.sendPacket({
+        type: "REQUEST_SAVE_STATE",
+        roomId: this.id,
+        quiet: true,
+      });
+    }
+  }
+
+  // Merges the sender's flags into the room's, relays those that changed to
+  // its peers and corrects the sender where the merged value differs
+  mergeFlags(packetObject: Packet, sender: Client) {
+    if (packetObject.type !== "UPDATE_FLAGS") {
+      return;
+    }
+
+    const key = this.saveStateKey(sender);
+    let flags = this.flags.get(key);
+    if (!flags) {
+      flags = new Map();
+      this.flags.set(key, flags);
+    }
+
+    // Not checked outside of strict mode
+    const sent = typeof packetObject.flags === "object" && packetObject.flags
+      ? Object.entries(packetObject.flags)
+      : [];
+    const changed: Record<string, FlagValue> = {};
+    const corrections: Record<string, FlagValue> = {};
+    for (const [flag, value] of sent) {
+      if (!["boolean", "number", "string"].includes(typeof value)) {
+        continue;
+      }
+      const previous = flags.get(flag);
+      if (previous === undefined && flags.size >= maxRoomFlags) {
+        this.log(`Too many flags, ignoring ${flag}`);
+        continue;
+      }
+
+      const merged = this.flagMerge === "union" && previous !== undefined
+        ? unionFlag(previous, value)
+        : value;
+      if (merged !== previous) {
+        flags.set(flag, merged);
+        changed[flag] = merged;
+      }
+      if (merged !== value) {
+        corrections[flag] = merged;
+      }
+    }
+
+    if (Object.keys(corrections).length) {
+      sender.sendPacket({
+        type: "UPDATE_FLAGS",
+        roomId: this.id,
+        flags: corrections,
+      });
+    }
+    if (Object.keys(changed).length) {
+      packetObject.flags = changed;
+      this.recordEvent(sender, packetObject);
+      this.broadcastPacket(packetObject, sender);
+    }
+  }
+
+  // Numbers the packet with its seq, which peers receive it with, and appends
+  // a copy to the event log
+  recordEvent(sender: Client, packetObject: Packet): RoomEvent {
+    packetObject.seq = this.nextEventSeq++;
+    const event: RoomEvent = {
+      seq: packetObject.seq,
+      timestamp: Date.now(),
+      clientId: sender.id,
+      teamId: sender.teamId,
+      // Client data keeps changing after it's sent
+      packet: structuredClone(packetObject),
+    };
+    this.events.push(event);
+    if (this.events.length > config.roomEventLogSize) {
+      this.events.splice(0, this.events.length - config.roomEventLogSize);
+    }
+
+    if (config.eventLogDir) {
+      this.appendEventLog(encoder.encode(JSON.stringify(event) + "\n"));
+    }
+    return event;
+  }
+
+  private appendEventLog(line: Uint8Array) {
+    this.eventLogWriting = this.eventLogWriting.then(async () => {
+      if (!this.eventLog) {
+        await Deno.mkdir(config.eventLogDir!, { recursive: true });
+        this.eventLog = await Deno.open(
+          `${config.eventLogDir}/${this.id.replace(/[^\w.-]/g, "-")}.jsonl`,
+          { create: true, append: true },
+        );
+      }
+      await writeAll(this.eventLog, line);
+    }).catch((error) => {
+      this.logError(`Error writing event log: ${error.message}`);
+      // Reopened by the next event, in case the file was moved or deleted
+      this.closeEventLogFile();
+    });
+  }
+
+  // Resolves once events recorded so far are written
+  closeEventLog() {
+    this.eventLogWriting = this.eventLogWriting.then(() => {
+      this.closeEventLogFile();
+    });
+    return this.eventLogWriting;
+  }
+
+  private closeEventLogFile() {
+    try {
+      this.eventLog?.close();
+    } catch (error) {
+      this.logError(`Error closing event log: ${error.message}`);
+    }
+    this.eventLog = undefined;
+  }
+
+  // Forgets the client, see Server.purgeClient. Returns whether it was here
+  purgeClient(clientId: number) {
+    for (const client of this.clients.filter((c) => c.id === clientId)) {
+      this.removeClient(client);
+    }
+    this.forgetDeliveries(clientId);
+    const snapshot = this.toSnapshot();
+    const found = purgeSnapshot(snapshot, clientId) ||
+      this.ownerId === clientId || this.moderatorIds.has(clientId) ||
+      [...this.kicked.values()].includes(clientId);
+
+    this.memberIds.delete(clientId);
+    this.teamAssignments.delete(clientId);
+    this.events = snapshot.events ?? [];
+    if (this.ownerId === clientId) {
+      this.ownerId = undefined;
+    }
+    this.moderatorIds.delete(clientId);
+    for (const [identity, kickedId] of this.kicked) {
+      if (kickedId === clientId) {
+        this.kicked.delete(identity);
+      }
+    }
+    return found;
+  }
+
+  // Resends the events after lastSeq that the client would have received.
+  // Client data and flags aren't, the client was just sent the latest of both.
+  // Events already dropped from the log are lost, the client is told so
+  catchUp(client: Client, lastSeq: number) {
+    const missed = this.events.filter(({ seq, clientId, teamId, packet }) =>
+      seq > lastSeq && clientId !== client.id &&
+      !["UPDATE_CLIENT_DATA", "CHANGE_TEAM", "UPDATE_FLAGS"].includes(
+        packet.type,
+      ) &&
+      (packet.targetClientId
+        ? packet.targetClientId === client.id
+        : !this.teamScoped || teamId === client.teamId)
+    );
+    const oldestSeq = this.events[0]?.seq ?? this.nextEventSeq;
+    this.log(
+      `Resending ${missed.length} events after ${lastSeq} to client ${client.id}`,
+    );
+    // Unacknowledged copies of those events are sent again below under new
+    // deliverySeqs, and ones up to lastSeq already arrived
+    const replayed = new Set(missed.map(({ seq }) => seq));
+    client.resendUnacked(({ seq }) =>
+      seq !== undefined && (seq <= lastSeq || replayed.has(seq))
+    );
+    if (oldestSeq > lastSeq + 1) {
+      sendServerMessage(
+        client,
+        `Events ${lastSeq + 1} to ${
+          oldestSeq - 1
+        } were too long ago to resend, some progress may be missing`,
+      );
+    }
+    for (const { packet } of missed) {
+      client.sendPacket(packet);
+    }
+  }
+
+  // Replays the event log into fresh teams, scores and flags, replacing the
+  // live ones. Returns which of them the replay disagreed with, a desync
+  // between the log and what the room did. Throws if the log no longer starts
+  // at the room's first event
+  rebuild() {
+    if (this.nextEventSeq > 1 && this.events[0]?.seq !== 1) {
+      throw new Error(
+        "The oldest events were dropped, raise ROOM_EVENT_LOG_SIZE",
+      );
+    }
+
+    const teamAssignments = new Map<number, string>();
+    const scores = new Map<string, TeamScore>();
+    const flags = new Map<string, Map<string, FlagValue>>();
+    const scoreOf = (teamId: string) => {
+      let score = scores.get(teamId);
+      if (!score) {
+        score = { teamId, checks: 0, items: 0 };
+        scores.set(teamId, score);
+      }
+      return score;
+    };
+
+    for (const { packet, clientId, teamId, timestamp } of this.events) {
+      if (packet.type === "UPDATE_CLIENT_DATA") {
+        if (isValidTeamId(packet.data.teamId)) {
+          teamAssignments.set(clientId, packet.data.teamId);
+        }
+      } else if (packet.type === "CHANGE_TEAM") {
+        teamAssignments.set(clientId, packet.teamId);
+      } else if (packet.type === "UPDATE_FLAGS") {
+        const key = this.teamScoped ? teamId : defaultTeamId;
+        if (!flags.has(key)) {
+          flags.set(key, new Map());
+        }
+        for (const [flag, value] of Object.entries(packet.flags)) {
+          flags.get(key)!.set(flag, value);
+        }
+      } else if (packet.type === "GAME_COMPLETE") {
+        scoreOf(teamId).completionMs = timestamp - this.createdAt;
+      } else {
+        if (config.scoreboardCheckTypes.includes(packet.type)) {
+          scoreOf(teamId).checks++;
+        }
+        if (config.scoreboardItemTypes.includes(packet.type)) {
+          scoreOf(teamId).items++;
+        }
+      }
+    }
+
+    const mismatches = [];
+    if (stableJson(teamAssignments) !== stableJson(this.teamAssignments)) {
+      mismatches.push("teams");
+    }
+    // Teams that haven't scored yet are only on the live scoreboard
+    const scored = (score: TeamScore) =>
+      score.checks || score.items || score.completionMs !== undefined;
+    if (
+      stableJson([...scores.values()].filter(scored)) !==
+        stableJson([...this.scores.values()].filter(scored))
+    ) {
+      mismatches.push("scores");
+    }
+    if (stableJson(flags) !== stableJson(this.flags)) {
+      mismatches.push("flags");
+    }
+
+    this.teamAssignments = teamAssignments;
+    this.scores = scores;
+    this.flags = flags;
+    return mismatches;
+  }
+
+  // Bursts of joins and leaves, e.g. everyone reconnecting after a restart,
+  // would otherwise send the whole room's data once per client. Changes here,
+  // rather than on another instance, are shared with the cluster too
+  scheduleAllClientData(local = true) {
+    this.membersChanged ||= local;
+    if (this.allClientDataTimer !== undefined) {
+      return;
+    }
+
+    this.allClientDataTimer = setTimeout(() => {
+      this.allClientDataTimer = undefined;
+      if (this.membersChanged) {
+        this.shareMembers();
+      }
+      this.broadcastAllClientData();
+    }, allClientDataDebounceMs);
+  }
+
+  // As peers see the client in ALL_CLIENT_DATA
+  memberData(client: Client): ClientData {
+    return {
+      clientId: client.id,
+      ...client.data,
+      // After data, so a client can't claim someone else's account or role
+      accountId: client.accountId,
+      role: this.roleOf(client),
+    };
+  }
+
+  // Everyone's data to each client matching the filter, all of them by default
+  broadcastAllClientData(filter: BroadcastFilter = {}) {
+    this.logVerbose("<- ALL_CLIENT_DATA packet", { event: "broadcast" });
+    traced("broadcastAllClientData", this.spanAttributes(), () => {
+      for (const client of this.recipients(filter)) {
+        const packetObject = {
+          type: "ALL_CLIENT_DATA" as const,
+          roomId: this.id,
+          clients: [
+            ...this.clients.filter((c) => c !== client)
+              .map((c) => this.memberData(c)),
+            ...[...this.remoteMembers.values()].flatMap((m) => m.clients),
+          ],
+        };
+
+        client.sendPacket(packetObject);
+      }
+    });
+  }
+
+  // Clients matching every given filter
+  recipients(filter: BroadcastFilter) {
+    return this.clients.filter((client) =>
+      client !== filter.exclude &&
+      (filter.teamId === undefined || client.teamId === filter.teamId) &&
+      (!filter.online || client.connected) &&
+      (!filter.where || filter.where(client))
+    );
+  }
+
+  // Returns the clients the packet was sent to
+  broadcast(packetObject: Packet, filter: BroadcastFilter = {}) {
+    return traced("broadcast", this.spanAttributes(packetObject), (span) => {
+      const recipients = this.recipients(filter);
+      span.setAttribute("anchor.recipients", recipients.length);
+      for (const client of recipients) {
+        client.sendPacket(packetObject);
+      }
+      // Held clients aren't sent anything, but keep what they'd have to ACK
+      // to resend once they're back
+      if (filter.online && config.ackedPacketTypes.includes(packetObject.type)) {
+        this.recipients({ ...filter, online: false })
+          .filter((client) => !client.connected)
+          .forEach((client) => client.sendPacket(packetObject));
+      }
+      return recipients;
+    });
+  }
+
+  spanAttributes(packetObject?: Packet): Attributes {
+    return {
+      "anchor.room.id": this.id,
+      "anchor.room.clients": this.clients.length,
+      ...(packetObject && { "anchor.packet.type": packetObject.type }),
+    };
+  }
+
+  // Relays to the sender's peers, see peersOf
+  broadcastPacket(packetObject: Packet, sender: Client) {
+    if (!packetObject.quiet) {
+      this.logVerbose(`<- ${packetObject.type} packet from ${sender.id}`, {
+        clientId: sender.id,
+        event: "broadcast",
+      });
+    }
+
+    this.broadcast(packetObject, this.peerFilter(sender));
+    this.shareWithCluster(packetObject, this.peerFilter(sender).teamId);
+  }
+
+  // Peers that opted into deltas only get the fields that changed, and
+  // nothing at all when none did
+  broadcastClientData(
+    packetObject: Packet,
+    sender: Client,
+    delta: ClientDataDelta,
+  ) {
+    if (!packetObject.quiet) {
+      this.logVerbose(`<- ${packetObject.type} packet from ${sender.id}`, {
+        clientId: sender.id,
+        event: "broadcast",
+      });
+    }
+
+    const unchanged = !Object.keys(delta.changed).length &&
+      !delta.removed.length;
+    traced("broadcastClientData", this.spanAttributes(packetObject), () => {
+      for (const client of this.peersOf(sender)) {
+        if (!client.acceptsDeltas) {
+          client.sendPacket(packetObject);
+        } else if (!unchanged) {
+          client.sendPacket({
+            type: "CLIENT_DATA_DELTA",
+            roomId: this.id,
+            clientId: sender.id,
+            quiet: packetObject.quiet,
+            ...delta,
+          });
+        }
+      }
+    });
+    // Other instances get the whole update, they don't have the previous data
+    // to compare against
+    this.shareWithCluster(packetObject, this.peerFilter(sender).teamId);
+  }
+
+  // Clients that packets relayed from the given client are sent to
+  peersOf(sender: Client) {
+    return this.recipients(this.peerFilter(sender));
+  }
+
+  peerFilter(sender: Client): BroadcastFilter {
+    return {
+      exclude: sender,
+      teamId: this.teamScoped ? sender.teamId : undefined,
+      online: true,
+    };
+  }
+
+  broadcastTeamPacket(packetObject: Packet, sender: Client) {
+    if (!packetObject.quiet) {
+      this.logVerbose(
+        `<- ${packetObject.type} packet from ${sender.id} to team ${sender.teamId}`,
+        { clientId: sender.id, event: "broadcast" },
+      );
+    }
+
+    this.broadcast(packetObject, {
+      exclude: sender,
+      teamId: sender.teamId,
+      online: true,
+      where: packetObject.type === "TEAM_CHAT"
+        ? (client) => client.acceptsChat
+        : undefined,
+    });
+    this.shareWithCluster(packetObject, sender.teamId);
+  }
+
+  // Relayed to the room's clients on other instances, only to teamId's if
+  // given and over UDP to those that can if unreliable
+  shareWithCluster(packetObject: Packet, teamId?: string, unreliable = false) {
+    this.server.cluster?.publish(this.id, {
+      packet: packetObject,
+      teamId,
+      unreliable: unreliable || undefined,
+    });
+  }
+
+  shareMembers() {
+    this.membersChanged = false;
+    this.server.cluster?.publish(this.id, {
+      members: this.clients.map((client) => this.memberData(client)),
+    });
+  }
+
+  // Stops relaying to and from other instances, which drop this one's members
+  // from the room right away rather than once they stop hearing from it
+  leaveCluster() {
+    this.server.cluster?.publish(this.id, { members: [] });
+    return this.server.cluster?.leaveRoom(this.id).catch((error) => {
+      this.logError(`Error leaving room on Redis: ${error.message}`);
+    });
+  }
+
+  // Whether the packet's target is on another instance
+  hasRemoteMember(packetObject: Packet) {
+    return [...this.remoteMembers.values()].some(({ clients }) =>
+      clients.some((c) => c.clientId === packetObject.targetClientId)
+    );
+  }
+
+  // Whether the client has peers on other instances, see peersOf
+  hasRemotePeers(client: Client) {
+    return [...this.remoteMembers.values()].some(({ clients }) =>
+      clients.some((c) =>
+        !this.teamScoped ||
+        (typeof c.teamId === "string" ? c.teamId : defaultTeamId) ===
+          client.teamId
+      )
+    );
+  }
+
+  // Members of instances that stopped sharing them, e.g. because they crashed
+  pruneRemoteMembers(maxAgeMs: number) {
+    for (const [instanceId, { receivedAt }] of this.remoteMembers) {
+      if (Date.now() - receivedAt > maxAgeMs) {
+        this.log(`Instance ${instanceId} went quiet, dropping its members`);
+        this.remoteMembers.delete(instanceId);
+        this.scheduleAllClientData(false);
+      }
+    }
+  }
+
+  // From another instance with clients in the room, see cluster.ts
+  handleClusterMessage(message: RoomMessage) {
+    const { instanceId, packet, teamId, members, savedState } = message;
+    if (members) {
+      // An instance new to the room hasn't heard about this one's members yet
+      const joined = !this.remoteMembers.has(instanceId);
+      if (members.length) {
+        this.remoteMembers.set(instanceId, {
+          clients: members,
+          receivedAt: Date.now(),
+        });
+      } else {
+        this.remoteMembers.delete(instanceId);
+      }
+      this.scheduleAllClientData(joined && members.length > 0);
+      return;
+    }
+
+    if (savedState && typeof message.saveStateKey === "string") {
+      const { saveStateKey } = message;
+      this.savedStates[saveStateKey] = savedState;
+      this.requestingStateClients = this.requestingStateClients
+        .filter((client) => {
+          if (this.saveStateKey(client) !== saveStateKey) {
+            return true;
+          }
+          client.sendPacket(savedState);
+          return false;
+        });
+      return;
+    }
+
+    if (!packet || typeof packet.type !== "string") {
+      return;
+    }
+    // Numbered by the sending instance, whose event log it's in
+    delete packet.seq;
+    delete packet.deliverySeq;
+    this.lastActivity = Date.now();
+    if (packet.type === "UPDATE_CLIENT_DATA") {
+      const member = this.remoteMembers.get(instanceId)?.clients
+        .find((c) => c.clientId === packet.clientId);
+      if (member) {
+        const { clientId, accountId, role } = member;
+        Object.keys(member).forEach((key) => delete member[key]);
+        Object.assign(member, packet.data, { clientId, accountId, role });
+      }
+    }
+    // Already merged by the sending instance
+    if (packet.type === "UPDATE_FLAGS") {
+      const key = teamId ?? defaultTeamId;
+      const flags = this.flags.get(key) ?? new Map<string, FlagValue>();
+      this.flags.set(key, flags);
+      for (const [flag, value] of Object.entries(packet.flags ?? {})) {
+        flags.set(flag, value);
+      }
+    }
+
+    const chat = packet.type === "TEAM_CHAT" || packet.type === "WHISPER";
+    const filter: BroadcastFilter = {
+      teamId,
+      online: true,
+      where: (client) =>
+        (packet.targetClientId === undefined ||
+          client.id === packet.targetClientId) &&
+        (!chat || client.acceptsChat),
+    };
+    if (message.unreliable) {
+      this.recipients(filter).forEach((client) => {
+        client.sendUnreliable(packet);
+      });
+    } else {
+      this.broadcast(packet, filter);
+    }
+  }
+
+  // Every message about the room or its clients, even in quiet mode, appended
+  // to a file so organisers can archive what happened in their room
+  startLog() {
+    Deno.mkdirSync(config.roomLogsDir, { recursive: true });
+    const path = `${config.roomLogsDir}/${
+      this.id.replace(/[^\w.-]/g, "-")
+    }.log`;
+    this.logFile = Deno.openSync(path, { create: true, append: true });
+    this.log(`Logging to ${path}`);
+    return path;
+  }
+
+  stopLog() {
+    if (!this.logFile) {
+      return;
+    }
+
+    this.log("Stopped logging to file");
+    try {
+      this.logFile.close();
+    } catch (error) {
+      this.logError(`Error closing log file: ${error.message}`);
+    }
+    this.logFile = undefined;
+  }
+
+  get isLogging() {
+    return !!this.logFile;
+  }
+
+  writeLogFile(
+    level: LogLevel,
+    message: string,
+    fields: LogFields,
+    source: string,
+  ) {
+    if (!this.logFile) {
+      return;
+    }
+
+    try {
+      const line = formatLog(level, message, fields, source, true);
+      writeAllSync(this.logFile, encoder.encode(line + "\n"));
+    } catch (error) {
+      // Unset first, so logging the error doesn't try the file again
+      const { logFile } = this;
+      this.logFile = undefined;
+      this.logError(`Error writing log file: ${error.message}`);
+      try {
+        logFile.close();
+      } catch (_) {
+        // Already unusable
+      }
+    }
+  }
+
+  log(message: string, fields: Omit<LogFields, "roomId"> = {}) {
+    this.logAt("info", message, fields);
+  }
+
+  logError(message: string, fields: Omit<LogFields, "roomId"> = {}) {
+    this.logAt("error", message, fields);
+  }
+
+  private logAt(
+    level: LogLevel,
+    message: string,
+    fields: Omit<LogFields, "roomId">,
+  ) {
+    const source = `Room ${this.id}`;
+    writeLog(level, message, { roomId: this.id, ...fields }, source);
+    this.writeLogFile(level, message, { roomId: this.id, ...fields }, source);
+  }
+
+  // Left out of the console in quiet mode, but still in the room's log file
+  logVerbose(message: string, fields: Omit<LogFields, "roomId"> = {}) {
+    if (!quietMode) {
+      this.log(message, fields);
+    } else {
+      this.writeLogFile(
+        "info",
+        message,
+        { roomId: this.id, ...fields },
+        `Room ${this.id}`,
+      );
+    }
+  }
+}
+
+function bindListener(address: ListenAddress): Listener {
+  const { transport, hostname, port } = address;
+  if (transport === "tcp") {
+    return Deno.listen({ hostname, port });
+  }
+
+  if (transport === "ws") {
+    return listenWebSocket({ hostname, port });
+  }
+
+  // Read on each bind, so rebinding picks up a renewed certificate
+  const cert = Deno.readTextFileSync(config.tlsCertPath);
+  const key = Deno.readTextFileSync(config.tlsKeyPath);
+  return transport === "tls"
+    ? Deno.listenTls({ hostname, port, cert, key })
+    : listenWebSocket({ hostname, port, cert, key });
+}
+
+// Doubling with each failure in a row, up to 32 times acceptRetryMs
+function acceptRetryDelayMs(failures: number) {
+  return acceptRetryMs * 2 ** Math.min(failures - 1, 5);
+}
+
+// Unix sockets and embedders' own connections don't have these options
+function applyTcpOptions(connection: Connection) {
+  if (!("setNoDelay" in connection)) {
+    return;
+  }
+
+  const tcpConnection = connection as Deno.TcpConn;
+  if (config.tcpNoDelay) {
+    tcpConnection.setNoDelay(true);
+  }
+  if (config.tcpKeepAlive) {
+    tcpConnection.setKeepAlive(true);
+  }
+}
+
+// Runs fn in a span, ended once fn returns or its promise settles
+function traced<T>(
+  name: string,
+  attributes: Attributes,
+  fn: (span: Span) => T,
+): T {
+  if (!tracer) {
+    return fn(noopSpan);
+  }
+  return tracer.startActiveSpan(name, { attributes }, (span) => {
+    let result: T;
+    try {
+      result = fn(span);
+    } catch (error) {
+      span.end();
+      throw error;
+    }
+    if (result instanceof Promise) {
+      return result.finally(() => span.end()) as T;
+    }
+    span.end();
+    return result;
+  });
+}
+
+// stats.json may be a symlink, e.g. into a volume, and the temporary file used
+// for saving has to be created next to the real file
+async function resolveSymlink(path: string) {
+  try {
+    const info = await Deno.lstat(path);
+    if (info.isSymlink) {
+      return resolve(dirname(path), await Deno.readLink(path));
+    }
+  } catch (_) {
+    // Doesn't exist yet
+  }
+  return path;
+}
+
+// Paths of the files in dir with the extension, none if it doesn't exist
+async function listFiles(dir: string, extension: string) {
+  const paths: string[] = [];
+  try {
+    for await (const entry of Deno.readDir(dir)) {
+      if (entry.isFile && entry.name.endsWith(extension)) {
+        paths.push(join(dir, entry.name));
+      }
+    }
+  } catch (error) {
+    if (!(error instanceof Deno.errors.NotFound)) {
+      throw error;
+    }
+  }
+  return paths;
+}
+
+// An event log or recording line without the client in it, null when it's
+// from or to the client
+function purgeRecord<T extends { clientId?: number; packet?: Packet }>(
+  record: T,
+  clientId: number,
+): T | null {
+  const { packet } = record;
+  if (
+    record.clientId === clientId || packet?.clientId === clientId ||
+    packet?.targetClientId === clientId
+  ) {
+    return null;
+  }
+  if (packet?.type === "ALL_CLIENT_DATA") {
+    packet.clients = packet.clients.filter((c) => c.clientId !== clientId);
+  }
+  return record;
+}
+
+// Returns whether the client's install UUID was in the stats
+function purgeStats(stats: ServerStats, clientId: number) {
+  let found = false;
+  for (const [clientUuid, id] of Object.entries(stats.clientUuids ?? {})) {
+    if (id === clientId) {
+      delete stats.clientUuids[clientUuid];
+      delete stats.clientUuidLastSeen?.[clientUuid];
+      found = true;
+    }
+  }
+  return found;
+}
+
+// Returns whether the client was in the dump
+function purgeDump(
+  dump: {
+    clients?: { id: number }[];
+    rooms?: {
+      ownerId?: number;
+      moderatorIds?: number[];
+      clientIds?: number[];
+    }[];
+  },
+  clientId: number,
+) {
+  const before = JSON.stringify(dump);
+  dump.clients = dump.clients?.filter((client) => client.id !== clientId);
+  for (const room of dump.rooms ?? []) {
+    if (room.ownerId === clientId) {
+      delete room.ownerId;
+    }
+    room.moderatorIds = room.moderatorIds?.filter((id) => id !== clientId);
+    room.clientIds = room.clientIds?.filter((id) => id !== clientId);
+  }
+  return JSON.stringify(dump) !== before;
+}
+
+// Replaces the clientIds that are keys of remap everywhere in the snapshot
+function remapSnapshot(snapshot: RoomSnapshot, remap: Map<number, number>) {
+  const remapped = (id: number) => remap.get(id) ?? id;
+  snapshot.memberIds = snapshot.memberIds?.map(remapped);
+  snapshot.teamAssignments = Object.fromEntries(
+    Object.entries(snapshot.teamAssignments ?? {})
+      .map(([id, teamId]) => [remapped(Number(id)), teamId]),
+  );
+  const packets = [
+    ...(snapshot.events ?? []).map((event) => {
+      event.clientId = remapped(event.clientId);
+      return event.packet;
+    }),
+    ...Object.values(snapshot.savedStates ?? {}),
+  ];
+  for (const packet of packets) {
+    if (packet.clientId !== undefined) {
+      packet.clientId = remapped(packet.clientId);
+    }
+    if (packet.targetClientId !== undefined) {
+      packet.targetClientId = remapped(packet.targetClientId);
+    }
+    if (packet.type === "ALL_CLIENT_DATA") {
+      for (const client of packet.clients) {
+        if (client.clientId !== undefined) {
+          client.clientId = remapped(client.clientId);
+        }
+      }
+    }
+  }
+}
+
+// Returns whether the client was in the snapshot
+function purgeSnapshot(snapshot: RoomSnapshot, clientId: number) {
+  const before = JSON.stringify(snapshot);
+  snapshot.memberIds = snapshot.memberIds?.filter((id) => id !== clientId);
+  delete snapshot.teamAssignments?.[clientId];
+  snapshot.events = snapshot.events?.filter((event) =>
+    purgeRecord(event, clientId)
+  );
+  // The save state belongs to the whole room or team, only its sender is
+  // forgotten
+  for (const state of Object.values(snapshot.savedStates)) {
+    if (state.clientId === clientId) {
+      delete state.clientId;
+    }
+  }
+  return JSON.stringify(snapshot) !== before;
+}
+
+// Newest first, the timestamps in the names sort chronologically
+async function listStatsBackups(path: string) {
+  const prefix = `${basename(path)}.`;
+  const backups: string[] = [];
+  try {
+    for await (const entry of Deno.readDir(dirname(path))) {
+      if (entry.name.startsWith(prefix) && entry.name.endsWith(".bak")) {
+        backups.push(join(dirname(path), entry.name));
+      }
+    }
+  } catch (error) {
+    writeLog("error", `Error listing stats backups: ${error.message}`);
+  }
+  return backups.sort().reverse();
+}
+
+// Dotted numbers like 8.0.10, anything after the numbers (like -rc1) is
+// ignored. Negative when a is older than b
+function compareVersions(a: string, b: string) {
+  const parse = (version: string) =>
+    (version.match(/^v?(\d+(\.\d+)*)/)?.[1] ?? "0").split(".").map(Number);
+  const [partsA, partsB] = [parse(a), parse(b)];
+  for (let i = 0; i < Math.max(partsA.length, partsB.length); i++) {
+    const difference = (partsA[i] ?? 0) - (partsB[i] ?? 0);
+    if (difference) {
+      return difference;
+    }
+  }
+  return 0;
+}
+
+// Why the client can't use this server at all, if it can't
+function clientVersionError(data: ClientData) {
+  const { clientVersion } = data;
+  if (
+    config.minClientVersion !== undefined &&
+    (typeof clientVersion !== "string" ||
+      compareVersions(clientVersion, config.minClientVersion) < 0)
+  ) {
+    return `This server needs version ${config.minClientVersion} or newer, you have ${
+      typeof clientVersion === "string" ? clientVersion : "an older version"
+    }. Please update and reconnect`;
+  }
+}
+
+// Returns why client data should be rejected, if it should be
+function clientDataError(data: unknown): string | undefined {
+  if (typeof data !== "object" || data === null || Array.isArray(data)) {
+    return "data is not an object";
+  }
+
+  const size = encoder.encode(JSON.stringify(data)).length;
+  if (size > config.maxClientDataSize) {
+    return `data is ${size} bytes, the limit is ${config.maxClientDataSize}`;
+  }
+
+  const missing = config.requiredClientDataFields.filter((field) =>
+    !(field in data)
+  );
+  if (missing.length) {
+    return `data is missing ${missing.join(", ")}`;
+  }
+}
+
+// Packets with the same key carry the full latest state of something, so an
+// older one still waiting to be sent can be dropped. Deltas and packets with an
+// eventId must all arrive, so they never have one
+function supersedeKey(packetObject: Packet) {
+  if (packetObject.eventId !== undefined) {
+    return;
+  }
+
+  switch (packetObject.type) {
+    case "ALL_CLIENT_DATA":
+      return packetObject.type;
+    case "UPDATE_CLIENT_DATA":
+    case "CLIENT_RTT":
+      return `${packetObject.type}:${packetObject.clientId}`;
+  }
+  if (config.supersededPacketTypes.includes(packetObject.type)) {
+    return `${packetObject.type}:${packetObject.clientId}`;
+  }
+}
+
+// Whether everything but the routing fields is in an encryptPacket payload.
+// Packets the server has to read are always allowed through
+function isSealed(packetObject: Packet) {
+  if (readableTypes.includes(packetObject.type)) {
+    return true;
+  }
+
+  return typeof (packetObject as GamePacket).payload === "string" &&
+    Object.keys(packetObject).every((field) =>
+      field === "payload" || routingFields.includes(field)
+    );
+}
+
+interface ClientDataDelta {
+  changed: ClientData;
+  removed: string[];
+}
+
+// Top level fields only, nested objects are resent whole when anything in
+// them changes
+function clientDataDelta(previous: ClientData, next: ClientData) {
+  const delta: ClientDataDelta = { changed: {}, removed: [] };
+  for (const [field, value] of Object.entries(next)) {
+    if (JSON.stringify(value) !== JSON.stringify(previous[field])) {
+      delta.changed[field] = value;
+    }
+  }
+  delta.removed = Object.keys(previous).filter((field) => !(field in next));
+  return delta;
+}
+
+type FieldType = "string" | "number" | "boolean" | "object" | "string[]";
+
+// Fields any packet may carry, all optional
+const strictBaseFields: Record<string, FieldType> = {
+  type: "string",
+  clientId: "number",
+  roomId: "string",
+  roomOptions: "object",
+  quickJoin: "boolean",
+  eventId: "string",
+  quiet: "boolean",
+  targetClientId: "number",
+  seq: "number",
+};
+
+const strictRoomOptionFields: Record<string, FieldType> = {
+  public: "boolean",
+  metadata: "object",
+  title: "string",
+  description: "string",
+  tags: "string[]",
+  region: "string",
+  teamScoped: "boolean",
+  retentionMinutes: "number",
+  encrypted: "boolean",
+  gameId: "string",
+  minClientVersion: "string",
+  requireMatchingVersion: "boolean",
+  flagMerge: "string",
+};
+
+// Types named by the protocol or the config. Anything else a client makes up is
+// counted as "other" in packetStats, so it can't grow without bound
+function isKnownPacketType(type: string) {
+  return type in strictPacketFields || readableTypes.includes(type) || [
+    config.strictAllowedTypes,
+    config.scoreboardCheckTypes,
+    config.scoreboardItemTypes,
+    config.supersededPacketTypes,
+    config.ackedPacketTypes,
+    ...Object.values(config.games).map((rules) => rules.packetTypes ?? []),
+  ].some((types) => types.includes(type));
+}
+
+// Required fields of the packets the server handles itself. null means the
+// payload belongs to the game and only the base fields are checked
+const strictPacketFields: Record<string, Record<string, FieldType> | null> = {
+  UPDATE_CLIENT_DATA: { data: "object" },
+  UPDATE_FLAGS: { flags: "object" },
+  TEAM_CHAT: { message: "string" },
+  WHISPER: { targetClientId: "number", message: "string" },
+  CHANGE_TEAM: { teamId: "string" },
+  LIST_ROOMS: {},
+  PING: {},
+  PONG: {},
+  REQUEST_SAVE_STATE: {},
+  REQUEST_SCOREBOARD: {},
+  REQUEST_SERVER_INFO: {},
+  REQUEST_UDP: {},
+  HANDSHAKE: { capabilities: "string[]" },
+  ACK: { deliverySeq: "number" },
+  SET_ROLE: { targetClientId: "number", role: "string" },
+  KICK: { targetClientId: "number" },
+  MUTE: { targetClientId: "number" },
+  GAME_COMPLETE: {},
+  HEARTBEAT: {},
+  PUSH_SAVE_STATE: null,
+};
+
+// Fields only some packet types may carry, all optional
+const strictOptionalPacketFields: Record<string, Record<string, FieldType>> = {
+  UPDATE_CLIENT_DATA: {
+    deltas: "boolean",
+    authToken: "string",
+    clientUuid: "string",
+    lastSeq: "number",
+  },
+  MUTE: { minutes: "number" },
+  LIST_ROOMS: {
+    gameId: "string",
+    region: "string",
+    tags: "string[]",
+    search: "string",
+    sort: "string",
+  },
+};
+
+function hasFieldType(value: unknown, type: FieldType) {
+  if (type === "object") {
+    return typeof value === "object" && value !== null && !Array.isArray(value);
+  }
+  if (type === "string[]") {
+    return Array.isArray(value) &&
+      value.every((item) => typeof item === "string");
+  }
+  return typeof value === type;
+}
+
+// Returns why the packet should be rejected in strict mode, if it should be
+// decodePacket has already checked it's an object with a type
+function strictPacketError(packet: any): string | undefined {
+  const fields = strictPacketFields[packet.type];
+  const allowed = config.strictAllowedTypes.includes(packet.type);
+  if (fields === undefined && !allowed) {
+    return `Unknown packet type ${packet.type}`;
+  }
+
+  for (const [key, value] of Object.entries(packet)) {
+    const type = strictBaseFields[key] ?? fields?.[key] ??
+      strictOptionalPacketFields[packet.type]?.[key];
+    if (!type) {
+      if (fields) {
+        return `Unknown field ${key} in ${packet.type} packet`;
+      }
+      continue;
+    }
+    if (!hasFieldType(value, type)) {
+      return `Field ${key} in ${packet.type} packet is not a ${type}`;
+    }
+  }
+
+  for (const key of Object.keys(fields ?? {})) {
+    if (!(key in packet)) {
+      return `Missing field ${key} in ${packet.type} packet`;
+    }
+  }
+
+  for (const [key, value] of Object.entries(packet.roomOptions ?? {})) {
+    const type = strictRoomOptionFields[key];
+    if (!type) {
+      return `Unknown room option ${key}`;
+    }
+    if (!hasFieldType(value, type)) {
+      return `Room option ${key} is not a ${type}`;
+    }
+  }
+}
+
+export interface RoomListingFilter {
+  gameId?: string;
+  region?: string;
+  tags?: string[];
+  search?: string;
+}
+
+// Most clients, alphabetical (untitled last) or newest first, otherwise
+// unchanged
+export function sortRooms(rooms: Room[], sort?: string) {
+  const sorted = [...rooms];
+  if (sort === "clientCount") {
+    sorted.sort((a, b) => b.clients.length - a.clients.length);
+  } else if (sort === "title") {
+    sorted.sort((a, b) =>
+      a.title === undefined
+        ? b.title === undefined ? 0 : 1
+        : b.title === undefined
+        ? -1
+        : a.title.localeCompare(b.title)
+    );
+  } else if (sort === "createdAt") {
+    sorted.sort((a, b) => b.createdAt - a.createdAt);
+  }
+  return sorted;
+}
+
+// Unset for the default, 0 unmutes. Anything else, like a string, is a mistake
+// rather than a request to unmute
+function isValidMuteMinutes(minutes: unknown) {
+  return minutes === undefined ||
+    (typeof minutes === "number" && Number.isFinite(minutes) && minutes >= 0);
+}
+
+function isLoopback(hostname: string) {
+  return /^(127\.|::1$|::ffff:127\.)/.test(hostname);
+}
+
+// Game packets that change what players have, as opposed to positions and
+// other state that's replaced every frame
+function isGameEvent(packetObject: Packet) {
+  return !(packetObject.type in strictPacketFields) &&
+    (typeof packetObject.eventId === "string" ||
+      config.scoreboardCheckTypes.includes(packetObject.type) ||
+      config.scoreboardItemTypes.includes(packetObject.type));
+}
+
+// Order independent JSON of maps and arrays of plain values, for comparing
+// rebuilt state to the live one
+function stableJson(value: unknown): string {
+  if (value instanceof Map) {
+    value = Object.fromEntries(value);
+  }
+  if (Array.isArray(value)) {
+    return `[${value.map(stableJson).sort().join(",")}]`;
+  }
+  if (typeof value === "object" && value !== null) {
+    return `{${
+      Object.entries(value)
+        .map(([key, item]) => `${JSON.stringify(key)}:${stableJson(item)}`)
+        .sort().join(",")
+    }}`;
+  }
+  return JSON.stringify(value);
+}
+
+const uuidPattern =
+  /^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$/i;
+
+// Booleans stay true once set and integer bitfields are ORed, anything else
+// takes the new value
+function unionFlag(previous: FlagValue, value: FlagValue): FlagValue {
+  if (typeof previous === "boolean" && typeof value === "boolean") {
+    return previous || value;
+  }
+  if (
+    Number.isSafeInteger(previous) && Number.isSafeInteger(value) &&
+    (previous as number) >= 0 && (value as number) >= 0
+  ) {
+    return Number(BigInt(previous) | BigInt(value));
+  }
+  return value;
+}
+
+function isValidTeamId(teamId: unknown): teamId is string {
+  return typeof teamId === "string" && teamId.length > 0 &&
+    teamId.length <= maxTeamIdLength;
+}
+
+function metadataMatches(a: ClientData, b: ClientData): boolean {
+  const keys = Object.keys(a);
+  if (keys.length !== Object.keys(b).length) {
+    return false;
+  }
+
+  return keys.every((key) => JSON.stringify(a[key]) === JSON.stringify(b[key]));
+}
+
+export function sendServerMessage(client: Client, message: string) {
+  return client.sendPacket({
+    type: "SERVER_MESSAGE",
+    message,
+  });
+}
+
+export function sendDisable(client: Client, message: string) {
+  sendServerMessage(client, message)
+    .finally(() =>
+      client.sendPacket({
+        type: "DISABLE_ANCHOR",
+      })
+    );
+}
+
+// Hours, minutes and seconds, e.g. 1:02:03
+export function formatDuration(ms: number) {
+  const seconds = Math.floor(ms / 1000);
+  return [Math.floor(seconds / 3600), Math.floor(seconds / 60) % 60]
+    .concat(seconds % 60)
+    .map((n, i) => i ? String(n).padStart(2, "0") : String(n))
+    .join(":");
+}
+
+// Deno can't send to unix datagram sockets without --unstable, so this goes
+// through systemd-notify. The unit needs NotifyAccess=all as a result
+async function sdNotify(state: string) {
+  if (!notifySocket) {
+    return;
+  }
+
+  try {
+    const { success } = await new Deno.Command("systemd-notify", {
+      args: [`--pid=${Deno.pid}`, state],
+    }).output();
+    if (!success) {
+      writeLog("error", `systemd-notify ${state} failed`);
+    }
+  } catch (error) {
+    writeLog("error", `Error notifying systemd: ${error.message}`);
+  }
+}
+
@@ -0,0 +1,307 @@
+import { assertEquals } from "https://deno.land/std@0.208.0/assert/mod.ts";
+import {
+  type ClientData,
+  encodePacket,
+  type GamePacket,
+  type Packet,
+} from "./protocol.ts";
+import { type Connection, type Listener, Server } from "./server.ts";
+
+const decoder = new TextDecoder();
+
+// Stands in for a client's TCP connection, packets sent through it arrive at
+// the server as if over the network
+class TestConnection implements Connection {
+  readonly remoteAddr: Deno.NetAddr;
+  private incoming: Uint8Array[] = [];
+  private wake?: () => void;
+  private closed = false;
+  private written = "";
+
+  constructor(hostname: string) {
+    this.remoteAddr = { transport: "tcp", hostname, port: 50000 };
+  }
+
+  send(packet: Packet | GamePacket) {
+    this.incoming.push(encodePacket(packet));
+    this.wake?.();
+  }
+
+  // Everything the server has written so far
+  received(type?: string): GamePacket[] {
+    return this.written.split("\0").filter(Boolean)
+      .map((packet) => JSON.parse(packet))
+      .filter((packet) => type === undefined || packet.type === type);
+  }
+
+  async read(buffer: Uint8Array) {
+    while (!this.incoming.length && !this.closed) {
+      await new Promise<void>((resolve) => this.wake = resolve);
+      this.wake = undefined;
+    }
+    const chunk = this.incoming.shift();
+    if (!chunk) {
+      return null;
+    }
+    if (chunk.length > buffer.length) {
+      this.incoming.unshift(chunk.subarray(buffer.length));
+    }
+    buffer.set(chunk.subarray(0, buffer.length));
+    return Math.min(chunk.length, buffer.length);
+  }
+
+  write(data: Uint8Array) {
+    if (this.closed) {
+      return Promise.reject(new Deno.errors.BadResource("Connection closed"));
+    }
+    this.written += decoder.decode(data);
+    return Promise.resolve(data.length);
+  }
+
+  close() {
+    this.closed = true;
+    this.wake?.();
+  }
+}
+
+class TestListener implements Listener {
+  connections: TestConnection[] = [];
+  private pending: Connection[] = [];
+  private wake?: () => void;
+  private closed = false;
+
+  // Each client gets its own address unless it's reconnecting from one
+  connect(hostname = `10.0.0.${this.connections.length + 1}`) {
+    const connection = new TestConnection(hostname);
+    this.connections.push(connection);
+    this.pending.push(connection);
+    this.wake?.();
+    return connection;
+  }
+
+  close() {
+    this.closed = true;
+    this.wake?.();
+  }
+
+  async *[Symbol.asyncIterator]() {
+    while (!this.closed) {
+      const connection = this.pending.shift();
+      if (connection) {
+        yield connection;
+        continue;
+      }
+      await new Promise<void>((resolve) => this.wake = resolve);
+      this.wake = undefined;
+    }
+  }
+}
+
+// Long enough for packets to be handled and ALL_CLIENT_DATA to go out
+function settle() {
+  return new Promise((resolve) => setTimeout(resolve, 100));
+}
+
+// The server keeps timers and reads going per client, which end with the
+// connections rather than with each test
+function serverTest(name: string, fn: (listener: TestListener) => unknown) {
+  Deno.test({
+    name,
+    sanitizeOps: false,
+    sanitizeResources: false,
+    async fn() {
+      const listener = new TestListener();
+      new Server().serve(listener);
+      try {
+        await fn(listener);
+      } finally {
+        listener.close();
+        listener.connections.forEach((connection) => connection.close());
+        await settle();
+      }
+    },
+  });
+}
+
+function join(
+  connection: TestConnection,
+  roomId: string,
+  data: ClientData = {},
+  clientUuid?: string,
+) {
+  connection.send({ type: "UPDATE_CLIENT_DATA", roomId, data, clientUuid });
+}
+
+// The room's other clients, as of the last ALL_CLIENT_DATA
+function peersOf(connection: TestConnection) {
+  const [latest] = connection.received("ALL_CLIENT_DATA").slice(-1);
+  return (latest?.clients ?? []) as ClientData[];
+}
+
+serverTest("relays packets to peers in the sender's room", async (listener) => {
+  const a = listener.connect();
+  const b = listener.connect();
+  const elsewhere = listener.connect();
+  join(a, "room", { name: "A" });
+  join(b, "room", { name: "B" });
+  join(elsewhere, "other", { name: "C" });
+  await settle();
+
+  a.send({ type: "ITEM", item: 7 });
+  await settle();
+
+  const [sender] = peersOf(b);
+  assertEquals(sender.name, "A");
+  assertEquals(
+    b.received("ITEM"),
+    [{ type: "ITEM", item: 7, clientId: sender.clientId }],
+  );
+  assertEquals(a.received("ITEM"), []);
+  assertEquals(elsewhere.received("ITEM"), []);
+});
+
+serverTest("handles packets spanning several reads", async (listener) => {
+  const a = listener.connect();
+  const b = listener.connect();
+  join(a, "room");
+  join(b, "room");
+  await settle();
+
+  const payload = "x".repeat(300 * 1024);
+  a.send({ type: "ITEM", item: 1, payload });
+  a.send({ type: "ITEM", item: 2 });
+  await settle();
+
+  const items = b.received("ITEM");
+  assertEquals(items.map((packet) => packet.item), [1, 2]);
+  assertEquals(items[0].payload, payload);
+});
+
+serverTest("drops muted clients' messages", async (listener) => {
+  const owner = listener.connect();
+  const member = listener.connect();
+  join(owner, "room");
+  join(member, "room");
+  await settle();
+  const [{ clientId }] = peersOf(owner);
+
+  owner.send({ type: "MUTE", targetClientId: clientId, minutes: 5 });
+  await settle();
+  // Refused rather than taken as 0, which would unmute
+  owner.send({ type: "MUTE", targetClientId: clientId, minutes: "none" });
+  await settle();
+  member.send({ type: "CHAT", message: "hello" });
+  member.send({ type: "ITEM", item: 1 });
+  await settle();
+
+  assertEquals(
+    owner.received("SERVER_MESSAGE").map((packet) => packet.message),
+    ['Invalid minutes "none"'],
+  );
+  assertEquals(owner.received("CHAT"), []);
+  assertEquals(owner.received("ITEM").length, 1);
+});
+
+serverTest("refuses kicked clients when they come back", async (listener) => {
+  const owner = listener.connect();
+  const member = listener.connect();
+  const install = crypto.randomUUID();
+  join(owner, "room");
+  join(member, "room", {}, install);
+  await settle();
+  const [{ clientId }] = peersOf(owner);
+
+  owner.send({ type: "KICK", targetClientId: clientId });
+  await settle();
+  member.close();
+  await settle();
+  // With a new clientId from the same address, then from another address
+  const sameAddress = listener.connect(member.remoteAddr.hostname);
+  join(sameAddress, "room");
+  const sameInstall = listener.connect();
+  join(sameInstall, "room", {}, install);
+  await settle();
+  sameAddress.send({ type: "ITEM", item: 1 });
+  sameInstall.send({ type: "ITEM", item: 2 });
+  await settle();
+
+  for (const again of [sameAddress, sameInstall]) {
+    assertEquals(
+      again.received("SERVER_MESSAGE").map((packet) => packet.message),
+      ["You were kicked from this room"],
+    );
+  }
+  assertEquals(owner.received("ITEM"), []);
+});
+
+serverTest("resends unacked packets after rejoining", async (listener) => {
+  const sender = listener.connect();
+  join(sender, "room");
+  const install = crypto.randomUUID();
+  const receiver = listener.connect();
+  receiver.send({ type: "HANDSHAKE", capabilities: ["acks"] });
+  join(receiver, "room", {}, install);
+  await settle();
+
+  sender.send({ type: "GIVE_ITEM", item: 1 });
+  sender.send({ type: "GIVE_ITEM", item: 2 });
+  await settle();
+  const given = receiver.received("GIVE_ITEM");
+  assertEquals(given.map((packet) => packet.deliverySeq), [1, 2]);
+
+  // Only the first made it before the connection died
+  receiver.send({ type: "ACK", deliverySeq: 1 });
+  await settle();
+  receiver.close();
+  await settle();
+
+  const again = listener.connect();
+  again.send({ type: "HANDSHAKE", capabilities: ["acks"] });
+  join(again, "room", {}, install);
+  await settle();
+  assertEquals(again.received("GIVE_ITEM"), [given[1]]);
+
+  sender.send({ type: "GIVE_ITEM", item: 3 });
+  await settle();
+  assertEquals(
+    again.received("GIVE_ITEM").map((packet) => packet.deliverySeq),
+    [2, 3],
+  );
+});
+
+serverTest("doesn't resend unacked packets caught up on", async (listener) => {
+  const sender = listener.connect();
+  join(sender, "room");
+  const install = crypto.randomUUID();
+  const receiver = listener.connect();
+  receiver.send({ type: "HANDSHAKE", capabilities: ["acks"] });
+  join(receiver, "room", {}, install);
+  await settle();
+
+  // With eventIds, so they're kept in the room's event log
+  sender.send({ type: "GIVE_ITEM", item: 1, eventId: "a" });
+  sender.send({ type: "GIVE_ITEM", item: 2, eventId: "b" });
+  await settle();
+  const given = receiver.received("GIVE_ITEM");
+  receiver.close();
+  await settle();
+
+  // Neither was acknowledged, but the first was applied
+  const again = listener.connect();
+  again.send({ type: "HANDSHAKE", capabilities: ["acks"] });
+  again.send({
+    type: "UPDATE_CLIENT_DATA",
+    roomId: "room",
+    data: {},
+    clientUuid: install,
+    lastSeq: given[0].seq,
+  });
+  await settle();
+  assertEquals(
+    again.received("GIVE_ITEM").map(({ item, deliverySeq }) => [
+      item,
+      deliverySeq,
+    ]),
+    [[2, 3]],
+  );
+});
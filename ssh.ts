@@ -0,0 +1,1123 @@
+// The admin console over SSH, so it can be used remotely with encryption and
+// authentication and without a VPN. Deliberately minimal: only public key
+// authentication, curve25519-sha256 key exchange, an ssh-ed25519 host key,
+// aes128-ctr and hmac-sha2-256, all of which current OpenSSH clients offer
+import {
+  decodeBase64,
+  encodeBase64,
+} from "https://deno.land/std@0.208.0/encoding/base64.ts";
+import {
+  decodeBase64Url,
+  encodeBase64Url,
+} from "https://deno.land/std@0.208.0/encoding/base64url.ts";
+import { type Connection, type Listener, writeLog } from "./server.ts";
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+
+const serverVersion = "SSH-2.0-Anchor";
+
+const kexAlgorithms = ["curve25519-sha256", "curve25519-sha256@libssh.org"];
+const hostKeyAlgorithm = "ssh-ed25519";
+const cipherAlgorithm = "aes128-ctr";
+const macAlgorithm = "hmac-sha2-256";
+// Signature algorithms accepted for each type of authorized key
+const signatureAlgorithms: Record<string, string[]> = {
+  "ssh-ed25519": ["ssh-ed25519"],
+  "ssh-rsa": ["rsa-sha2-256", "rsa-sha2-512"],
+};
+const rsaHashes: Record<string, string> = {
+  "rsa-sha2-256": "SHA-256",
+  "rsa-sha2-512": "SHA-512",
+};
+
+const blockSize = 16;
+const macLength = 32;
+// Far more than the console ever needs, but bounds what a client can make us
+// buffer
+const maxPacketLength = 256 * 1024;
+const windowSize = 1024 * 1024;
+const maxChannelData = 32 * 1024;
+// Output for a session that isn't reading it is dropped past this
+const maxPendingOutput = 1024 * 1024;
+const loginTimeoutMs = 30 * 1000;
+const maxAuthAttempts = 20;
+
+const message = {
+  disconnect: 1,
+  ignore: 2,
+  unimplemented: 3,
+  debug: 4,
+  serviceRequest: 5,
+  serviceAccept: 6,
+  extInfo: 7,
+  kexInit: 20,
+  newKeys: 21,
+  kexEcdhInit: 30,
+  kexEcdhReply: 31,
+  userauthRequest: 50,
+  userauthFailure: 51,
+  userauthSuccess: 52,
+  userauthPkOk: 60,
+  globalRequest: 80,
+  requestFailure: 82,
+  channelOpen: 90,
+  channelOpenConfirmation: 91,
+  channelOpenFailure: 92,
+  channelWindowAdjust: 93,
+  channelData: 94,
+  channelEof: 96,
+  channelClose: 97,
+  channelRequest: 98,
+  channelSuccess: 99,
+  channelFailure: 100,
+};
+
+export interface SshHostKey {
+  privateKey: CryptoKey;
+  blob: Uint8Array; // the public key in SSH wire format
+  fingerprint: string;
+}
+
+export interface SshConsoleOptions {
+  hostKey: SshHostKey;
+  // OpenSSH format, read on every login so keys can be added and removed
+  // without a restart
+  authorizedKeysPath: string;
+  runCommand: (line: string, operator: string) => void;
+}
+
+interface AuthorizedKey {
+  blob: Uint8Array;
+  name: string; // the key's comment, or its fingerprint without one
+}
+
+// An ssh-ed25519 key, generated on first use and saved as a JWK
+export async function loadHostKey(path: string): Promise<SshHostKey> {
+  let jwk: JsonWebKey;
+  try {
+    jwk = JSON.parse(await Deno.readTextFile(path));
+  } catch (error) {
+    if (!(error instanceof Deno.errors.NotFound)) {
+      throw error;
+    }
+
+    const pair = await crypto.subtle.generateKey(
+      { name: "Ed25519" },
+      true,
+      ["sign", "verify"],
+    ) as CryptoKeyPair;
+    jwk = await crypto.subtle.exportKey("jwk", pair.privateKey);
+    await Deno.writeTextFile(path, JSON.stringify(jwk), { mode: 0o600 });
+    writeLog("info", `Generated SSH host key ${path}`);
+  }
+
+  const privateKey = await crypto.subtle.importKey(
+    "jwk",
+    jwk,
+    { name: "Ed25519" },
+    false,
+    ["sign"],
+  );
+  const blob = concat(
+    sshString(hostKeyAlgorithm),
+    sshString(decodeBase64Url(jwk.x ?? "")),
+  );
+  return { privateKey, blob, fingerprint: await fingerprint(blob) };
+}
+
+export class SshConsole {
+  private options: SshConsoleOptions;
+  private listener?: Listener;
+  private sessions = new Set<SshSession>();
+  private originalConsole?: Pick<Console, "log" | "error">;
+
+  constructor(options: SshConsoleOptions) {
+    this.options = options;
+  }
+
+  async serve(listener: Listener) {
+    this.listener = listener;
+
+    // Everything logged, command output included, is mirrored to each session
+    this.originalConsole = { log: console.log, error: console.error };
+    const { log, error } = this.originalConsole;
+    console.log = (...data) => {
+      log(...data);
+      this.write(data);
+    };
+    console.error = (...data) => {
+      error(...data);
+      this.write(data);
+    };
+
+    for await (const connection of listener) {
+      const session = new SshSession(connection, this.options);
+      this.sessions.add(session);
+      session.run().finally(() => this.sessions.delete(session));
+    }
+  }
+
+  close() {
+    if (this.originalConsole) {
+      Object.assign(console, this.originalConsole);
+      this.originalConsole = undefined;
+    }
+    this.listener?.close();
+    for (const session of this.sessions) {
+      session.close();
+    }
+  }
+
+  private write(data: unknown[]) {
+    if (!this.sessions.size) {
+      return;
+    }
+
+    const text = data.map((d) => typeof d === "string" ? d : Deno.inspect(d))
+      .join(" ");
+    for (const session of this.sessions) {
+      session.write(text + "\n");
+    }
+  }
+}
+
+interface Keys {
+  cipher: CtrCipher;
+  macKey: CryptoKey;
+}
+
+interface Channel {
+  id: number;
+  remoteId: number;
+  remoteWindow: number;
+  remoteMaxPacket: number;
+  localWindow: number;
+  pty: boolean; // input arrives a keystroke at a time and needs echoing
+  shell: boolean;
+  closing: boolean; // closed once pending output has been sent
+  closeSent: boolean;
+  line: string;
+  pending: Uint8Array; // output waiting for the client to open its window
+}
+
+class SshSession {
+  private connection: Connection;
+  private options: SshConsoleOptions;
+  private address: string;
+  private buffer = new Uint8Array(0);
+  private sending = Promise.resolve();
+  private closed = false;
+  private loginTimer: number;
+
+  private clientVersion = "";
+  private clientKexInit?: Uint8Array;
+  private serverKexInit?: Uint8Array;
+  private sessionId?: Uint8Array;
+  private sendExtInfo = false;
+  private incoming?: Keys;
+  private nextIncoming?: Keys;
+  private outgoing?: Keys;
+  private sequenceIn = 0;
+  private sequenceOut = 0;
+
+  private operator?: string; // set once authenticated
+  private authAttempts = 0;
+  private channels = new Map<number, Channel>();
+  private nextChannelId = 0;
+
+  constructor(connection: Connection, options: SshConsoleOptions) {
+    this.connection = connection;
+    this.options = options;
+    const addr = connection.remoteAddr as Deno.NetAddr;
+    this.address = addr.hostname ?? "unknown";
+    this.loginTimer = setTimeout(() => {
+      if (!this.operator) {
+        this.disconnect("Login timed out");
+      }
+    }, loginTimeoutMs);
+  }
+
+  async run() {
+    try {
+      await this.writeAll(encoder.encode(serverVersion + "\r\n"));
+      this.sendKexInit();
+      const clientVersion = await this.readVersion();
+      if (clientVersion === null) {
+        return;
+      }
+      this.clientVersion = clientVersion;
+
+      while (!this.closed) {
+        const payload = await this.readPacket();
+        if (!payload) {
+          break;
+        }
+        await this.handle(payload);
+      }
+    } catch (error) {
+      if (!this.closed) {
+        writeLog(
+          "error",
+          `Error in SSH session from ${this.address}: ${error.message}`,
+        );
+        this.disconnect(error.message);
+      }
+    } finally {
+      this.close();
+      if (this.operator) {
+        writeLog("info", `${this.operator} left the SSH console`);
+      }
+    }
+  }
+
+  close() {
+    if (this.closed) {
+      return;
+    }
+
+    this.closed = true;
+    clearTimeout(this.loginTimer);
+    // Lets anything already queued, like a disconnect reason, go out first
+    this.sending.finally(() => {
+      try {
+        this.connection.close();
+      } catch (_) {
+        // Already closed
+      }
+    });
+  }
+
+  // Console output, for every open shell
+  write(text: string) {
+    if (!this.operator) {
+      return;
+    }
+
+    for (const channel of this.channels.values()) {
+      if (channel.shell && !channel.closing) {
+        this.sendData(
+          channel,
+          channel.pty ? text.replaceAll("\n", "\r\n") : text,
+        );
+      }
+    }
+  }
+
+  private disconnect(reason: string) {
+    this.send(
+      message.disconnect,
+      uint32(2), // SSH_DISCONNECT_PROTOCOL_ERROR
+      sshString(reason),
+      sshString(""),
+    );
+    this.close();
+  }
+
+  private async handle(payload: Uint8Array) {
+    const type = payload[0];
+    const reader = new SshReader(payload.subarray(1));
+
+    // Not just once the exchange is done, but once the client's NEWKEYS means
+    // what it sends is encrypted
+    if (type >= message.userauthRequest && !this.incoming) {
+      throw new Error("Message before key exchange");
+    }
+    if (type >= message.globalRequest && !this.operator) {
+      throw new Error("Message before authentication");
+    }
+
+    switch (type) {
+      case message.disconnect:
+        this.close();
+        break;
+      case message.ignore:
+      case message.debug:
+      case message.unimplemented:
+        break;
+      case message.kexInit:
+        this.handleKexInit(payload);
+        break;
+      case message.kexEcdhInit:
+        await this.handleKexEcdhInit(reader);
+        break;
+      case message.newKeys:
+        if (!this.nextIncoming) {
+          throw new Error("Unexpected NEWKEYS");
+        }
+        this.incoming = this.nextIncoming;
+        this.nextIncoming = undefined;
+        break;
+      case message.serviceRequest: {
+        const service = reader.string();
+        if (service !== "ssh-userauth" || !this.incoming) {
+          throw new Error(`Unsupported service ${service}`);
+        }
+        this.send(message.serviceAccept, sshString(service));
+        break;
+      }
+      case message.userauthRequest:
+        await this.handleUserauthRequest(reader);
+        break;
+      case message.globalRequest: {
+        reader.string();
+        if (reader.bool()) {
+          this.send(message.requestFailure);
+        }
+        break;
+      }
+      case message.channelOpen:
+        this.handleChannelOpen(reader);
+        break;
+      case message.channelRequest:
+        this.handleChannelRequest(reader);
+        break;
+      case message.channelWindowAdjust: {
+        const channel = this.channel(reader.uint32());
+        channel.remoteWindow += reader.uint32();
+        this.flush(channel);
+        break;
+      }
+      case message.channelData:
+        this.handleChannelData(reader);
+        break;
+      case message.channelEof:
+        // e.g. the end of commands piped in, there's nothing more to do
+        this.closeChannel(this.channel(reader.uint32()));
+        break;
+      case message.channelClose: {
+        const channel = this.channel(reader.uint32());
+        this.closeChannel(channel);
+        this.channels.delete(channel.id);
+        break;
+      }
+      default:
+        this.send(message.unimplemented, uint32(this.sequenceIn - 1 >>> 0));
+    }
+  }
+
+  private sendKexInit() {
+    const payload = concat(
+      Uint8Array.of(message.kexInit),
+      crypto.getRandomValues(new Uint8Array(16)),
+      sshString(kexAlgorithms.join(",")),
+      sshString(hostKeyAlgorithm),
+      sshString(cipherAlgorithm),
+      sshString(cipherAlgorithm),
+      sshString(macAlgorithm),
+      sshString(macAlgorithm),
+      sshString("none"),
+      sshString("none"),
+      sshString(""),
+      sshString(""),
+      Uint8Array.of(0), // first_kex_packet_follows
+      uint32(0),
+    );
+    this.serverKexInit = payload;
+    this.sendPayload(payload);
+  }
+
+  private handleKexInit(payload: Uint8Array) {
+    const reader = new SshReader(payload.subarray(17)); // type and cookie
+    const [kex, hostKey, cipherIn, cipherOut, macIn, macOut, compIn, compOut] =
+      Array.from({ length: 8 }, () => reader.string().split(","));
+    const supported = kexAlgorithms.some((name) => kex.includes(name)) &&
+      hostKey.includes(hostKeyAlgorithm) &&
+      cipherIn.includes(cipherAlgorithm) &&
+      cipherOut.includes(cipherAlgorithm) && macIn.includes(macAlgorithm) &&
+      macOut.includes(macAlgorithm) && compIn.includes("none") &&
+      compOut.includes("none");
+    if (!supported) {
+      throw new Error("No supported algorithms in common");
+    }
+
+    // The client is rekeying
+    if (!this.serverKexInit) {
+      this.sendKexInit();
+    }
+    this.clientKexInit = payload;
+    // Tells the client RSA keys can sign with SHA-2, only after the first kex
+    this.sendExtInfo = !this.sessionId && kex.includes("ext-info-c");
+  }
+
+  private async handleKexEcdhInit(reader: SshReader) {
+    if (!this.clientKexInit || !this.serverKexInit) {
+      throw new Error("Unexpected KEX_ECDH_INIT");
+    }
+
+    const clientPublic = reader.bytes();
+    const pair = await crypto.subtle.generateKey(
+      { name: "X25519" },
+      true,
+      ["deriveBits"],
+    ) as CryptoKeyPair;
+    const serverPublic = new Uint8Array(
+      await crypto.subtle.exportKey("raw", pair.publicKey),
+    );
+    const clientKey = await crypto.subtle.importKey(
+      "raw",
+      clientPublic,
+      { name: "X25519" },
+      false,
+      [],
+    );
+    const secret = mpint(
+      new Uint8Array(
+        await crypto.subtle.deriveBits(
+          { name: "X25519", public: clientKey },
+          pair.privateKey,
+          256,
+        ),
+      ),
+    );
+
+    const { hostKey } = this.options;
+    const hash = await sha256(concat(
+      sshString(this.clientVersion),
+      sshString(serverVersion),
+      sshString(this.clientKexInit),
+      sshString(this.serverKexInit),
+      sshString(hostKey.blob),
+      sshString(clientPublic),
+      sshString(serverPublic),
+      secret,
+    ));
+    const sessionId = this.sessionId ??= hash;
+    const signature = new Uint8Array(
+      await crypto.subtle.sign("Ed25519", hostKey.privateKey, hash),
+    );
+    this.send(
+      message.kexEcdhReply,
+      sshString(hostKey.blob),
+      sshString(serverPublic),
+      sshString(concat(sshString(hostKeyAlgorithm), sshString(signature))),
+    );
+
+    const derive = (letter: string) =>
+      sha256(concat(secret, hash, encoder.encode(letter), sessionId));
+    const [ivIn, ivOut, keyIn, keyOut, macIn, macOut] = await Promise.all(
+      ["A", "B", "C", "D", "E", "F"].map(derive),
+    );
+    this.nextIncoming = await createKeys(keyIn, ivIn, macIn);
+    const outgoing = await createKeys(keyOut, ivOut, macOut);
+    this.send(message.newKeys);
+    this.sending = this.sending.then(() => {
+      this.outgoing = outgoing;
+    });
+    this.clientKexInit = undefined;
+    this.serverKexInit = undefined;
+
+    if (this.sendExtInfo) {
+      this.send(
+        message.extInfo,
+        uint32(1),
+        sshString("server-sig-algs"),
+        sshString(Object.values(signatureAlgorithms).flat().join(",")),
+      );
+    }
+  }
+
+  private async handleUserauthRequest(reader: SshReader) {
+    if (this.operator) {
+      return; // Already logged in, further requests are ignored
+    }
+    if (++this.authAttempts > maxAuthAttempts) {
+      throw new Error("Too many authentication attempts");
+    }
+
+    const user = reader.bytes();
+    const service = reader.bytes();
+    const method = reader.string();
+    const failure = () =>
+      this.send(
+        message.userauthFailure,
+        sshString("publickey"),
+        Uint8Array.of(0),
+      );
+    if (method !== "publickey") {
+      failure();
+      return;
+    }
+
+    const signed = reader.bool();
+    const algorithm = reader.bytes();
+    const blob = reader.bytes();
+    const authorizedKey = (await this.loadAuthorizedKeys())
+      .find((key) => equal(key.blob, blob));
+    const keyType = new SshReader(blob).string();
+    const algorithmName = decoder.decode(algorithm);
+    if (
+      !authorizedKey ||
+      !signatureAlgorithms[keyType]?.includes(algorithmName)
+    ) {
+      failure();
+      return;
+    }
+
+    // Asking whether the key would be accepted, before signing with it
+    if (!signed) {
+      this.send(message.userauthPkOk, sshString(algorithm), sshString(blob));
+      return;
+    }
+
+    const data = concat(
+      sshString(this.sessionId!),
+      Uint8Array.of(message.userauthRequest),
+      sshString(user),
+      sshString(service),
+      sshString("publickey"),
+      Uint8Array.of(1),
+      sshString(algorithm),
+      sshString(blob),
+    );
+    if (!await verifySignature(blob, algorithmName, reader.bytes(), data)) {
+      failure();
+      return;
+    }
+
+    this.operator = `ssh:${authorizedKey.name}`;
+    clearTimeout(this.loginTimer);
+    this.send(message.userauthSuccess);
+    writeLog(
+      "info",
+      `${this.operator} logged in to the SSH console from ${this.address}`,
+    );
+  }
+
+  private async loadAuthorizedKeys() {
+    let text = "";
+    try {
+      text = await Deno.readTextFile(this.options.authorizedKeysPath);
+    } catch (error) {
+      if (!(error instanceof Deno.errors.NotFound)) {
+        throw error;
+      }
+    }
+
+    const keys: AuthorizedKey[] = [];
+    for (const line of text.split("\n")) {
+      // Options before the key type, like from="...", aren't supported
+      const [type, data, ...comment] = line.trim().split(/\s+/);
+      if (!(type in signatureAlgorithms) || !data) {
+        continue;
+      }
+
+      const blob = decodeBase64(data);
+      keys.push({
+        blob,
+        name: comment.join(" ") || await fingerprint(blob),
+      });
+    }
+    return keys;
+  }
+
+  private handleChannelOpen(reader: SshReader) {
+    const type = reader.string();
+    const remoteId = reader.uint32();
+    const remoteWindow = reader.uint32();
+    const remoteMaxPacket = reader.uint32();
+    if (type !== "session") {
+      this.send(
+        message.channelOpenFailure,
+        uint32(remoteId),
+        uint32(1), // SSH_OPEN_ADMINISTRATIVELY_PROHIBITED
+        sshString("Only sessions are supported"),
+        sshString(""),
+      );
+      return;
+    }
+
+    const channel: Channel = {
+      id: this.nextChannelId++,
+      remoteId,
+      remoteWindow,
+      remoteMaxPacket,
+      localWindow: windowSize,
+      pty: false,
+      shell: false,
+      closing: false,
+      closeSent: false,
+      line: "",
+      pending: new Uint8Array(0),
+    };
+    this.channels.set(channel.id, channel);
+    this.send(
+      message.channelOpenConfirmation,
+      uint32(remoteId),
+      uint32(channel.id),
+      uint32(windowSize),
+      uint32(maxChannelData),
+    );
+  }
+
+  private handleChannelRequest(reader: SshReader) {
+    const channel = this.channel(reader.uint32());
+    const type = reader.string();
+    const wantReply = reader.bool();
+
+    // Commands can't be run with exec, as their output isn't always printed
+    // before they return
+    let success = true;
+    if (type === "pty-req") {
+      channel.pty = true;
+    } else if (type === "shell") {
+      channel.shell = true;
+    } else if (type !== "env" && type !== "window-change") {
+      success = false;
+    }
+
+    if (wantReply) {
+      this.send(
+        success ? message.channelSuccess : message.channelFailure,
+        uint32(channel.remoteId),
+      );
+    }
+    if (type === "shell") {
+      this.sendData(
+        channel,
+        `Anchor admin console, type help for commands or exit to leave${
+          channel.pty ? "\r\n" : "\n"
+        }`,
+      );
+    }
+  }
+
+  private handleChannelData(reader: SshReader) {
+    const channel = this.channel(reader.uint32());
+    const data = reader.bytes();
+    channel.localWindow -= data.length;
+    if (channel.localWindow < windowSize / 2) {
+      this.send(
+        message.channelWindowAdjust,
+        uint32(channel.remoteId),
+        uint32(windowSize - channel.localWindow),
+      );
+      channel.localWindow = windowSize;
+    }
+
+    // Escape sequences, like the arrow keys, aren't supported
+    if (!channel.shell || channel.closing || data[0] === 0x1b) {
+      return;
+    }
+
+    const lines: string[] = [];
+    let echo = "";
+    const text = decoder.decode(data);
+    for (const character of text) {
+      if ((character === "\r" && channel.pty) || character === "\n") {
+        lines.push(channel.line.trim());
+        channel.line = "";
+        echo += channel.pty ? "\r\n" : "";
+      } else if (character === "\x7f" || character === "\b") {
+        if (channel.line) {
+          channel.line = [...channel.line].slice(0, -1).join("");
+          echo += "\b \b";
+        }
+      } else if (character === "\x03") { // Ctrl+C
+        channel.line = "";
+        echo += "^C\r\n";
+      } else if (character === "\x04" && !channel.line) { // Ctrl+D
+        lines.push("exit");
+      } else if (character >= " ") {
+        channel.line += character;
+        echo += character;
+      }
+    }
+
+    if (channel.pty && echo) {
+      this.sendData(channel, echo);
+    }
+    for (const line of lines) {
+      if (line === "exit") {
+        this.closeChannel(channel);
+        return;
+      }
+      if (line) {
+        this.options.runCommand(line, this.operator!);
+      }
+    }
+  }
+
+  private closeChannel(channel: Channel) {
+    if (channel.closing) {
+      return;
+    }
+
+    channel.closing = true;
+    this.flush(channel);
+  }
+
+  private flush(channel: Channel) {
+    while (channel.pending.length && channel.remoteWindow > 0) {
+      const length = Math.min(
+        channel.pending.length,
+        channel.remoteWindow,
+        channel.remoteMaxPacket,
+        maxChannelData,
+      );
+      this.send(
+        message.channelData,
+        uint32(channel.remoteId),
+        sshString(channel.pending.subarray(0, length)),
+      );
+      channel.pending = channel.pending.subarray(length);
+      channel.remoteWindow -= length;
+    }
+
+    if (channel.closing && !channel.pending.length && !channel.closeSent) {
+      channel.closeSent = true;
+      this.send(
+        message.channelRequest,
+        uint32(channel.remoteId),
+        sshString("exit-status"),
+        Uint8Array.of(0),
+        uint32(0),
+      );
+      this.send(message.channelEof, uint32(channel.remoteId));
+      this.send(message.channelClose, uint32(channel.remoteId));
+    }
+  }
+
+  private channel(id: number) {
+    const channel = this.channels.get(id);
+    if (!channel) {
+      throw new Error(`Unknown channel ${id}`);
+    }
+    return channel;
+  }
+
+  private sendData(channel: Channel, text: string) {
+    if (channel.pending.length > maxPendingOutput) {
+      return;
+    }
+    channel.pending = concat(channel.pending, encoder.encode(text));
+    this.flush(channel);
+  }
+
+  private send(type: number, ...fields: Uint8Array[]) {
+    this.sendPayload(concat(Uint8Array.of(type), ...fields));
+  }
+
+  // Packets are written one at a time, in order, as each one's encryption
+  // and MAC depend on the ones before it
+  private sendPayload(payload: Uint8Array) {
+    this.sending = this.sending
+      .then(() => this.writePacket(payload))
+      .catch(() => this.close());
+  }
+
+  private async writePacket(payload: Uint8Array) {
+    if (this.closed && payload[0] !== message.disconnect) {
+      return;
+    }
+
+    const size = this.outgoing ? blockSize : 8;
+    let paddingLength = size - (payload.length + 5) % size;
+    if (paddingLength < 4) {
+      paddingLength += size;
+    }
+    const packet = concat(
+      uint32(payload.length + paddingLength + 1),
+      Uint8Array.of(paddingLength),
+      payload,
+      crypto.getRandomValues(new Uint8Array(paddingLength)),
+    );
+
+    let data = packet;
+    if (this.outgoing) {
+      const mac = await crypto.subtle.sign(
+        "HMAC",
+        this.outgoing.macKey,
+        concat(uint32(this.sequenceOut), packet),
+      );
+      data = concat(
+        await this.outgoing.cipher.process(packet),
+        new Uint8Array(mac),
+      );
+    }
+    this.sequenceOut = this.sequenceOut + 1 >>> 0;
+    await this.writeAll(data);
+  }
+
+  private async writeAll(data: Uint8Array) {
+    let written = 0;
+    while (written < data.length) {
+      written += await this.connection.write(data.subarray(written));
+    }
+  }
+
+  // Skips any lines the client sends before its version
+  private async readVersion() {
+    while (true) {
+      const end = this.buffer.indexOf(0x0a);
+      if (end !== -1) {
+        const line = decoder.decode(this.buffer.subarray(0, end))
+          .replace(/\r$/, "");
+        this.buffer = this.buffer.subarray(end + 1);
+        if (!line.startsWith("SSH-")) {
+          continue;
+        }
+        if (!/^SSH-(2\.0|1\.99)-/.test(line)) {
+          throw new Error(`Unsupported SSH version ${line}`);
+        }
+        return line;
+      }
+
+      if (this.buffer.length > 8192) {
+        throw new Error("No SSH version received");
+      }
+      if (!await this.fill(this.buffer.length + 1)) {
+        return null;
+      }
+    }
+  }
+
+  private async readPacket() {
+    const keys = this.incoming;
+    const size = keys ? blockSize : 8;
+    if (!await this.fill(size)) {
+      return null;
+    }
+
+    let first = this.buffer.subarray(0, size);
+    if (keys) {
+      first = await keys.cipher.process(first);
+    }
+    const length = new DataView(first.buffer, first.byteOffset).getUint32(0);
+    if (length < 12 || length > maxPacketLength || (length + 4) % size) {
+      throw new Error("Invalid packet length");
+    }
+
+    const total = 4 + length + (keys ? macLength : 0);
+    if (!await this.fill(total)) {
+      return null;
+    }
+
+    let packet = this.buffer.subarray(0, 4 + length);
+    if (keys) {
+      packet = concat(
+        first,
+        await keys.cipher.process(this.buffer.subarray(size, 4 + length)),
+      );
+      const valid = await crypto.subtle.verify(
+        "HMAC",
+        keys.macKey,
+        this.buffer.subarray(4 + length, total),
+        concat(uint32(this.sequenceIn), packet),
+      );
+      if (!valid) {
+        throw new Error("Invalid packet MAC");
+      }
+    }
+
+    this.buffer = this.buffer.subarray(total);
+    this.sequenceIn = this.sequenceIn + 1 >>> 0;
+    const paddingLength = packet[4];
+    return packet.slice(5, 4 + length - paddingLength);
+  }
+
+  // Reads until at least length bytes are buffered, false if the connection
+  // closed first
+  private async fill(length: number) {
+    while (this.buffer.length < length) {
+      const chunk = new Uint8Array(32 * 1024);
+      const read = await this.connection.read(chunk);
+      if (read === null) {
+        return false;
+      }
+      this.buffer = concat(this.buffer, chunk.subarray(0, read));
+    }
+    return true;
+  }
+}
+
+// AES in counter mode, with the counter carried over between packets
+class CtrCipher {
+  private key: CryptoKey;
+  private counter: bigint;
+
+  constructor(key: CryptoKey, iv: Uint8Array) {
+    this.key = key;
+    this.counter = BigInt(`0x${Array.from(iv, hex).join("")}`);
+  }
+
+  // data must be a whole number of blocks
+  async process(data: Uint8Array) {
+    const counter = Uint8Array.from(
+      this.counter.toString(16).padStart(32, "0").match(/../g)!,
+      (byte) => parseInt(byte, 16),
+    );
+    const result = await crypto.subtle.encrypt(
+      { name: "AES-CTR", counter, length: 128 },
+      this.key,
+      data,
+    );
+    this.counter = (this.counter + BigInt(data.length / blockSize)) %
+      (1n << 128n);
+    return new Uint8Array(result);
+  }
+}
+
+async function createKeys(
+  key: Uint8Array,
+  iv: Uint8Array,
+  macKey: Uint8Array,
+): Promise<Keys> {
+  const cipherKey = await crypto.subtle.importKey(
+    "raw",
+    key.subarray(0, 16),
+    { name: "AES-CTR" },
+    false,
+    ["encrypt"],
+  );
+  return {
+    cipher: new CtrCipher(cipherKey, iv.subarray(0, blockSize)),
+    macKey: await crypto.subtle.importKey(
+      "raw",
+      macKey,
+      { name: "HMAC", hash: "SHA-256" },
+      false,
+      ["sign", "verify"],
+    ),
+  };
+}
+
+async function verifySignature(
+  blob: Uint8Array,
+  algorithm: string,
+  signatureBlob: Uint8Array,
+  data: Uint8Array,
+) {
+  try {
+    const keyReader = new SshReader(blob);
+    const keyType = keyReader.string();
+    const signatureReader = new SshReader(signatureBlob);
+    if (signatureReader.string() !== algorithm) {
+      return false;
+    }
+    const signature = signatureReader.bytes();
+
+    if (keyType === "ssh-ed25519") {
+      const key = await crypto.subtle.importKey(
+        "raw",
+        keyReader.bytes(),
+        { name: "Ed25519" },
+        false,
+        ["verify"],
+      );
+      return await crypto.subtle.verify("Ed25519", key, signature, data);
+    }
+
+    const e = stripZeros(keyReader.bytes());
+    const n = stripZeros(keyReader.bytes());
+    const key = await crypto.subtle.importKey(
+      "jwk",
+      { kty: "RSA", e: encodeBase64Url(e), n: encodeBase64Url(n) },
+      { name: "RSASSA-PKCS1-v1_5", hash: rsaHashes[algorithm] },
+      false,
+      ["verify"],
+    );
+    // Signatures can have their leading zeros stripped too
+    const padded = new Uint8Array(Math.max(n.length, signature.length));
+    padded.set(signature, padded.length - signature.length);
+    return await crypto.subtle.verify("RSASSA-PKCS1-v1_5", key, padded, data);
+  } catch (_) {
+    return false;
+  }
+}
+
+// In the same format as ssh-keygen -l
+async function fingerprint(blob: Uint8Array) {
+  return `SHA256:${encodeBase64(await sha256(blob)).replace(/=+$/, "")}`;
+}
+
+async function sha256(data: Uint8Array) {
+  return new Uint8Array(await crypto.subtle.digest("SHA-256", data));
+}
+
+class SshReader {
+  private data: Uint8Array;
+  private view: DataView;
+  private offset = 0;
+
+  constructor(data: Uint8Array) {
+    this.data = data;
+    this.view = new DataView(data.buffer, data.byteOffset, data.byteLength);
+  }
+
+  bool() {
+    if (this.offset >= this.data.length) {
+      throw new Error("Truncated message");
+    }
+    return this.data[this.offset++] !== 0;
+  }
+
+  uint32() {
+    if (this.offset + 4 > this.data.length) {
+      throw new Error("Truncated message");
+    }
+    const value = this.view.getUint32(this.offset);
+    this.offset += 4;
+    return value;
+  }
+
+  bytes() {
+    const length = this.uint32();
+    if (this.offset + length > this.data.length) {
+      throw new Error("Truncated message");
+    }
+    const value = this.data.subarray(this.offset, this.offset + length);
+    this.offset += length;
+    return value;
+  }
+
+  string() {
+    return decoder.decode(this.bytes());
+  }
+}
+
+function uint32(value: number) {
+  const bytes = new Uint8Array(4);
+  new DataView(bytes.buffer).setUint32(0, value);
+  return bytes;
+}
+
+function sshString(value: Uint8Array | string) {
+  const bytes = typeof value === "string" ? encoder.encode(value) : value;
+  return concat(uint32(bytes.length), bytes);
+}
+
+function mpint(bytes: Uint8Array) {
+  const value = stripZeros(bytes);
+  return sshString(
+    value[0] & 0x80 ? concat(Uint8Array.of(0), value) : value,
+  );
+}
+
+function stripZeros(bytes: Uint8Array) {
+  let start = 0;
+  while (start < bytes.length && bytes[start] === 0) {
+    start++;
+  }
+  return bytes.subarray(start);
+}
+
+function concat(...parts: Uint8Array[]) {
+  const result = new Uint8Array(
+    parts.reduce((length, part) => length + part.length, 0),
+  );
+  let offset = 0;
+  for (const part of parts) {
+    result.set(part, offset);
+    offset += part.length;
+  }
+  return result;
+}
+
+function equal(a: Uint8Array, b: Uint8Array) {
+  return a.length === b.length && a.every((byte, i) => byte === b[i]);
+}
+
+function hex(byte: number) {
+  return byte.toString(16).padStart(2, "0");
+}
@@ -0,0 +1,232 @@
+import {
+  assert,
+  assertEquals,
+  assertStringIncludes,
+} from "https://deno.land/std@0.208.0/assert/mod.ts";
+import { writeAll } from "https://deno.land/std@0.208.0/streams/write_all.ts";
+import { loadHostKey, SshConsole } from "./ssh.ts";
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+
+// Run against the system's OpenSSH client, so they're skipped without one
+const hasSsh = await new Deno.Command("ssh", { args: ["-V"], stderr: "null" })
+  .output().then(() => true, () => false);
+
+interface TestConsole {
+  dir: string;
+  port: number;
+  // Every command the console ran
+  commands: string[];
+}
+
+async function keygen(path: string, comment: string) {
+  const { success } = await new Deno.Command("ssh-keygen", {
+    args: ["-q", "-t", "ed25519", "-N", "", "-C", comment, "-f", path],
+  }).output();
+  assert(success, `ssh-keygen failed for ${path}`);
+}
+
+// Only operator's key is authorized, stranger's isn't
+function sshTest(name: string, fn: (test: TestConsole) => unknown) {
+  Deno.test({
+    name,
+    ignore: !hasSsh,
+    sanitizeOps: false,
+    sanitizeResources: false,
+    async fn() {
+      const dir = await Deno.makeTempDir();
+      await keygen(`${dir}/operator`, "operator@test");
+      await keygen(`${dir}/stranger`, "stranger@test");
+      await Deno.copyFile(`${dir}/operator.pub`, `${dir}/authorized_keys`);
+
+      const commands: string[] = [];
+      const sshConsole = new SshConsole({
+        hostKey: await loadHostKey(`${dir}/host_key.json`),
+        authorizedKeysPath: `${dir}/authorized_keys`,
+        runCommand: (line, operator) => {
+          commands.push(line);
+          console.log(`${operator} ran ${line}`);
+        },
+      });
+      const listener = Deno.listen({ hostname: "127.0.0.1", port: 0 });
+      sshConsole.serve(listener);
+      try {
+        await fn({ dir, port: listener.addr.port, commands });
+      } finally {
+        sshConsole.close();
+        await Deno.remove(dir, { recursive: true });
+      }
+    },
+  });
+}
+
+// Types input into a shell on the console, then hangs up
+async function ssh(
+  port: number,
+  identity: string,
+  input: string,
+  options: string[] = [],
+) {
+  const child = new Deno.Command("ssh", {
+    args: [
+      "-v",
+      "-T",
+      "-F",
+      "/dev/null",
+      "-i",
+      identity,
+      "-o",
+      "IdentitiesOnly=yes",
+      "-o",
+      "BatchMode=yes",
+      "-o",
+      "StrictHostKeyChecking=no",
+      "-o",
+      "UserKnownHostsFile=/dev/null",
+      "-p",
+      String(port),
+      ...options,
+      "operator@127.0.0.1",
+    ],
+    stdin: "piped",
+    stdout: "piped",
+    stderr: "piped",
+  }).spawn();
+  const writer = child.stdin.getWriter();
+  await writer.write(encoder.encode(input));
+  await writer.close();
+  const { code, stdout, stderr } = await child.output();
+  return {
+    code,
+    stdout: decoder.decode(stdout),
+    stderr: decoder.decode(stderr),
+  };
+}
+
+// Relays connections to port, flipping the last byte the client sends in the
+// first chunk after its NEWKEYS. That byte is always part of a MAC
+function corruptingProxy(port: number) {
+  const listener = Deno.listen({ hostname: "127.0.0.1", port: 0 });
+  (async () => {
+    for await (const client of listener) {
+      const server = await Deno.connect({ hostname: "127.0.0.1", port });
+      let sent = new Uint8Array(0);
+      let corrupted = false;
+      relay(client, server, (data) => {
+        if (!corrupted) {
+          sent = new Uint8Array([...sent, ...data]);
+          const encryptedFrom = endOfNewKeys(sent);
+          if (encryptedFrom !== undefined && encryptedFrom < sent.length) {
+            data[data.length - 1] ^= 1;
+            corrupted = true;
+          }
+        }
+        return data;
+      });
+      relay(server, client);
+    }
+  })();
+  return listener;
+}
+
+// Where the client's NEWKEYS ends, after its version line and the unencrypted
+// key exchange packets
+function endOfNewKeys(sent: Uint8Array) {
+  let offset = sent.indexOf(0x0a) + 1;
+  while (offset && offset + 6 <= sent.length) {
+    const length = new DataView(sent.buffer, offset).getUint32(0);
+    const type = sent[offset + 5];
+    offset += 4 + length;
+    if (offset > sent.length) {
+      return;
+    }
+    if (type === 21) {
+      return offset;
+    }
+  }
+}
+
+async function relay(
+  from: Deno.Conn,
+  to: Deno.Conn,
+  change = (data: Uint8Array) => data,
+) {
+  const buffer = new Uint8Array(32 * 1024);
+  try {
+    let read;
+    while ((read = await from.read(buffer)) !== null) {
+      await writeAll(to, change(buffer.slice(0, read)));
+    }
+  } catch (_) {
+    // Either side hanging up ends both
+  }
+  for (const connection of [from, to]) {
+    try {
+      connection.close();
+    } catch (_) {
+      // Already closed
+    }
+  }
+}
+
+sshTest("runs commands for an authorized key", async (test) => {
+  const { code, stdout, stderr } = await ssh(
+    test.port,
+    `${test.dir}/operator`,
+    "status\nrooms\n",
+  );
+
+  assertEquals(code, 0, stderr);
+  assertStringIncludes(stderr, "kex: algorithm: curve25519-sha256");
+  assertStringIncludes(stdout, "Anchor admin console");
+  assertStringIncludes(stdout, "ssh:operator@test ran status");
+  assertEquals(test.commands, ["status", "rooms"]);
+});
+
+sshTest("refuses a key that isn't authorized", async (test) => {
+  const { code, stderr } = await ssh(
+    test.port,
+    `${test.dir}/stranger`,
+    "status\n",
+  );
+
+  assertEquals(code, 255);
+  assertStringIncludes(stderr, "Permission denied (publickey)");
+  assertEquals(test.commands, []);
+});
+
+sshTest("carries on after the client rekeys", async (test) => {
+  const lines = Array.from({ length: 200 }, (_, i) => `say ${i}`);
+  const { code, stdout, stderr } = await ssh(
+    test.port,
+    `${test.dir}/operator`,
+    lines.join("\n") + "\n",
+    ["-o", "RekeyLimit=1K"],
+  );
+
+  assertEquals(code, 0, stderr);
+  assert(
+    stderr.split("SSH2_MSG_NEWKEYS received").length > 2,
+    "The client didn't rekey",
+  );
+  assertEquals(test.commands, lines);
+  assertStringIncludes(stdout, "ssh:operator@test ran say 199");
+});
+
+sshTest("disconnects on a bad MAC", async (test) => {
+  const proxy = corruptingProxy(test.port);
+  try {
+    const { code, stderr } = await ssh(
+      proxy.addr.port,
+      `${test.dir}/operator`,
+      "status\n",
+    );
+
+    assertEquals(code, 255);
+    assertStringIncludes(stderr, "Invalid packet MAC");
+    assertEquals(test.commands, []);
+  } finally {
+    proxy.close();
+  }
+});
@@ -0,0 +1,64 @@
+// Pushes metrics to a StatsD daemon, which can forward them on to Graphite,
+// for operators whose monitoring doesn't scrape Prometheus
+const encoder = new TextEncoder();
+
+const defaultPort = 8125;
+// Keeps each datagram under a typical MTU so it isn't fragmented
+const maxDatagramBytes = 1432;
+
+export class StatsdClient {
+  private connection: Deno.DatagramConn;
+  private address: Deno.NetAddr;
+  private lines: string[] = [];
+
+  // target is host:port, the port defaults to 8125
+  constructor(public readonly target: string, public prefix = "") {
+    const separator = target.lastIndexOf(":");
+    const hostname = separator === -1 ? target : target.slice(0, separator);
+    const port = separator === -1
+      ? defaultPort
+      : parseInt(target.slice(separator + 1));
+    if (!hostname || !Number.isInteger(port)) {
+      throw new Error(`Invalid StatsD address ${target}`);
+    }
+
+    this.address = { transport: "udp", hostname, port };
+    this.connection = Deno.listenDatagram({
+      transport: "udp",
+      hostname: "0.0.0.0",
+      port: 0,
+    });
+  }
+
+  gauge(name: string, value: number) {
+    this.lines.push(`${this.prefix}${name}:${value}|g`);
+  }
+
+  count(name: string, value: number) {
+    if (value) {
+      this.lines.push(`${this.prefix}${name}:${value}|c`);
+    }
+  }
+
+  // Sends everything queued since the last flush
+  async flush() {
+    const lines = this.lines;
+    this.lines = [];
+
+    let datagram = "";
+    for (const line of lines) {
+      if (datagram && datagram.length + line.length + 1 > maxDatagramBytes) {
+        await this.connection.send(encoder.encode(datagram), this.address);
+        datagram = "";
+      }
+      datagram += datagram ? `\n${line}` : line;
+    }
+    if (datagram) {
+      await this.connection.send(encoder.encode(datagram), this.address);
+    }
+  }
+
+  close() {
+    this.connection.close();
+  }
+}
@@ -0,0 +1,209 @@
+// Full screen dashboard for attended servers, started with --tui. Rooms,
+// clients and packet rates update live above the log, with console commands
+// typed on the bottom line instead of interleaved with log output
+import { formatDuration, type Server, version } from "./server.ts";
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+
+const refreshMs = 1000;
+const maxLogLines = 500;
+const roomRows = 8;
+const clientRows = 8;
+
+const enterAlternateScreen = "\x1b[?1049h";
+const leaveAlternateScreen = "\x1b[?1049l";
+const clearScreen = "\x1b[H\x1b[2J";
+
+export class Dashboard {
+  private server: Server;
+  private runCommand: (line: string) => void;
+  private logLines: string[] = [];
+  private input = "";
+  private refreshTimer?: number;
+  private originalConsole?: Pick<Console, "log" | "error">;
+  // Packets per second by type, from the change in packetStats
+  private rates: Record<string, { received: number; sent: number }> = {};
+  private lastTotals: Record<string, { received: number; sent: number }> = {};
+  private lastRefresh = Date.now();
+
+  constructor(server: Server, runCommand: (line: string) => void) {
+    this.server = server;
+    this.runCommand = runCommand;
+  }
+
+  // Throws if stdin isn't a terminal
+  start() {
+    if (!Deno.stdin.isTerminal()) {
+      throw new Error("The dashboard needs a terminal");
+    }
+
+    // Everything logged, command output included, goes to the log pane
+    this.originalConsole = { log: console.log, error: console.error };
+    console.log = (...data) => this.addLogLine(data);
+    console.error = (...data) => this.addLogLine(data);
+
+    Deno.stdin.setRaw(true);
+    this.write(enterAlternateScreen);
+    this.readInput();
+    this.refresh();
+  }
+
+  stop() {
+    if (!this.originalConsole) {
+      return;
+    }
+
+    clearTimeout(this.refreshTimer);
+    Object.assign(console, this.originalConsole);
+    this.originalConsole = undefined;
+    this.write(leaveAlternateScreen);
+    try {
+      Deno.stdin.setRaw(false);
+    } catch (_) {
+      // stdin is already closed
+    }
+  }
+
+  get isRunning() {
+    return !!this.originalConsole;
+  }
+
+  private addLogLine(data: unknown[]) {
+    const text = data.map((d) => typeof d === "string" ? d : Deno.inspect(d))
+      .join(" ");
+    this.logLines.push(...text.split("\n"));
+    this.logLines.splice(0, this.logLines.length - maxLogLines);
+  }
+
+  private async readInput() {
+    for await (const chunk of Deno.stdin.readable) {
+      // Escape sequences, like the arrow keys, aren't supported
+      if (chunk[0] === 0x1b) {
+        continue;
+      }
+
+      for (const byte of chunk) {
+        if (byte === 0x03) { // Ctrl+C, raw mode doesn't send SIGINT
+          // Clients are told and stats saved, the process exits once stopped
+          this.server.stop("Server shutting down").catch((error) => {
+            this.addLogLine([`Error stopping: ${error.message}`]);
+          });
+        } else if (byte === 0x0d || byte === 0x0a) {
+          const line = this.input.trim();
+          this.input = "";
+          if (line) {
+            this.addLogLine([`> ${line}`]);
+            this.runCommand(line);
+          }
+        } else if (byte === 0x7f || byte === 0x08) {
+          this.input = this.input.slice(0, -1);
+        } else if (byte >= 0x20) {
+          // Streamed, as multibyte characters arrive a byte at a time here
+          this.input += decoder.decode(new Uint8Array([byte]), {
+            stream: true,
+          });
+        }
+      }
+      this.render();
+    }
+  }
+
+  private refresh() {
+    const elapsedSeconds = Math.max((Date.now() - this.lastRefresh) / 1000, 1);
+    this.lastRefresh = Date.now();
+    this.rates = {};
+    for (const [type, stats] of Object.entries(this.server.packetStats)) {
+      const last = this.lastTotals[type] ?? { received: 0, sent: 0 };
+      this.rates[type] = {
+        received: (stats.received - last.received) / elapsedSeconds,
+        sent: (stats.sent - last.sent) / elapsedSeconds,
+      };
+      this.lastTotals[type] = { received: stats.received, sent: stats.sent };
+    }
+
+    this.render();
+    this.refreshTimer = setTimeout(() => this.refresh(), refreshMs);
+  }
+
+  private render() {
+    const { columns, rows } = Deno.consoleSize();
+    const { server } = this;
+    const activeRooms = server.rooms.filter((room) => room.clients.length);
+    const rates = Object.entries(this.rates)
+      .filter(([, rate]) => rate.received || rate.sent)
+      .sort(([, a], [, b]) => b.received + b.sent - a.received - a.sent);
+    const total = rates.reduce(
+      (sum, [, rate]) => sum + rate.received + rate.sent,
+      0,
+    );
+
+    const lines = [
+      [
+        `Anchor ${version}`,
+        `up ${formatDuration(Date.now() - server.startedAt)}`,
+        `${server.clients.length} clients`,
+        `${server.rooms.length} rooms (${activeRooms.length} active)`,
+        `${total.toFixed(0)} packets/s`,
+      ].join(" | "),
+    ];
+
+    // Rooms on the left, packet rates on the right
+    const half = Math.floor(columns / 2);
+    const rooms = [...server.rooms]
+      .sort((a, b) => b.clients.length - a.clients.length)
+      .map((room) =>
+        `${room.id} ${room.clients.length} clients${
+          room.gameId ? ` ${room.gameId}` : ""
+        }${room.title ? ` ${JSON.stringify(room.title)}` : ""}`
+      );
+    const rateLines = rates.map(([type, rate]) =>
+      `${type} in ${rate.received.toFixed(1)} out ${rate.sent.toFixed(1)}`
+    );
+    lines.push(
+      pad(heading("Rooms", half), half) + heading("Packets/s", columns - half),
+    );
+    for (let i = 0; i < roomRows; i++) {
+      lines.push(pad(rooms[i] ?? "", half) + (rateLines[i] ?? ""));
+    }
+
+    lines.push(heading("Clients", columns));
+    const clients = server.clients.slice(0, clientRows).map((client) =>
+      `${client.id} ${JSON.stringify(client.data.name ?? "")} room ${
+        client.room?.id ?? "none"
+      } team ${client.teamId} ${client.rtt ?? "?"}ms`
+    );
+    for (let i = 0; i < clientRows; i++) {
+      lines.push(clients[i] ?? "");
+    }
+
+    lines.push(heading("Log", columns));
+    const logRows = Math.max(rows - lines.length - 1, 0);
+    lines.push(
+      ...(logRows ? this.logLines.slice(-logRows) : []),
+      ...Array(Math.max(logRows - this.logLines.length, 0)).fill(""),
+    );
+    lines.push(`> ${this.input}`);
+
+    this.write(
+      clearScreen +
+        lines.map((line) => line.slice(0, columns)).join("\r\n"),
+    );
+  }
+
+  private write(text: string) {
+    const data = encoder.encode(text);
+    let written = 0;
+    while (written < data.length) {
+      written += Deno.stdout.writeSync(data.subarray(written));
+    }
+  }
+}
+
+function heading(title: string, width: number) {
+  return `── ${title} `.padEnd(width, "─");
+}
+
+function pad(text: string, width: number) {
+  return text.slice(0, width - 1).padEnd(width);
+}
@@ -0,0 +1,68 @@
+// Posts server events to community sites as JSON. With a secret, each request
+// is signed so receivers can check it came from this server
+import { encodeHex } from "https://deno.land/std@0.208.0/encoding/hex.ts";
+
+const encoder = new TextEncoder();
+
+const timeoutMs = 10 * 1000;
+// Doubled after each failed attempt
+const retryDelayMs = 1000;
+
+// Throws once every attempt has failed
+export async function postWebhook(
+  url: string,
+  body: string,
+  secret: string | undefined,
+  retries: number,
+) {
+  const headers: Record<string, string> = {
+    "Content-Type": "application/json",
+    "User-Agent": "Anchor",
+  };
+  if (secret) {
+    headers["X-Anchor-Signature"] = `sha256=${await sign(secret, body)}`;
+  }
+
+  for (let attempt = 0;; attempt++) {
+    let failure: string;
+    let retryable = true;
+    try {
+      const response = await fetch(url, {
+        method: "POST",
+        headers,
+        body,
+        signal: AbortSignal.timeout(timeoutMs),
+      });
+      await response.body?.cancel();
+      if (response.ok) {
+        return;
+      }
+      failure = `HTTP ${response.status}`;
+      // The request itself was rejected, sending it again won't help
+      retryable = response.status >= 500 || response.status === 429;
+    } catch (error) {
+      failure = error.message;
+    }
+
+    if (!retryable || attempt >= retries) {
+      throw new Error(failure);
+    }
+    await new Promise((resolve) =>
+      setTimeout(resolve, retryDelayMs * 2 ** attempt)
+    );
+  }
+}
+
+// Hex encoded HMAC-SHA256 of the body, like GitHub's X-Hub-Signature-256
+export async function sign(secret: string, body: string) {
+  const key = await crypto.subtle.importKey(
+    "raw",
+    encoder.encode(secret),
+    { name: "HMAC", hash: "SHA-256" },
+    false,
+    ["sign"],
+  );
+  return encodeHex(
+    await crypto.subtle.sign("HMAC", key, encoder.encode(body)),
+  );
+}
@@ -0,0 +1,143 @@
+// WebSocket transport for browser clients, which can't open raw TCP sockets.
+// Each message the client sends is one packet, the null terminator optional,
+// and each packet it's sent arrives as a text message ending in one
+import type { Connection, Listener } from "./server.ts";
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+
+// WebSockets have no drain event, so bufferedAmount is checked this often
+const drainPollMs = 10;
+
+export interface WebSocketListenOptions {
+  hostname: string;
+  port: number;
+  // PEM encoded, for wss://
+  cert?: string;
+  key?: string;
+}
+
+class WebSocketConnection implements Connection {
+  private socket: WebSocket;
+  private chunks: Uint8Array[] = [];
+  private closed = false;
+  private waiter?: () => void;
+
+  constructor(socket: WebSocket, public readonly remoteAddr: Deno.Addr) {
+    this.socket = socket;
+    socket.binaryType = "arraybuffer";
+    socket.onmessage = ({ data }) => {
+      const chunk = typeof data === "string"
+        ? encoder.encode(data)
+        : new Uint8Array(data);
+      this.chunks.push(chunk);
+      if (chunk.at(-1) !== 0) {
+        this.chunks.push(new Uint8Array([0]));
+      }
+      this.wake();
+    };
+    socket.onclose = () => {
+      this.closed = true;
+      this.wake();
+    };
+  }
+
+  async read(buffer: Uint8Array) {
+    while (!this.chunks.length && !this.closed) {
+      await new Promise<void>((resolve) => this.waiter = resolve);
+    }
+    const chunk = this.chunks[0];
+    if (!chunk) {
+      return null;
+    }
+
+    const count = Math.min(buffer.length, chunk.length);
+    buffer.set(chunk.subarray(0, count));
+    if (count === chunk.length) {
+      this.chunks.shift();
+    } else {
+      this.chunks[0] = chunk.subarray(count);
+    }
+    return count;
+  }
+
+  // Client writes a whole encoded packet at a time, so each is one message.
+  // Resolves once it's been sent rather than buffered, so a slow client backs
+  // up the client's outbox and hits its write deadline like over TCP
+  async write(data: Uint8Array) {
+    if (this.socket.readyState !== WebSocket.OPEN) {
+      throw new Error("WebSocket is closed");
+    }
+    this.socket.send(decoder.decode(data));
+    while (this.socket.bufferedAmount > 0) {
+      await new Promise((resolve) => setTimeout(resolve, drainPollMs));
+      if (this.socket.readyState !== WebSocket.OPEN) {
+        throw new Error("WebSocket is closed");
+      }
+    }
+    return data.length;
+  }
+
+  close() {
+    this.socket.close();
+  }
+
+  private wake() {
+    const waiter = this.waiter;
+    this.waiter = undefined;
+    waiter?.();
+  }
+}
+
+// Binds before returning, like Deno.listen. Requests that aren't a WebSocket
+// upgrade, on any path, get a 426
+export function listenWebSocket(options: WebSocketListenOptions): Listener {
+  const connections: WebSocketConnection[] = [];
+  let closed = false;
+  let waiter: (() => void) | undefined;
+  const wake = () => {
+    const resolve = waiter;
+    waiter = undefined;
+    resolve?.();
+  };
+
+  const server = Deno.serve({
+    hostname: options.hostname,
+    port: options.port,
+    cert: options.cert,
+    key: options.key,
+    onListen: () => {},
+  }, (request, info) => {
+    if (request.headers.get("upgrade")?.toLowerCase() !== "websocket") {
+      return new Response("Upgrade Required", { status: 426 });
+    }
+
+    const { socket, response } = Deno.upgradeWebSocket(request);
+    socket.onopen = () => {
+      connections.push(new WebSocketConnection(socket, info.remoteAddr));
+      wake();
+    };
+    return response;
+  });
+
+  return {
+    async *[Symbol.asyncIterator]() {
+      while (true) {
+        while (!connections.length && !closed) {
+          await new Promise<void>((resolve) => waiter = resolve);
+        }
+        const connection = connections.shift();
+        if (!connection) {
+          return;
+        }
+        yield connection;
+      }
+    },
+    close() {
+      closed = true;
+      connections.splice(0).forEach((connection) => connection.close());
+      wake();
+      server.shutdown();
+    },
+  };
+}